@@ -11,8 +11,16 @@ import (
 func main() {
 	var filePath string
 	var generateGraphs bool
+	var options string
+	var measFile string
+	var rawFile string
+	var csvFile string
 	flag.StringVar(&filePath, "path", "", "Spice file path")
 	flag.BoolVar(&generateGraphs, "graphs", false, "Generate graphs")
+	flag.StringVar(&options, "options", "", "Simulator options overriding the netlist's .options, e.g. \"reltol=1e-4 method=trap\"")
+	flag.StringVar(&measFile, "meas", "", "CSV file to write the .meas results to")
+	flag.StringVar(&rawFile, "raw", "", "ASCII rawfile to write the transient results to")
+	flag.StringVar(&csvFile, "csv", "", "CSV file to write the transient results to")
 	flag.Parse()
 
 	if filePath == "" {
@@ -27,5 +35,14 @@ func main() {
 		os.Exit(1)
 	}
 
-	internal.ParserInit(filePath, generateGraphs)
+	if rawFile != "" {
+		internal.SinkRegister(internal.SinkNewRawfile(rawFile))
+	}
+	if csvFile != "" {
+		internal.SinkRegister(internal.SinkNewCSV(csvFile))
+	}
+
+	if internal.ParserInit(filePath, generateGraphs, options, measFile) {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,433 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"os"
+	"sort"
+)
+
+type acSweep struct {
+	sweepType string // dec, oct or lin
+	points    int    // points per decade/octave, or total points for lin
+	fStart    float64
+	fStop     float64
+}
+
+func acFrequencies(sweep acSweep) []float64 {
+	frequencies := make([]float64, 0)
+
+	switch sweep.sweepType {
+	case "dec", "oct":
+		base := 10.0
+		if sweep.sweepType == "oct" {
+			base = 2.0
+		}
+		// Small tolerance so fStop itself is not lost to rounding
+		n := int(math.Floor(math.Log(sweep.fStop/sweep.fStart)/math.Log(base)*float64(sweep.points) + 1e-9))
+		for i := 0; i <= n; i++ {
+			frequencies = append(frequencies, sweep.fStart*math.Pow(base, float64(i)/float64(sweep.points)))
+		}
+	case "lin":
+		if sweep.points == 1 {
+			return append(frequencies, sweep.fStart)
+		}
+		step := (sweep.fStop - sweep.fStart) / float64(sweep.points-1)
+		for i := 0; i < sweep.points; i++ {
+			frequencies = append(frequencies, sweep.fStart+float64(i)*step)
+		}
+	}
+
+	return frequencies
+}
+
+// acSolve runs the small-signal sweep and returns the frequencies, the solution at each of them and the indices
+// of the branch currents.
+func acSolve(elementList *Element, nodesMap map[string]int, sweep acSweep, conditions mnaConditions,
+	options SimOptions) ([]float64, [][]complex128, map[string]int) {
+	staticH, Xop, currentNodes := acLinearize(elementList, nodesMap, conditions, options)
+
+	frequencies := acFrequencies(sweep)
+	X := make([][]complex128, 0, len(frequencies))
+
+	for _, f := range frequencies {
+		H, B := acSystem(elementList, currentNodes, staticH, 2.0*math.Pi*f, Xop, options)
+		LU, P := acLUFactorization(H)
+		X = append(X, acLUSolve(LU, P, B))
+	}
+
+	return frequencies, X, currentNodes
+}
+
+// acLinearize returns the part of the small-signal system that does not depend on frequency, the operating point
+// the nonlinear elements are linearized around and the indices of the branch currents.
+func acLinearize(elementList *Element, nodesMap map[string]int, conditions mnaConditions,
+	options SimOptions) ([][]float64, []float64, map[string]int) {
+	mnaIdentifyGroups(elementList)
+	currentNodes := assignIndicesToCurrentNodes(elementList, nodesMap)
+	size := len(nodesMap) + len(currentNodes) - 1
+
+	staticH := acStaticMatrix(elementList, currentNodes, size)
+
+	// Nonlinear elements are linearized around the operating point
+	Xop, _, _ := mnaOperatingPoint(elementList, currentNodes, size, conditions, options, mnaStateDC)
+
+	return staticH, Xop, currentNodes
+}
+
+// acStaticMatrix returns the stamps of the elements that do not depend on frequency: resistors and controlled
+// sources.
+func acStaticMatrix(elementList *Element, currentNodes map[string]int, size int) [][]float64 {
+	staticH := make([][]float64, size)
+	for i := range staticH {
+		staticH[i] = make([]float64, size)
+	}
+	staticB := make([]float64, size)
+	mnaBuildStaticMatrices(elementList, currentNodes, staticH, staticB)
+	return staticH
+}
+
+// acSystem returns the small-signal matrix and excitations at angular frequency w.
+func acSystem(elementList *Element, currentNodes map[string]int, staticH [][]float64, w float64, Xop []float64,
+	options SimOptions) ([][]complex128, []complex128) {
+	H := make([][]complex128, len(staticH))
+	for i := range H {
+		H[i] = make([]complex128, len(staticH))
+		for j := range H[i] {
+			H[i][j] = complex(staticH[i][j], 0.0)
+		}
+	}
+	B := make([]complex128, len(staticH))
+
+	acBuildMatrices(elementList, currentNodes, H, B, w, Xop, options)
+	return H, B
+}
+
+// acBuildMatrices stamps the frequency dependent elements, the small-signal models of the nonlinear elements
+// around the operating point Xop and the small-signal excitations at angular frequency w. Without Xop the nonlinear
+// elements are left out, for analyses that handle them in time.
+func acBuildMatrices(elementList *Element, currentNodes map[string]int, H [][]complex128, B []complex128, w float64, Xop []float64, options SimOptions) {
+	e := elementList
+
+	for e != nil {
+		switch e.ElementType {
+		case ElementBJT, ElementDiode, ElementMOSFET:
+			fmt.Fprintf(os.Stderr, "MNA Error: Element not implemented.\n")
+			os.Exit(1)
+		case ElementCCCS, ElementCCVS, ElementResistor, ElementVCCS, ElementVCVS, ElementProbe:
+			// Treated as static
+		case ElementCapacitor:
+			// jwC (v1 - v2) - i = 0
+			b := currentNodes[e.Label] - 1
+			y := complex(0.0, w*e.Value)
+			if e.Nodes[0] != 0 {
+				H[e.Nodes[0]-1][b] += 1.0
+				H[b][e.Nodes[0]-1] += y
+			}
+			if e.Nodes[1] != 0 {
+				H[e.Nodes[1]-1][b] -= 1.0
+				H[b][e.Nodes[1]-1] -= y
+			}
+			H[b][b] -= 1.0
+		case ElementInductor:
+			// v1 - v2 - jwL i = 0
+			b := currentNodes[e.Label] - 1
+			if e.Nodes[0] != 0 {
+				H[e.Nodes[0]-1][b] += 1.0
+				H[b][e.Nodes[0]-1] += 1.0
+			}
+			if e.Nodes[1] != 0 {
+				H[e.Nodes[1]-1][b] -= 1.0
+				H[b][e.Nodes[1]-1] -= 1.0
+			}
+			H[b][b] -= complex(0.0, w*e.Value)
+		case ElementCurrentSource:
+			if !e.PreserveCurrent {
+				if e.Nodes[0] != 0 {
+					B[e.Nodes[0]-1] -= e.AC
+				}
+				if e.Nodes[1] != 0 {
+					B[e.Nodes[1]-1] += e.AC
+				}
+			} else {
+				b := currentNodes[e.Label] - 1
+				if e.Nodes[0] != 0 {
+					H[e.Nodes[0]-1][b] += 1.0
+				}
+				if e.Nodes[1] != 0 {
+					H[e.Nodes[1]-1][b] -= 1.0
+				}
+				H[b][b] += 1.0
+				B[b] += e.AC
+			}
+		case ElementVoltageSource:
+			b := currentNodes[e.Label] - 1
+			if e.Nodes[0] != 0 {
+				H[e.Nodes[0]-1][b] += 1.0
+				H[b][e.Nodes[0]-1] += 1.0
+			}
+			if e.Nodes[1] != 0 {
+				H[e.Nodes[1]-1][b] -= 1.0
+				H[b][e.Nodes[1]-1] -= 1.0
+			}
+			B[b] += e.AC
+		case ElementTLine:
+			// Exact lossless line: v1 - z0*i1 = exp(-jw*td) (v2 + z0*i2), and symmetrically for port 2
+			desc := e.Extra.(*tlineDescriptor)
+			d := cmplx.Exp(complex(0.0, -w*desc.td))
+			ports := [2][2]int{{e.Nodes[0], e.Nodes[1]}, {e.Nodes[2], e.Nodes[3]}}
+			branches := [2]int{currentNodes[e.Label+"#1"] - 1, currentNodes[e.Label+"#2"] - 1}
+
+			for p := 0; p < 2; p++ {
+				q := 1 - p
+				if ports[p][0] != 0 {
+					H[ports[p][0]-1][branches[p]] += 1.0
+					H[branches[p]][ports[p][0]-1] += 1.0
+				}
+				if ports[p][1] != 0 {
+					H[ports[p][1]-1][branches[p]] -= 1.0
+					H[branches[p]][ports[p][1]-1] -= 1.0
+				}
+				if ports[q][0] != 0 {
+					H[branches[p]][ports[q][0]-1] -= d
+				}
+				if ports[q][1] != 0 {
+					H[branches[p]][ports[q][1]-1] += d
+				}
+				H[branches[p]][branches[p]] -= complex(desc.z0, 0.0)
+				H[branches[p]][branches[q]] -= d * complex(desc.z0, 0.0)
+			}
+		case ElementLossyLine:
+			acStampLossyLine(e, currentNodes, H, w)
+		case ElementJFET:
+			if Xop != nil {
+				acStampJFET(e, H, w, Xop, options.Gmin)
+			}
+		case ElementNetwork:
+			Y := touchstoneAdmittance(e.Extra.(*touchstoneDescriptor).data, w/(2.0*math.Pi))
+			touchstoneStamp(e, Y, func(row int, column int, y complex128) {
+				H[row][column] += y
+			})
+		}
+
+		e = e.Next
+	}
+}
+
+// acStampLossyLine stamps the exact chain (ABCD) parameters of a RLGC line:
+// v1 = A v2 + B i2, i1 = C v2 + D i2, where i1 enters port 1 and i2 leaves port 2.
+// Only the first and last section currents of the transient ladder are used, the other
+// internal unknowns are pinned to zero.
+func acStampLossyLine(e *Element, currentNodes map[string]int, H [][]complex128, w float64) {
+	desc := e.Extra.(*ltraDescriptor)
+	n := desc.segments
+
+	z := complex(desc.r, w*desc.l)
+	y := complex(desc.g, w*desc.c)
+	gl := cmplx.Sqrt(z*y) * complex(desc.length, 0.0)
+	sinhc := complex(1.0, 0.0)
+	if gl != 0 {
+		sinhc = cmplx.Sinh(gl) / gl
+	}
+	a := cmplx.Cosh(gl)
+	b := z * complex(desc.length, 0.0) * sinhc
+	c := y * complex(desc.length, 0.0) * sinhc
+
+	for k := 2; k < n; k++ {
+		i := currentNodes[mnaLossyLineCurrent(e, k)] - 1
+		H[i][i] += 1.0
+	}
+	for k := 1; k < n; k++ {
+		i := currentNodes[mnaLossyLineVoltage(e, k)] - 1
+		H[i][i] += 1.0
+	}
+
+	i1 := currentNodes[mnaLossyLineCurrent(e, 1)] - 1
+	i2 := currentNodes[mnaLossyLineCurrent(e, n)] - 1
+
+	if e.Nodes[0] != 0 {
+		H[e.Nodes[0]-1][i1] += 1.0
+		H[i1][e.Nodes[0]-1] += 1.0
+	}
+	if e.Nodes[1] != 0 {
+		H[e.Nodes[1]-1][i1] -= 1.0
+		H[i1][e.Nodes[1]-1] -= 1.0
+	}
+	if e.Nodes[2] != 0 {
+		H[e.Nodes[2]-1][i2] -= 1.0
+		H[i1][e.Nodes[2]-1] -= a
+		H[i2][e.Nodes[2]-1] -= c
+	}
+	if e.Nodes[3] != 0 {
+		H[e.Nodes[3]-1][i2] += 1.0
+		H[i1][e.Nodes[3]-1] += a
+		H[i2][e.Nodes[3]-1] += c
+	}
+	H[i1][i2] -= b
+	H[i2][i1] += 1.0
+	H[i2][i2] -= a
+}
+
+func acStampJFET(e *Element, H [][]complex128, w float64, Xop []float64, gmin float64) {
+	desc := e.Extra.(*jfetDescriptor)
+	d, g, s := e.Nodes[0], e.Nodes[1], e.Nodes[2]
+
+	vgs := desc.polarity * mnaVoltageAcross(Xop, g, s)
+	vgd := desc.polarity * mnaVoltageAcross(Xop, g, d)
+	_, gm, gds := jfetDrainCurrent(desc, vgs, vgs-vgd)
+	_, ggs := jfetJunctionCurrent(desc, vgs, gmin)
+	_, ggd := jfetJunctionCurrent(desc, vgd, gmin)
+	_, cgs := jfetJunctionCharge(desc, desc.cgs, vgs)
+	_, cgd := jfetJunctionCharge(desc, desc.cgd, vgd)
+
+	acStampAdmittance(H, g, s, complex(ggs, w*cgs))
+	acStampAdmittance(H, g, d, complex(ggd, w*cgd))
+	acStampTransadmittance(H, d, s, g, s, complex(gm, 0.0))
+	acStampAdmittance(H, d, s, complex(gds, 0.0))
+}
+
+// acStampAdmittance stamps an admittance y between nodes n1 and n2.
+func acStampAdmittance(H [][]complex128, n1 int, n2 int, y complex128) {
+	if n1 != 0 {
+		H[n1-1][n1-1] += y
+	}
+	if n1 != 0 && n2 != 0 {
+		H[n1-1][n2-1] -= y
+		H[n2-1][n1-1] -= y
+	}
+	if n2 != 0 {
+		H[n2-1][n2-1] += y
+	}
+}
+
+// acStampTransadmittance stamps a current y*(v(c1) - v(c2)) flowing from n1 to n2 through the element.
+func acStampTransadmittance(H [][]complex128, n1 int, n2 int, c1 int, c2 int, y complex128) {
+	if n1 != 0 && c1 != 0 {
+		H[n1-1][c1-1] += y
+	}
+	if n1 != 0 && c2 != 0 {
+		H[n1-1][c2-1] -= y
+	}
+	if n2 != 0 && c1 != 0 {
+		H[n2-1][c1-1] -= y
+	}
+	if n2 != 0 && c2 != 0 {
+		H[n2-1][c2-1] += y
+	}
+}
+
+// acLUFactorization factors H in place of a copy using partial pivoting. P[i] is the original row stored at row i.
+func acLUFactorization(H [][]complex128) ([][]complex128, []int) {
+	n := len(H)
+	P := make([]int, n)
+	LU := make([][]complex128, n)
+	for i := range H {
+		P[i] = i
+		LU[i] = make([]complex128, n)
+		copy(LU[i], H[i])
+	}
+
+	for k := 0; k < n; k++ {
+		kMax := k
+		for l := k + 1; l < n; l++ {
+			if cmplx.Abs(LU[l][k]) > cmplx.Abs(LU[kMax][k]) {
+				kMax = l
+			}
+		}
+
+		LU[k], LU[kMax] = LU[kMax], LU[k]
+		P[k], P[kMax] = P[kMax], P[k]
+
+		if LU[k][k] == 0 {
+			continue
+		}
+
+		for i := k + 1; i < n; i++ {
+			LU[i][k] = LU[i][k] / LU[k][k]
+			for j := k + 1; j < n; j++ {
+				LU[i][j] = LU[i][j] - LU[i][k]*LU[k][j]
+			}
+		}
+	}
+
+	return LU, P
+}
+
+func acLUSolve(LU [][]complex128, P []int, B []complex128) []complex128 {
+	n := len(LU)
+	X := make([]complex128, n)
+
+	// Progressive substitution (L has unit diagonal)
+	for i := 0; i < n; i++ {
+		X[i] = B[P[i]]
+		for j := 0; j < i; j++ {
+			X[i] -= LU[i][j] * X[j]
+		}
+	}
+
+	// Regressive substitution
+	for i := n - 1; i >= 0; i-- {
+		for j := i + 1; j < n; j++ {
+			X[i] -= LU[i][j] * X[j]
+		}
+		X[i] = X[i] / LU[i][i]
+	}
+
+	return X
+}
+
+// acSortedKeys returns the keys of an index map ordered by their index.
+func acSortedKeys(indexMap map[string]int) []string {
+	keys := make([]string, 0, len(indexMap))
+	for k := range indexMap {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return indexMap[keys[i]] < indexMap[keys[j]]
+	})
+	return keys
+}
+
+// acUnwrapPhase returns the phase in degrees moved by whole turns to within 180 degrees of the phase before it
+// along the sweep, so that phases read continuously across frequency.
+func acUnwrapPhase(phase float64, previous float64) float64 {
+	return phase - 360.0*math.Round((phase-previous)/360.0)
+}
+
+// acPhases returns the phases in degrees of every frequency of the solutions, each unknown unwrapped along the
+// sweep.
+func acPhases(X [][]complex128) [][]float64 {
+	phases := make([][]float64, len(X))
+	for i := range X {
+		phases[i] = make([]float64, len(X[i]))
+		for j, x := range X[i] {
+			phases[i][j] = cmplx.Phase(x) * 180.0 / math.Pi
+			if i > 0 {
+				phases[i][j] = acUnwrapPhase(phases[i][j], phases[i-1][j])
+			}
+		}
+	}
+	return phases
+}
+
+func acPrintResults(frequencies []float64, X [][]complex128, nodesMap map[string]int, currentNodes map[string]int, digits int) {
+	nodes := acSortedKeys(nodesMap)
+	currents := acSortedKeys(currentNodes)
+	phases := acPhases(X)
+
+	fmt.Printf("AC Analysis:\n")
+	for i, f := range frequencies {
+		fmt.Printf("\n\tf = %e Hz\n", f)
+		for _, k := range nodes {
+			if v := nodesMap[k]; v != 0 {
+				fmt.Printf("\tV(%s) = %e V / %.*f deg\n", k, cmplx.Abs(X[i][v-1]), digits, phases[i][v-1])
+			}
+		}
+		for _, k := range currents {
+			if v := currentNodes[k]; v != 0 && !mnaIsInternal(k) {
+				fmt.Printf("\tI(%s) = %e A / %.*f deg\n", k, cmplx.Abs(X[i][v-1]), digits, phases[i][v-1])
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+type DiagnosticSeverity int
+
+const (
+	DiagnosticError   DiagnosticSeverity = iota
+	DiagnosticWarning DiagnosticSeverity = iota
+)
+
+type Diagnostic struct {
+	Severity DiagnosticSeverity
+	File     string
+	Line     int
+	Column   int
+	Message  string
+}
+
+func diagnosticSort(diagnostics []Diagnostic) {
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		if diagnostics[i].File != diagnostics[j].File {
+			return diagnostics[i].File < diagnostics[j].File
+		}
+		if diagnostics[i].Line != diagnostics[j].Line {
+			return diagnostics[i].Line < diagnostics[j].Line
+		}
+		return diagnostics[i].Column < diagnostics[j].Column
+	})
+}
+
+// diagnosticReport prints every diagnostic followed by a summary and returns the number of errors.
+func diagnosticReport(diagnostics []Diagnostic) int {
+	sources := make(map[string][]string)
+	errors := 0
+	warnings := 0
+
+	for _, d := range diagnostics {
+		lines, loaded := sources[d.File]
+		if !loaded {
+			data, err := ioutil.ReadFile(d.File)
+			if err == nil {
+				lines = strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+			}
+			sources[d.File] = lines
+		}
+		diagnosticPrint(d, lines)
+
+		if d.Severity == DiagnosticError {
+			errors = errors + 1
+		} else {
+			warnings = warnings + 1
+		}
+	}
+
+	if errors > 0 || warnings > 0 {
+		fmt.Fprintf(os.Stderr, "%d error(s), %d warning(s)\n", errors, warnings)
+	}
+	return errors
+}
+
+// diagnosticPrint prints "file:line:column: severity: message" followed by the offending line
+// and a caret under the reported column.
+func diagnosticPrint(d Diagnostic, lines []string) {
+	severity := "error"
+	if d.Severity == DiagnosticWarning {
+		severity = "warning"
+	}
+	if d.Line == 0 {
+		// Not tied to a position of the file
+		fmt.Fprintf(os.Stderr, "%s: %s: %s\n", d.File, severity, d.Message)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s:%d:%d: %s: %s\n", d.File, d.Line, d.Column, severity, d.Message)
+
+	if d.Line < 1 || d.Line > len(lines) {
+		return
+	}
+	line := lines[d.Line-1]
+
+	// Keep tabs in the caret prefix so it lines up with the source line
+	var caret strings.Builder
+	for i := 0; i < d.Column-1; i++ {
+		if i < len(line) && line[i] == '\t' {
+			caret.WriteByte('\t')
+		} else {
+			caret.WriteByte(' ')
+		}
+	}
+	caret.WriteByte('^')
+
+	fmt.Fprintf(os.Stderr, "    %s\n    %s\n", line, caret.String())
+}
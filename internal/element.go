@@ -17,6 +17,11 @@ const (
 	ElementDiode         ElementType = 9
 	ElementBJT           ElementType = 10
 	ElementMOSFET        ElementType = 11
+	ElementTLine         ElementType = 12
+	ElementLossyLine     ElementType = 13
+	ElementJFET          ElementType = 14
+	ElementProbe         ElementType = 15
+	ElementNetwork       ElementType = 16
 )
 
 type Element struct {
@@ -24,7 +29,10 @@ type Element struct {
 	Label           string
 	Nodes           []int
 	Value           float64
-	Extra           interface{} // model or control element (CCCS CCVS) [string] | IC (capacitor, inductor) [float64]
+	Expression      string      // value as an expression of .param parameters, empty for a constant
+	Tolerance       tolerance   // Monte Carlo variation of the value
+	Extra           interface{} // model or control element (CCCS CCVS) [string] | resistor [*resistorDescriptor, nil if no parameters given] | IC (capacitor, inductor) [float64, nil if not given] | line (T) [*tlineDescriptor] | line (O) [*ltraDescriptor] | JFET [*jfetDescriptor] | N-port (N) [*touchstoneDescriptor]
+	AC              complex128  // small-signal excitation phasor (independent sources)
 	PreserveCurrent bool        // used by MNA algorithm
 	Next            *Element
 }
@@ -41,6 +49,55 @@ type pwlDescriptor struct {
 	x float64
 }
 
+type tlineDescriptor struct {
+	z0      float64
+	td      float64
+	history []tlineHistoryPoint // accepted timepoints, used by the method of characteristics
+}
+
+type ltraDescriptor struct {
+	model    string
+	r        float64 // per unit length
+	l        float64 // per unit length
+	g        float64 // per unit length
+	c        float64 // per unit length
+	length   float64
+	segments int // lumped RLGC sections used in transient analysis
+}
+
+type jfetDescriptor struct {
+	model    string
+	area     float64
+	polarity float64 // 1 for N-channel, -1 for P-channel
+	vto      float64
+	beta     float64
+	lambda   float64
+	is       float64
+	cgs      float64
+	cgd      float64
+	pb       float64
+	fc       float64
+	eg       float64 // energy gap (eV)
+	xti      float64 // saturation current temperature exponent
+	kf       float64 // flicker noise coefficient
+	af       float64 // flicker noise exponent of the drain current
+	vt       float64 // thermal voltage at the device temperature
+	isT      float64 // saturation current at the device temperature
+	vgsLast  float64 // junction voltages of the last Newton iteration, used for limiting
+	vgdLast  float64
+	qgs      float64 // junction charges at the last accepted timepoint
+	qgd      float64
+	instanceTemperature
+}
+
+type tlineHistoryPoint struct {
+	t  float64
+	v1 float64
+	i1 float64
+	v2 float64
+	i2 float64
+}
+
 func elementListAppend(elementList *Element, e *Element) {
 	tmp := elementList
 
@@ -64,6 +121,27 @@ func elementListFindByLabel(elementList *Element, label string) *Element {
 	return nil
 }
 
+// elementHasValue tells whether the element has a single value that expressions and .step may set.
+func elementHasValue(e *Element) bool {
+	switch e.ElementType {
+	case ElementResistor, ElementCapacitor, ElementInductor, ElementVCVS, ElementCCCS, ElementVCCS, ElementCCVS:
+		return true
+	case ElementVoltageSource, ElementCurrentSource:
+		// The dc value, waveforms are not stepped
+		return e.Extra == nil
+	}
+	return false
+}
+
+// elementSetValue changes the value of an element. The value of a resistor with temperature coefficients is
+// its value at tnom.
+func elementSetValue(e *Element, value float64) {
+	if desc, given := e.Extra.(*resistorDescriptor); given {
+		desc.nominal = value
+	}
+	e.Value = value
+}
+
 func elementListPrint(elementList *Element) {
 	e := elementList
 	count := 1
@@ -102,6 +180,16 @@ func elementPrint(e *Element) {
 		fmt.Printf("\tType: VCVS\n")
 	case ElementVoltageSource:
 		fmt.Printf("\tType: Voltage Source\n")
+	case ElementTLine:
+		fmt.Printf("\tType: Transmission Line\n")
+	case ElementLossyLine:
+		fmt.Printf("\tType: Lossy Transmission Line\n")
+	case ElementJFET:
+		fmt.Printf("\tType: JFET\n")
+	case ElementProbe:
+		fmt.Printf("\tType: Stability Probe\n")
+	case ElementNetwork:
+		fmt.Printf("\tType: Touchstone Network\n")
 	}
 
 	fmt.Printf("\tLabel: %s\n", e.Label)
@@ -117,13 +205,27 @@ func elementPrint(e *Element) {
 
 	if e.ElementType == ElementBJT || e.ElementType == ElementMOSFET {
 		fmt.Printf("\tModel: %s\n", e.Extra.(string))
+	} else if e.ElementType == ElementTLine {
+		desc := e.Extra.(*tlineDescriptor)
+		fmt.Printf("\tZ0: %f\n", desc.z0)
+		fmt.Printf("\tTD: %g\n", desc.td)
+	} else if e.ElementType == ElementLossyLine {
+		fmt.Printf("\tModel: %s\n", e.Extra.(*ltraDescriptor).model)
+	} else if e.ElementType == ElementJFET {
+		fmt.Printf("\tModel: %s\n", e.Extra.(*jfetDescriptor).model)
+		fmt.Printf("\tArea: %f\n", e.Extra.(*jfetDescriptor).area)
+	} else if e.ElementType == ElementNetwork {
+		fmt.Printf("\tFile: %s\n", e.Extra.(*touchstoneDescriptor).path)
 	} else {
 		fmt.Printf("\tValue: %f\n", e.Value)
 	}
 
 	if e.ElementType == ElementCapacitor || e.ElementType == ElementInductor {
-		fmt.Printf("\tIC: %f\n", e.Extra.(float64))
+		if ic, given := e.Extra.(float64); given {
+			fmt.Printf("\tIC: %f\n", ic)
+		}
 	} else if e.ElementType == ElementVoltageSource || e.ElementType == ElementCurrentSource {
 		fmt.Printf("\tParameters: %+v\n", e.Extra)
+		fmt.Printf("\tAC: %v\n", e.AC)
 	}
 }
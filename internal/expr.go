@@ -0,0 +1,262 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+)
+
+// exprFunction evaluates a function of an expression. It returns an error message, empty on success.
+type exprFunction func(args []float64) (string, float64)
+
+// exprScope holds the names an expression may refer to
+type exprScope struct {
+	params    map[string]float64
+	functions map[string]exprFunction // looked up before the built-in functions
+}
+
+type exprParser struct {
+	text     string
+	position int
+	scope    exprScope
+	err      string // first error found
+}
+
+var exprBuiltins = map[string]exprFunction{
+	"sqrt":  exprUnary(math.Sqrt),
+	"exp":   exprUnary(math.Exp),
+	"log":   exprUnary(math.Log),
+	"ln":    exprUnary(math.Log),
+	"log10": exprUnary(math.Log10),
+	"abs":   exprUnary(math.Abs),
+	"sin":   exprUnary(math.Sin),
+	"cos":   exprUnary(math.Cos),
+	"tan":   exprUnary(math.Tan),
+	"atan":  exprUnary(math.Atan),
+	"floor": exprUnary(math.Floor),
+	"ceil":  exprUnary(math.Ceil),
+	"pow":   exprBinary(math.Pow),
+	"min":   exprBinary(math.Min),
+	"max":   exprBinary(math.Max),
+}
+
+func exprUnary(f func(float64) float64) exprFunction {
+	return func(args []float64) (string, float64) {
+		if len(args) != 1 {
+			return "needs 1 argument", 0.0
+		}
+		return "", f(args[0])
+	}
+}
+
+func exprBinary(f func(float64, float64) float64) exprFunction {
+	return func(args []float64) (string, float64) {
+		if len(args) != 2 {
+			return "needs 2 arguments", 0.0
+		}
+		return "", f(args[0], args[1])
+	}
+}
+
+// exprIsExpression tells whether a value token is a "{...}" expression.
+func exprIsExpression(value string) bool {
+	return len(value) >= 2 && value[0] == '{' && value[len(value)-1] == '}'
+}
+
+// exprEvaluate evaluates an arithmetic expression (+ - * / ^, parentheses, numbers with SPICE suffixes,
+// parameters and functions). The surrounding braces, if any, are ignored. It returns an error message,
+// empty on success.
+func exprEvaluate(expression string, scope exprScope) (string, float64) {
+	if exprIsExpression(expression) {
+		expression = expression[1 : len(expression)-1]
+	}
+
+	p := exprParser{text: expression, scope: scope}
+	value := exprParseSum(&p)
+	exprSkipSpaces(&p)
+	if p.err == "" && p.position < len(p.text) {
+		p.err = fmt.Sprintf("unexpected '%c' in expression", p.text[p.position])
+	}
+	if p.err == "" && (math.IsNaN(value) || math.IsInf(value, 0)) {
+		p.err = "expression does not evaluate to a finite number"
+	}
+	return p.err, value
+}
+
+func exprSkipSpaces(p *exprParser) {
+	for p.position < len(p.text) && (p.text[p.position] == ' ' || p.text[p.position] == '\t') {
+		p.position = p.position + 1
+	}
+}
+
+// exprAccept consumes the given operator if it is next.
+func exprAccept(p *exprParser, operator string) bool {
+	exprSkipSpaces(p)
+	if len(p.text)-p.position >= len(operator) && p.text[p.position:p.position+len(operator)] == operator {
+		p.position = p.position + len(operator)
+		return true
+	}
+	return false
+}
+
+func exprParseSum(p *exprParser) float64 {
+	value := exprParseProduct(p)
+	for p.err == "" {
+		if exprAccept(p, "+") {
+			value = value + exprParseProduct(p)
+		} else if exprAccept(p, "-") {
+			value = value - exprParseProduct(p)
+		} else {
+			break
+		}
+	}
+	return value
+}
+
+func exprParseProduct(p *exprParser) float64 {
+	value := exprParseUnary(p)
+	for p.err == "" {
+		if exprAccept(p, "*") {
+			value = value * exprParseUnary(p)
+		} else if exprAccept(p, "/") {
+			value = value / exprParseUnary(p)
+		} else {
+			break
+		}
+	}
+	return value
+}
+
+func exprParseUnary(p *exprParser) float64 {
+	if exprAccept(p, "-") {
+		return -exprParseUnary(p)
+	}
+	if exprAccept(p, "+") {
+		return exprParseUnary(p)
+	}
+	return exprParsePower(p)
+}
+
+// exprParsePower parses a right associative "^" or "**"
+func exprParsePower(p *exprParser) float64 {
+	base := exprParsePrimary(p)
+	if p.err == "" && (exprAccept(p, "^") || exprAccept(p, "**")) {
+		return math.Pow(base, exprParseUnary(p))
+	}
+	return base
+}
+
+func exprParsePrimary(p *exprParser) float64 {
+	exprSkipSpaces(p)
+	if p.err != "" {
+		return 0.0
+	}
+	if p.position >= len(p.text) {
+		p.err = "incomplete expression"
+		return 0.0
+	}
+
+	current := p.text[p.position]
+	if current == '(' {
+		p.position = p.position + 1
+		value := exprParseSum(p)
+		if p.err == "" && !exprAccept(p, ")") {
+			p.err = "missing ')' in expression"
+		}
+		return value
+	}
+
+	if parserIsByteNumber(current) || current == '.' {
+		return exprParseNumber(p)
+	}
+
+	if exprIsNameByte(current) {
+		start := p.position
+		for p.position < len(p.text) && (exprIsNameByte(p.text[p.position]) || parserIsByteNumber(p.text[p.position])) {
+			p.position = p.position + 1
+		}
+		name := p.text[start:p.position]
+
+		if exprAccept(p, "(") {
+			return exprParseCall(p, name)
+		}
+		value, exists := p.scope.params[name]
+		if !exists {
+			p.err = fmt.Sprintf("parameter '%s' is not defined", name)
+		}
+		return value
+	}
+
+	p.err = fmt.Sprintf("unexpected '%c' in expression", current)
+	return 0.0
+}
+
+// exprParseCall parses the arguments of a function after its "(" and calls it.
+func exprParseCall(p *exprParser, name string) float64 {
+	function, exists := p.scope.functions[name]
+	if !exists {
+		function, exists = exprBuiltins[name]
+	}
+	if !exists {
+		p.err = fmt.Sprintf("function '%s' is not defined", name)
+		return 0.0
+	}
+
+	args := make([]float64, 0)
+	if !exprAccept(p, ")") {
+		for p.err == "" {
+			args = append(args, exprParseSum(p))
+			if exprAccept(p, ")") {
+				break
+			}
+			if p.err == "" && !exprAccept(p, ",") {
+				p.err = fmt.Sprintf("missing ')' after the arguments of '%s'", name)
+			}
+		}
+	}
+	if p.err != "" {
+		return 0.0
+	}
+
+	err, value := function(args)
+	if err != "" {
+		p.err = fmt.Sprintf("function '%s' %s", name, err)
+	}
+	return value
+}
+
+// exprParseNumber reads a number with an optional exponent and SPICE suffix, e.g. "1.5e-3" or "4.7k".
+func exprParseNumber(p *exprParser) float64 {
+	start := p.position
+	for p.position < len(p.text) && (parserIsByteNumber(p.text[p.position]) || p.text[p.position] == '.') {
+		p.position = p.position + 1
+	}
+
+	// Exponent
+	if p.position+1 < len(p.text) && p.text[p.position] == 'e' {
+		next := p.position + 1
+		if p.text[next] == '+' || p.text[next] == '-' {
+			next = next + 1
+		}
+		if next < len(p.text) && parserIsByteNumber(p.text[next]) {
+			p.position = next
+			for p.position < len(p.text) && parserIsByteNumber(p.text[p.position]) {
+				p.position = p.position + 1
+			}
+		}
+	}
+
+	// Suffix
+	for p.position < len(p.text) && exprIsNameByte(p.text[p.position]) {
+		p.position = p.position + 1
+	}
+
+	err, value := parserParseNumber(p.text[start:p.position])
+	if err {
+		p.err = fmt.Sprintf("invalid number '%s'", p.text[start:p.position])
+	}
+	return value
+}
+
+func exprIsNameByte(b byte) bool {
+	return (b >= 'a' && b <= 'z') || b == '_'
+}
@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"os"
+	"text/tabwriter"
+)
+
+const (
+	fourierHarmonics  = 9    // harmonics of .four when not given
+	fourierGridPoints = 200  // points each period is resampled to, at least
+	fourierFFTPoints  = 1024 // points of a spectrum, at least
+)
+
+// fourier is a .four line: the harmonics of outputs over the last periods of the transient, and optionally the
+// full spectrum of the transient
+type fourier struct {
+	frequency float64 // fundamental
+	harmonics int
+	outputs   []outputVariable
+	periods   int
+	window    string // window of the spectrum: rect, hann or blackman, empty for none
+	points    int    // points of the spectrum, a power of 2, 0 for the default
+	token     Token
+}
+
+// fourierComponent is a harmonic of a waveform, its phase in degrees relative to a sine
+type fourierComponent struct {
+	magnitude float64
+	phase     float64
+}
+
+// fourierSpectra collects the spectra of every run, one plot for each output of each .four
+type fourierSpectra struct {
+	names  []string
+	curves map[string][]graphValues
+}
+
+// fourierRun prints the Fourier analyses of a transient run and returns the THD of each output. The spectrum of
+// an output goes to spectra when a window is given.
+func fourierRun(fouriers []fourier, T []float64, wave measureWave, label string, spectra *fourierSpectra,
+	digits int) []outputScalar {
+	scalars := make([]outputScalar, 0)
+	for _, f := range fouriers {
+		for _, o := range f.outputs {
+			y := wave(o)
+			dc, components := fourierAnalyse(f, T, y)
+			thd := fourierTHD(components)
+			fourierPrint(f, outputName(o), T[len(T)-1], dc, components, thd, digits)
+			scalars = append(scalars, outputScalar{"THD of " + outputName(o), thd})
+
+			if f.window == "" {
+				continue
+			}
+			if spectra.curves == nil {
+				spectra.curves = make(map[string][]graphValues)
+			}
+			name := "spectrum_" + graphFileName(outputName(o))
+			if _, exists := spectra.curves[name]; !exists {
+				spectra.names = append(spectra.names, name)
+			}
+			frequencies, magnitudes := fourierSpectrum(f, T, y)
+			spectra.curves[name] = append(spectra.curves[name], graphValues{name: label, t: frequencies, v: magnitudes})
+		}
+	}
+	return scalars
+}
+
+// fourierAnalyse resamples the last periods of a waveform and returns its DC value and its harmonics, the
+// fundamental at index 1.
+func fourierAnalyse(f fourier, T []float64, y []float64) (float64, []fourierComponent) {
+	perPeriod := fourierGridPoints
+	if perPeriod < 4*f.harmonics {
+		perPeriod = 4 * f.harmonics
+	}
+	n := perPeriod * f.periods
+	to := T[len(T)-1]
+	from := to - float64(f.periods)/f.frequency
+	samples := fourierResample(T, y, from, to, n)
+
+	dc := 0.0
+	for _, v := range samples {
+		dc = dc + v
+	}
+	dc = dc / float64(n)
+
+	// Phases are taken from t = 0, so a sine that starts there has phase 0
+	components := make([]fourierComponent, f.harmonics+1)
+	for k := 1; k <= f.harmonics; k++ {
+		a, b := 0.0, 0.0
+		for i, v := range samples {
+			angle := 2.0 * math.Pi * float64(k) * f.frequency * (from + float64(i)*(to-from)/float64(n))
+			a = a + v*math.Cos(angle)
+			b = b + v*math.Sin(angle)
+		}
+		a = 2.0 * a / float64(n)
+		b = 2.0 * b / float64(n)
+		components[k] = fourierComponent{magnitude: math.Hypot(a, b), phase: math.Atan2(a, b) * 180.0 / math.Pi}
+	}
+	return dc, components
+}
+
+// fourierResample returns n points of a waveform evenly spaced from from, the point at to left out. Points before
+// the first time point take its value.
+func fourierResample(T []float64, y []float64, from float64, to float64, n int) []float64 {
+	samples := make([]float64, n)
+	for i := range samples {
+		_, samples[i] = measureInterpolate(T, y, math.Max(T[0], from+float64(i)*(to-from)/float64(n)))
+	}
+	return samples
+}
+
+// fourierTHD returns the total harmonic distortion in percent of the fundamental.
+func fourierTHD(components []fourierComponent) float64 {
+	if len(components) < 2 || components[1].magnitude == 0.0 {
+		return 0.0
+	}
+	sum := 0.0
+	for _, c := range components[2:] {
+		sum = sum + c.magnitude*c.magnitude
+	}
+	return 100.0 * math.Sqrt(sum) / components[1].magnitude
+}
+
+// fourierPrint prints the classic Fourier table: every harmonic and its value relative to the fundamental.
+func fourierPrint(f fourier, name string, tStop float64, dc float64, components []fourierComponent, thd float64,
+	digits int) {
+	fmt.Printf("Fourier Analysis: %s, fundamental %g Hz, %d period(s) from t=%.6g\n\n", name, f.frequency, f.periods,
+		tStop-float64(f.periods)/f.frequency)
+	fmt.Printf("\tDC component: %.*g\n\n", digits+1, dc)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(writer, "\tharmonic\tfrequency\tmagnitude\tphase\tnormalized magnitude\tnormalized phase\t\n")
+	fundamental := components[1]
+	for k := 1; k < len(components); k++ {
+		c := components[k]
+		normalized := 0.0
+		if fundamental.magnitude != 0.0 {
+			normalized = c.magnitude / fundamental.magnitude
+		}
+		fmt.Fprintf(writer, "\t%d\t%g\t%.*g\t%.*f\t%.*g\t%.*f\t\n", k, float64(k)*f.frequency, digits+1, c.magnitude,
+			digits, c.phase, digits+1, normalized, digits, c.phase-fundamental.phase)
+	}
+	writer.Flush()
+	fmt.Printf("\n\tTHD: %.*g %%\n\n", digits+1, thd)
+}
+
+// fourierSpectrum returns the single-sided spectrum of the whole waveform in dB, windowed to limit the leakage of
+// frequencies that do not fit the transient a whole number of times.
+func fourierSpectrum(f fourier, T []float64, y []float64) ([]float64, []float64) {
+	n := f.points
+	if n == 0 {
+		n = fourierFFTPoints
+		for n < len(T) {
+			n = 2 * n
+		}
+	}
+	from, to := T[0], T[len(T)-1]
+	samples := fourierResample(T, y, from, to, n)
+	window := fourierWindow(f.window, n)
+
+	x := make([]complex128, n)
+	gain := 0.0
+	for i, v := range samples {
+		x[i] = complex(v*window[i], 0.0)
+		gain = gain + window[i]
+	}
+	X := fourierFFT(x)
+
+	frequencies := make([]float64, n/2+1)
+	magnitudes := make([]float64, n/2+1)
+	peak := 0.0
+	for k := range frequencies {
+		frequencies[k] = float64(k) / (to - from)
+		magnitudes[k] = cmplx.Abs(X[k]) / gain
+		if k > 0 && k < n/2 {
+			magnitudes[k] = 2.0 * magnitudes[k]
+		}
+		peak = math.Max(peak, magnitudes[k])
+	}
+	// Keep exact zeros on the plot
+	for k, m := range magnitudes {
+		magnitudes[k] = 20.0 * math.Log10(math.Max(m, 1e-12*peak))
+	}
+	return frequencies, magnitudes
+}
+
+// fourierWindow returns the coefficients of a window of n points.
+func fourierWindow(window string, n int) []float64 {
+	coefficients := make([]float64, n)
+	for i := range coefficients {
+		angle := 2.0 * math.Pi * float64(i) / float64(n)
+		switch window {
+		case "hann":
+			coefficients[i] = 0.5 - 0.5*math.Cos(angle)
+		case "blackman":
+			coefficients[i] = 0.42 - 0.5*math.Cos(angle) + 0.08*math.Cos(2.0*angle)
+		default:
+			coefficients[i] = 1.0
+		}
+	}
+	return coefficients
+}
+
+// fourierFFT returns the discrete Fourier transform of x, whose length must be a power of 2.
+func fourierFFT(x []complex128) []complex128 {
+	n := len(x)
+	X := make([]complex128, n)
+
+	// Bit reversed order
+	bits := 0
+	for 1<<uint(bits) < n {
+		bits = bits + 1
+	}
+	for i := range x {
+		reversed := 0
+		for b := 0; b < bits; b++ {
+			if i&(1<<uint(b)) != 0 {
+				reversed = reversed | 1<<uint(bits-1-b)
+			}
+		}
+		X[reversed] = x[i]
+	}
+
+	// Butterflies of growing size
+	for size := 2; size <= n; size = 2 * size {
+		step := cmplx.Exp(complex(0.0, -2.0*math.Pi/float64(size)))
+		for start := 0; start < n; start = start + size {
+			w := complex(1.0, 0.0)
+			for k := 0; k < size/2; k++ {
+				even, odd := X[start+k], w*X[start+k+size/2]
+				X[start+k] = even + odd
+				X[start+k+size/2] = even - odd
+				w = w * step
+			}
+		}
+	}
+	return X
+}
+
+// fourierPlot draws every spectrum, one curve per run.
+func fourierPlot(spectra fourierSpectra) error {
+	for _, name := range spectra.names {
+		if err := graphRender(name, "f", "dB", spectra.curves[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
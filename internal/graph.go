@@ -3,30 +3,74 @@ package internal
 import (
 	"bytes"
 	"io/ioutil"
+	"math"
+	"math/cmplx"
+	"strconv"
+	"strings"
 
 	chart "github.com/wcharczuk/go-chart"
 )
 
 type graphValues struct {
-	t []float64
-	v []float64
+	name string // legend entry, the .step values of the run
+	t    []float64
+	v    []float64
 }
 
-func genAllGraphs(currentNodes map[string]int, nodesMap map[string]int, X [][]float64) error {
-	// Gen graph of all voltages
+// graphPoints is the most timepoints a transient curve is drawn with, longer runs being decimated
+const graphPoints = 8192
+
+// genAllGraphs plots every signal recorded of the transient runs, one curve per run, labelled by labels.
+func genAllGraphs(labels []string, runs []*sinkRecorder) error {
+	for _, signal := range runs[0].run.Signals {
+		err := genGraph(graphSignalName(signal), labels, runs, signal)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func genGraph(label string, labels []string, runs []*sinkRecorder, signal string) error {
+	curves := make([]graphValues, 0, len(runs))
+	for run, r := range runs {
+		curves = append(curves, graphValues{
+			name: labels[run],
+			t:    r.T,
+			v:    sinkRecorderWave(r, signal),
+		})
+	}
+
+	return graphRender(label, "t", "value", curves)
+}
+
+// graphSignalName names the graph of a transient signal: "voltage_<node>", "voltage_<node>_<node>" or
+// "current_<element>".
+func graphSignalName(signal string) string {
+	kind := "voltage_"
+	if strings.HasPrefix(signal, "I(") {
+		kind = "current_"
+	}
+	return kind + strings.Replace(signal[2:len(signal)-1], ",", "_", 1)
+}
+
+// genAllACGraphs plots the bode diagrams of every voltage and current of the AC runs X, one curve per run.
+func genAllACGraphs(currentNodes map[string]int, nodesMap map[string]int, F []float64, logScale bool, labels []string, X [][][]complex128) error {
+	// Gen bode graphs of all voltages
 	for k, v := range nodesMap {
 		if v != 0 {
-			err := genGraph("voltage_"+k, X, v-1)
+			err := genACGraph("ac_voltage_"+k, F, logScale, labels, X, v-1)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
-	// Gen graph of all currents
+	// Gen bode graphs of all currents
 	for k, v := range currentNodes {
-		if v != 0 {
-			err := genGraph("current_"+k, X, v-1)
+		if v != 0 && !mnaIsInternal(k) {
+			err := genACGraph("ac_current_"+k, F, logScale, labels, X, v-1)
 			if err != nil {
 				return err
 			}
@@ -36,41 +80,83 @@ func genAllGraphs(currentNodes map[string]int, nodesMap map[string]int, X [][]fl
 	return nil
 }
 
-func genGraph(label string, X [][]float64, xIndex int) error {
-	gv := graphValues{
-		t: make([]float64, 0),
-		v: make([]float64, 0),
+func genACGraph(label string, F []float64, logScale bool, labels []string, X [][][]complex128, xIndex int) error {
+	magnitudes := make([]graphValues, 0, len(X))
+	phases := make([]graphValues, 0, len(X))
+	xName := "f"
+	for run := range X {
+		runPhases := acPhases(X[run])
+		magnitude := graphValues{
+			name: labels[run],
+			t:    make([]float64, 0),
+			v:    make([]float64, 0),
+		}
+		phase := graphValues{
+			name: labels[run],
+			t:    make([]float64, 0),
+			v:    make([]float64, 0),
+		}
+		for i, v := range X[run] {
+			f := F[i]
+			if logScale {
+				f = math.Log10(f)
+			}
+			magnitude.t = append(magnitude.t, f)
+			magnitude.v = append(magnitude.v, 20.0*math.Log10(cmplx.Abs(v[xIndex])))
+			phase.t = append(phase.t, f)
+			phase.v = append(phase.v, runPhases[i][xIndex])
+		}
+		magnitudes = append(magnitudes, magnitude)
+		phases = append(phases, phase)
+	}
+	if logScale {
+		xName = "log10(f)"
 	}
-	for t, v := range X {
-		gv.t = append(gv.t, float64(t))
-		gv.v = append(gv.v, v[xIndex])
+
+	err := graphRender(label+"_magnitude", xName, "dB", magnitudes)
+	if err != nil {
+		return err
 	}
+	return graphRender(label+"_phase", xName, "degrees", phases)
+}
 
-	return graphRender(label, gv)
+// graphRender draws the curves on a single chart, with a legend when there is more than one.
+func graphRender(label string, xName string, yName string, curves []graphValues) error {
+	return graphDraw(label, xName, yName, curves, chart.Style{Show: true})
 }
 
-func graphRender(label string, gv graphValues) error {
+// graphRenderPoints draws the values of each curve as unconnected points.
+func graphRenderPoints(label string, xName string, yName string, curves []graphValues) error {
+	return graphDraw(label, xName, yName, curves, chart.Style{Show: true, StrokeWidth: chart.Disabled, DotWidth: 5})
+}
+
+func graphDraw(label string, xName string, yName string, curves []graphValues, style chart.Style) error {
+	series := make([]chart.Series, 0, len(curves))
+	for _, gv := range curves {
+		series = append(series, chart.ContinuousSeries{
+			Name:    gv.name,
+			Style:   style,
+			XValues: gv.t,
+			YValues: gv.v,
+		})
+	}
+
 	graph := chart.Chart{
 		Width: 1920,
 		XAxis: chart.XAxis{
-			Name:      "t",
+			Name:      xName,
 			NameStyle: chart.StyleShow(),
 			Style:     chart.StyleShow(),
 		},
 		YAxis: chart.YAxis{
-			Name:      "value",
+			Name:      yName,
 			NameStyle: chart.StyleShow(),
 			Style:     chart.StyleShow(),
 		},
-		Series: []chart.Series{
-			chart.ContinuousSeries{
-				Style: chart.Style{
-					Show: true,
-				},
-				XValues: gv.t,
-				YValues: gv.v,
-			},
-		},
+		Series: series,
+	}
+	if len(curves) > 1 {
+		graph.Elements = []chart.Renderable{chart.Legend(&graph)}
 	}
 
 	buffer := bytes.NewBuffer([]byte{})
@@ -80,3 +166,41 @@ func graphRender(label string, gv graphValues) error {
 	}
 	return ioutil.WriteFile(label+".png", buffer.Bytes(), 0644)
 }
+
+// graphRenderHistogram draws the counts of the bins starting at edges as a bar chart.
+func graphRenderHistogram(label string, title string, edges []float64, counts []int, digits int) error {
+	bars := make([]chart.Value, len(counts))
+	for i, count := range counts {
+		bars[i] = chart.Value{
+			Label: strconv.FormatFloat(edges[i], 'g', digits+1, 64),
+			Value: float64(count),
+		}
+	}
+
+	graph := chart.BarChart{
+		Title:  title,
+		Width:  1920,
+		Height: 1080,
+		Bars:   bars,
+	}
+
+	buffer := bytes.NewBuffer([]byte{})
+	err := graph.Render(chart.PNG, buffer)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(label+".png", buffer.Bytes(), 0644)
+}
+
+// graphFileName turns a quantity such as "V(out)" into a name usable in a file name.
+func graphFileName(name string) string {
+	var result strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '.' || c == '-' {
+			result.WriteRune(c)
+		} else if result.Len() > 0 && !strings.HasSuffix(result.String(), "_") {
+			result.WriteByte('_')
+		}
+	}
+	return strings.TrimSuffix(result.String(), "_")
+}
@@ -0,0 +1,872 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+const (
+	hbHarmonics         = 5     // highest order of the mixing products when not given
+	hbTones             = 3     // tones of a .hb at most, the grid growing as a power of their number
+	hbCoincidence       = 1e-9  // relative distance under which two frequencies are taken as the same
+	hbDenseUnknowns     = 400   // largest system factored by LU, larger ones are solved by GMRES
+	hbKrylovRestart     = 30    // GMRES iterations between restarts
+	hbKrylovIterations  = 300   // GMRES iterations of a Newton-Raphson step at most
+	hbKrylovTolerance   = 1e-10 // GMRES residual relative to the right-hand side
+	hbLineSearch        = 10    // halvings of a Newton-Raphson step that makes the residual grow
+	hbMinimumExcitation = 1e-3  // smallest increase of the tones when stepping the sources
+)
+
+// harmonicBalance is a .hb line: the steady state of a circuit driven by one or more tones, in the frequency domain
+type harmonicBalance struct {
+	tones     []float64
+	harmonics int              // highest order |k1| + ... + |kN| of the mixing products k1 f1 + ... + kN fN kept
+	outputs   []outputVariable // every node voltage when empty
+	token     Token
+}
+
+// hbProduct is a mixing product k1 f1 + ... + kN fN of the tones
+type hbProduct struct {
+	k         []int
+	frequency float64
+}
+
+// hbGrid samples the waveforms over a period of every tone, each tone along its own axis
+type hbGrid struct {
+	points int // along each axis, a power of 2
+	size   int // points to the power of the number of tones
+}
+
+// hbNonlinearity is a current, or a charge whose derivative is a current, flowing through a nonlinear element
+// from n1 to n2, sampled over the grid
+type hbNonlinearity struct {
+	n1       int
+	n2       int
+	charge   bool
+	value    []float64
+	spectrum []complex128 // of value, over the grid
+	controls []hbControl
+}
+
+// hbControl is the derivative of a nonlinearity with respect to the voltage between c1 and c2
+type hbControl struct {
+	c1         int
+	c2         int
+	derivative []float64
+	spectrum   []complex128 // of derivative, over the grid
+}
+
+// hbSystem is the harmonic balance system of a circuit. The unknowns of the circuit, node voltages then branch
+// currents, are repeated for every mixing product.
+type hbSystem struct {
+	elementList *Element
+	size        int // unknowns of the circuit
+	currents    int // branch currents among them
+	products    []hbProduct
+	indices     []int // of every product on the grid
+	grid        hbGrid
+	Y           [][][]complex128 // linear part of the circuit at every product
+	B           []complex128     // sources at every product
+	gmin        float64
+}
+
+// hbSpectra collects the spectra of every run, one plot for each output of each .hb
+type hbSpectra struct {
+	names  []string
+	curves map[string][]graphValues
+}
+
+// hbRun finds the steady state of every .hb by harmonic balance. Each unknown is a truncated Fourier series over the
+// mixing products of the tones. The linear elements are solved at the frequency of each product as in AC analysis;
+// the nonlinear ones are evaluated in time, over a grid that samples a period of every tone along its own axis, and
+// brought back to the products by FFT. Newton-Raphson solves the balance of the two, its Jacobian factored by LU
+// when small and solved by GMRES otherwise. When it fails from the DC operating point, the tones are stepped up
+// from zero. Returns the THD of each output, or its third order intermodulation with more than one tone.
+func hbRun(hbs []harmonicBalance, elementList *Element, nodesMap map[string]int, conditions mnaConditions,
+	options SimOptions, label string, spectra *hbSpectra) []outputScalar {
+	conditions.quiet = true
+	scalars := make([]outputScalar, 0)
+	staticH, Xop, currentNodes := acLinearize(elementList, nodesMap, conditions, options)
+
+	for _, h := range hbs {
+		s := hbSystem{elementList: elementList, size: len(staticH), currents: len(currentNodes), gmin: options.Gmin}
+		s.products = hbProducts(h.tones, h.harmonics)
+		s.grid = hbNewGrid(len(h.tones), h.harmonics)
+		s.indices = make([]int, len(s.products))
+		for p, product := range s.products {
+			s.indices[p] = hbGridIndex(s.grid, product.k)
+		}
+
+		// The linear part at negative frequencies is the conjugate of the one at positive frequencies
+		dc := len(s.products) / 2
+		s.Y = make([][][]complex128, len(s.products))
+		for p := dc; p < len(s.products); p++ {
+			s.Y[p], _ = acSystem(elementList, currentNodes, staticH, 2.0*math.Pi*s.products[p].frequency, nil, options)
+			mirror := make([][]complex128, s.size)
+			for i := range mirror {
+				mirror[i] = make([]complex128, s.size)
+				for j := range mirror[i] {
+					mirror[i][j] = cmplx.Conj(s.Y[p][i][j])
+				}
+			}
+			s.Y[len(s.products)-1-p] = mirror
+		}
+		s.B = hbExcitation(elementList, currentNodes, s.products, s.size)
+
+		X0 := make([]complex128, len(s.products)*s.size)
+		for i, x := range Xop {
+			X0[dc*s.size+i] = complex(x, 0.0)
+		}
+		X, iterations, krylov, converged := hbNewton(&s, X0, 1.0, options)
+
+		// Source stepping: from the DC sources alone, the tones grow as long as Newton-Raphson follows them
+		excitation, steps := 1.0, 0
+		if !converged {
+			var i, k int
+			X, i, k, converged = hbNewton(&s, X0, 0.0, options)
+			iterations, krylov, excitation = iterations+i, krylov+k, 0.0
+			increase := 0.25
+			for converged && excitation < 1.0 {
+				next := math.Min(1.0, excitation+increase)
+				newX, i, k, ok := hbNewton(&s, X, next, options)
+				iterations, krylov, steps = iterations+i, krylov+k, steps+1
+				if ok {
+					X, excitation, increase = newX, next, 2.0*increase
+				} else if increase = increase / 2.0; increase < hbMinimumExcitation {
+					converged = false
+				}
+			}
+		}
+		if !converged {
+			fmt.Fprintf(os.Stderr, "HB Error: Newton-Raphson did not converge with the tones at %g%% of their amplitude\n",
+				100.0*excitation)
+			os.Exit(1)
+		}
+
+		outputs := h.outputs
+		if len(outputs) == 0 {
+			for _, node := range acSortedKeys(nodesMap) {
+				if nodesMap[node] != 0 {
+					outputs = append(outputs, outputVariable{node: node})
+				}
+			}
+		}
+		fmt.Printf("Harmonic Balance: ")
+		for i, tone := range h.tones {
+			fmt.Printf("f%d=%g Hz, ", i+1, tone)
+		}
+		fmt.Printf("%d mixing product(s) up to order %d\n\n", len(s.products)-dc-1, h.harmonics)
+		solver := "LU"
+		if len(X) > hbDenseUnknowns {
+			solver = fmt.Sprintf("GMRES in %d iteration(s)", krylov)
+		}
+		fmt.Printf("\tconverged in %d Newton-Raphson iteration(s)", iterations)
+		if steps > 0 {
+			fmt.Printf(" over %d source step(s)", steps)
+		}
+		fmt.Printf(", %d unknowns solved by %s\n\n", len(X), solver)
+
+		for _, o := range outputs {
+			phasors := make([]complex128, len(s.products))
+			for p := range s.products {
+				phasors[p] = outputPhasor(o, elementList, X[p*s.size:(p+1)*s.size], nodesMap, currentNodes)
+			}
+			if name, value := hbPrint(h, s.products, phasors, outputName(o), options.NumDgt); name != "" {
+				scalars = append(scalars, outputScalar{name + " of " + outputName(o), value})
+			}
+
+			if spectra.curves == nil {
+				spectra.curves = make(map[string][]graphValues)
+			}
+			plot := "hb_" + graphFileName(outputName(o))
+			if _, exists := spectra.curves[plot]; !exists {
+				spectra.names = append(spectra.names, plot)
+			}
+			frequencies, magnitudes := hbSpectrum(s.products, phasors)
+			spectra.curves[plot] = append(spectra.curves[plot], graphValues{name: label, t: frequencies, v: magnitudes})
+		}
+	}
+	return scalars
+}
+
+// hbProducts returns the mixing products of the tones up to the given order by increasing frequency: DC in the
+// middle, every positive product mirrored by its negative one.
+func hbProducts(tones []float64, harmonics int) []hbProduct {
+	products := make([]hbProduct, 0)
+	k := make([]int, len(tones))
+	var add func(tone int, order int)
+	add = func(tone int, order int) {
+		if tone == len(tones) {
+			product := hbProduct{k: append([]int(nil), k...)}
+			for i := range k {
+				product.frequency = product.frequency + float64(k[i])*tones[i]
+			}
+			products = append(products, product)
+			return
+		}
+		for ki := order - harmonics; ki <= harmonics-order; ki++ {
+			k[tone] = ki
+			if ki < 0 {
+				add(tone+1, order-ki)
+			} else {
+				add(tone+1, order+ki)
+			}
+		}
+	}
+	add(0, 0)
+	sort.SliceStable(products, func(i, j int) bool {
+		return products[i].frequency < products[j].frequency
+	})
+	return products
+}
+
+// hbCoincident returns the first of two products that share a frequency, -1 if they all differ. Such tones, one a
+// harmonic of the other within the order kept, have no steady state of their own mixing products.
+func hbCoincident(products []hbProduct) int {
+	last := products[len(products)-1].frequency
+	for p := len(products) / 2; p+1 < len(products); p++ {
+		if products[p+1].frequency-products[p].frequency <= hbCoincidence*last {
+			return p
+		}
+	}
+	return -1
+}
+
+// hbProductAt returns the product at a frequency that is not negative, -1 if there is none.
+func hbProductAt(products []hbProduct, frequency float64) int {
+	last := products[len(products)-1].frequency
+	for p := len(products) / 2; p < len(products); p++ {
+		if math.Abs(products[p].frequency-frequency) <= hbCoincidence*last {
+			return p
+		}
+	}
+	return -1
+}
+
+// hbProductName names a product after its tones, the positive ones first, as in "2f1-f2".
+func hbProductName(product hbProduct) string {
+	name := ""
+	for _, positive := range []bool{true, false} {
+		for i, ki := range product.k {
+			if ki == 0 || (ki > 0) != positive {
+				continue
+			}
+			sign := "+"
+			if ki < 0 {
+				sign = "-"
+			} else if name == "" {
+				sign = ""
+			}
+			coefficient := ""
+			if ki > 1 || ki < -1 {
+				coefficient = fmt.Sprintf("%d", int(math.Abs(float64(ki))))
+			}
+			name = name + fmt.Sprintf("%s%sf%d", sign, coefficient, i+1)
+		}
+	}
+	if name == "" {
+		return "DC"
+	}
+	return name
+}
+
+// hbNewGrid returns the grid of the tones. The derivatives of the nonlinear elements couple any two products, so
+// their spectra are needed up to twice the order kept without wrapping around an axis.
+func hbNewGrid(tones int, harmonics int) hbGrid {
+	points := 2
+	for points < 4*harmonics+1 {
+		points = 2 * points
+	}
+	size := 1
+	for i := 0; i < tones; i++ {
+		size = size * points
+	}
+	return hbGrid{points: points, size: size}
+}
+
+// hbGridIndex returns the index on the grid of the component k1 f1 + ... + kN fN of a spectrum.
+func hbGridIndex(grid hbGrid, k []int) int {
+	index, stride := 0, 1
+	for _, ki := range k {
+		index = index + ((ki%grid.points+grid.points)%grid.points)*stride
+		stride = stride * grid.points
+	}
+	return index
+}
+
+// hbTransform returns the spectrum of a waveform over the grid, scaled so the waveform is the sum of its components,
+// or the waveform of a spectrum when inverse. The FFT runs along each axis in turn.
+func hbTransform(grid hbGrid, x []complex128, inverse bool) []complex128 {
+	X := make([]complex128, grid.size)
+	for i := range x {
+		X[i] = x[i]
+		if inverse {
+			X[i] = cmplx.Conj(x[i])
+		}
+	}
+
+	line := make([]complex128, grid.points)
+	for stride := 1; stride < grid.size; stride = stride * grid.points {
+		for start := 0; start < grid.size; start++ {
+			if (start/stride)%grid.points != 0 {
+				continue
+			}
+			for i := range line {
+				line[i] = X[start+i*stride]
+			}
+			for i, v := range fourierFFT(line) {
+				X[start+i*stride] = v
+			}
+		}
+	}
+
+	for i := range X {
+		if inverse {
+			X[i] = cmplx.Conj(X[i])
+		} else {
+			X[i] = X[i] / complex(float64(grid.size), 0.0)
+		}
+	}
+	return X
+}
+
+// hbSpectrumOf returns the spectrum over the grid of a real waveform.
+func hbSpectrumOf(grid hbGrid, w []float64) []complex128 {
+	x := make([]complex128, len(w))
+	for i, v := range w {
+		x[i] = complex(v, 0.0)
+	}
+	return hbTransform(grid, x, false)
+}
+
+// hbWaveform returns the waveform over the grid of the voltage of a node, from its components at every product.
+// Ground is zero.
+func hbWaveform(s *hbSystem, X []complex128, node int) []complex128 {
+	spectrum := make([]complex128, s.grid.size)
+	if node != 0 {
+		for p := range s.products {
+			spectrum[s.indices[p]] = X[p*s.size+node-1]
+		}
+	}
+	return hbTransform(s.grid, spectrum, true)
+}
+
+// hbExcitation returns the sources at every product: their DC values, and each sine source at the product of its
+// frequency as v0 + va sin(wt + td) = v0 + va/2j e^j(wt + td) - va/2j e^-j(wt + td).
+func hbExcitation(elementList *Element, currentNodes map[string]int, products []hbProduct, size int) []complex128 {
+	B := make([]complex128, len(products)*size)
+	dc := len(products) / 2
+	for e := elementList; e != nil; e = e.Next {
+		if e.ElementType != ElementVoltageSource && e.ElementType != ElementCurrentSource {
+			continue
+		}
+		add := func(p int, value complex128) {
+			row := B[p*size : (p+1)*size]
+			if e.ElementType == ElementVoltageSource || e.PreserveCurrent {
+				row[currentNodes[e.Label]-1] += value
+				return
+			}
+			if e.Nodes[0] != 0 {
+				row[e.Nodes[0]-1] -= value
+			}
+			if e.Nodes[1] != 0 {
+				row[e.Nodes[1]-1] += value
+			}
+		}
+
+		switch source := e.Extra.(type) {
+		case sinDescriptor:
+			add(dc, complex(source.v0, 0.0))
+			p := hbProductAt(products, source.freq)
+			if p == dc {
+				add(dc, complex(source.va*math.Sin(source.td), 0.0))
+				continue
+			}
+			phasor := cmplx.Rect(source.va/2.0, source.td-math.Pi/2.0)
+			add(p, phasor)
+			add(len(products)-1-p, cmplx.Conj(phasor))
+		case []pwlDescriptor:
+			add(dc, complex(source[0].x, 0.0))
+		default:
+			add(dc, complex(e.Value, 0.0))
+		}
+	}
+	return B
+}
+
+// hbEvaluate samples the currents and charges of the nonlinear elements, and their derivatives, over the grid at
+// the solution X.
+func hbEvaluate(s *hbSystem, X []complex128) []hbNonlinearity {
+	voltages := make(map[int][]complex128)
+	voltage := func(node int) []complex128 {
+		if _, exists := voltages[node]; !exists {
+			voltages[node] = hbWaveform(s, X, node)
+		}
+		return voltages[node]
+	}
+
+	nonlinear := make([]hbNonlinearity, 0)
+	for e := s.elementList; e != nil; e = e.Next {
+		if e.ElementType != ElementJFET {
+			continue
+		}
+		desc := e.Extra.(*jfetDescriptor)
+		d, g, src := e.Nodes[0], e.Nodes[1], e.Nodes[2]
+		vd, vg, vs := voltage(d), voltage(g), voltage(src)
+
+		n := s.grid.size
+		id, gm, gds := make([]float64, n), make([]float64, n), make([]float64, n)
+		igs, ggs, qgs, cgs := make([]float64, n), make([]float64, n), make([]float64, n), make([]float64, n)
+		igd, ggd, qgd, cgd := make([]float64, n), make([]float64, n), make([]float64, n), make([]float64, n)
+		for t := 0; t < n; t++ {
+			vgs := desc.polarity * real(vg[t]-vs[t])
+			vgd := desc.polarity * real(vg[t]-vd[t])
+			id[t], gm[t], gds[t] = jfetDrainCurrent(desc, vgs, vgs-vgd)
+			igs[t], ggs[t] = jfetJunctionCurrent(desc, vgs, s.gmin)
+			igd[t], ggd[t] = jfetJunctionCurrent(desc, vgd, s.gmin)
+			qgs[t], cgs[t] = jfetJunctionCharge(desc, desc.cgs, vgs)
+			qgd[t], cgd[t] = jfetJunctionCharge(desc, desc.cgd, vgd)
+
+			// The derivatives do not change with the polarity, the currents and charges do
+			id[t], igs[t], igd[t] = desc.polarity*id[t], desc.polarity*igs[t], desc.polarity*igd[t]
+			qgs[t], qgd[t] = desc.polarity*qgs[t], desc.polarity*qgd[t]
+		}
+		nonlinear = append(nonlinear,
+			hbNonlinearity{n1: g, n2: src, value: igs, controls: []hbControl{{c1: g, c2: src, derivative: ggs}}},
+			hbNonlinearity{n1: g, n2: src, charge: true, value: qgs, controls: []hbControl{{c1: g, c2: src, derivative: cgs}}},
+			hbNonlinearity{n1: g, n2: d, value: igd, controls: []hbControl{{c1: g, c2: d, derivative: ggd}}},
+			hbNonlinearity{n1: g, n2: d, charge: true, value: qgd, controls: []hbControl{{c1: g, c2: d, derivative: cgd}}},
+			hbNonlinearity{n1: d, n2: src, value: id,
+				controls: []hbControl{{c1: g, c2: src, derivative: gm}, {c1: d, c2: src, derivative: gds}}})
+	}
+
+	for i := range nonlinear {
+		nonlinear[i].spectrum = hbSpectrumOf(s.grid, nonlinear[i].value)
+		for j := range nonlinear[i].controls {
+			nonlinear[i].controls[j].spectrum = hbSpectrumOf(s.grid, nonlinear[i].controls[j].derivative)
+		}
+	}
+	return nonlinear
+}
+
+// hbStampCurrent adds a current flowing from n1 to n2 to the node equations F.
+func hbStampCurrent(F []complex128, n1 int, n2 int, i complex128) {
+	if n1 != 0 {
+		F[n1-1] += i
+	}
+	if n2 != 0 {
+		F[n2-1] -= i
+	}
+}
+
+// hbResidual returns Y X + I(X) + jw Q(X) - B at every product, the tones of B scaled by excitation.
+func hbResidual(s *hbSystem, X []complex128, nonlinear []hbNonlinearity, excitation float64) []complex128 {
+	F := make([]complex128, len(X))
+	dc := len(s.products) / 2
+	for p, product := range s.products {
+		scale := complex(excitation, 0.0)
+		if p == dc {
+			scale = 1.0
+		}
+		row := p * s.size
+		for i := 0; i < s.size; i++ {
+			F[row+i] = -scale * s.B[row+i]
+			for j, y := range s.Y[p][i] {
+				F[row+i] += y * X[row+j]
+			}
+		}
+
+		jw := complex(0.0, 2.0*math.Pi*product.frequency)
+		for _, n := range nonlinear {
+			i := n.spectrum[s.indices[p]]
+			if n.charge {
+				i = jw * i
+			}
+			hbStampCurrent(F[row:row+s.size], n.n1, n.n2, i)
+		}
+	}
+	return F
+}
+
+// hbJacobianApply returns J x: the linear part at each product, and the derivatives of the nonlinear elements
+// multiplied by the control voltages of x over the grid.
+func hbJacobianApply(s *hbSystem, nonlinear []hbNonlinearity, x []complex128) []complex128 {
+	Jx := make([]complex128, len(x))
+	for p := range s.products {
+		row := p * s.size
+		for i := 0; i < s.size; i++ {
+			for j, y := range s.Y[p][i] {
+				Jx[row+i] += y * x[row+j]
+			}
+		}
+	}
+
+	// The waveforms of x are complex: only the solution itself is real
+	voltages := make(map[int][]complex128)
+	for _, n := range nonlinear {
+		current := make([]complex128, s.grid.size)
+		for _, c := range n.controls {
+			for _, node := range []int{c.c1, c.c2} {
+				if _, exists := voltages[node]; !exists {
+					voltages[node] = hbWaveform(s, x, node)
+				}
+			}
+			v1, v2 := voltages[c.c1], voltages[c.c2]
+			for t := range current {
+				current[t] += complex(c.derivative[t], 0.0) * (v1[t] - v2[t])
+			}
+		}
+		spectrum := hbTransform(s.grid, current, false)
+		for p, product := range s.products {
+			i := spectrum[s.indices[p]]
+			if n.charge {
+				i = complex(0.0, 2.0*math.Pi*product.frequency) * i
+			}
+			hbStampCurrent(Jx[p*s.size:(p+1)*s.size], n.n1, n.n2, i)
+		}
+	}
+	return Jx
+}
+
+// hbStampBlock adds through add(row, column, y) how the nonlinear currents at product p depend on the unknowns at
+// product q: the spectrum of each derivative at the difference of the two products.
+func hbStampBlock(s *hbSystem, nonlinear []hbNonlinearity, p int, q int, add func(int, int, complex128)) {
+	k := make([]int, len(s.products[p].k))
+	for i := range k {
+		k[i] = s.products[p].k[i] - s.products[q].k[i]
+	}
+	index := hbGridIndex(s.grid, k)
+	jw := complex(0.0, 2.0*math.Pi*s.products[p].frequency)
+
+	for _, n := range nonlinear {
+		for _, c := range n.controls {
+			y := c.spectrum[index]
+			if n.charge {
+				y = jw * y
+			}
+			if n.n1 != 0 && c.c1 != 0 {
+				add(n.n1-1, c.c1-1, y)
+			}
+			if n.n1 != 0 && c.c2 != 0 {
+				add(n.n1-1, c.c2-1, -y)
+			}
+			if n.n2 != 0 && c.c1 != 0 {
+				add(n.n2-1, c.c1-1, -y)
+			}
+			if n.n2 != 0 && c.c2 != 0 {
+				add(n.n2-1, c.c2-1, y)
+			}
+		}
+	}
+}
+
+// hbSolveLinear solves J delta = R at the solution the nonlinear elements were evaluated at. Small systems are
+// factored by LU; larger ones are solved by GMRES, preconditioned by the blocks of J that couple each product with
+// itself. Returns the GMRES iterations taken, 0 with LU.
+func hbSolveLinear(s *hbSystem, nonlinear []hbNonlinearity, R []complex128) ([]complex128, int) {
+	if len(R) <= hbDenseUnknowns {
+		J := make([][]complex128, len(R))
+		for i := range J {
+			J[i] = make([]complex128, len(R))
+		}
+		for p := range s.products {
+			for i := 0; i < s.size; i++ {
+				copy(J[p*s.size+i][p*s.size:], s.Y[p][i])
+			}
+			for q := range s.products {
+				hbStampBlock(s, nonlinear, p, q, func(row int, column int, y complex128) {
+					J[p*s.size+row][q*s.size+column] += y
+				})
+			}
+		}
+		LU, P := acLUFactorization(J)
+		return acLUSolve(LU, P, R), 0
+	}
+
+	blocks := make([][][]complex128, len(s.products))
+	pivots := make([][]int, len(s.products))
+	for p := range s.products {
+		block := make([][]complex128, s.size)
+		for i := range block {
+			block[i] = append([]complex128(nil), s.Y[p][i]...)
+		}
+		hbStampBlock(s, nonlinear, p, p, func(row int, column int, y complex128) {
+			block[row][column] += y
+		})
+		blocks[p], pivots[p] = acLUFactorization(block)
+	}
+	precondition := func(x []complex128) []complex128 {
+		z := make([]complex128, len(x))
+		for p := range s.products {
+			copy(z[p*s.size:], acLUSolve(blocks[p], pivots[p], x[p*s.size:(p+1)*s.size]))
+		}
+		return z
+	}
+	apply := func(x []complex128) []complex128 {
+		return hbJacobianApply(s, nonlinear, x)
+	}
+	delta, iterations := hbGMRES(apply, precondition, R)
+	return delta, iterations
+}
+
+// hbGMRES solves A x = b by GMRES, preconditioned on the right by M and restarted every hbKrylovRestart
+// iterations, until the residual falls under hbKrylovTolerance of b or hbKrylovIterations are taken. Returns the
+// solution and the iterations taken.
+func hbGMRES(A func([]complex128) []complex128, M func([]complex128) []complex128, b []complex128) ([]complex128,
+	int) {
+	x := make([]complex128, len(b))
+	target := hbKrylovTolerance * hbNorm(b)
+	r := append([]complex128(nil), b...)
+	iterations := 0
+
+	for iterations < hbKrylovIterations {
+		beta := hbNorm(r)
+		if beta <= target {
+			break
+		}
+
+		// Arnoldi, the Hessenberg matrix turned triangular by Givens rotations as it grows
+		V := [][]complex128{hbScale(r, complex(1.0/beta, 0.0))}
+		Z := make([][]complex128, 0, hbKrylovRestart)
+		H := make([][]complex128, 0, hbKrylovRestart)
+		c := make([]float64, 0, hbKrylovRestart)
+		sn := make([]complex128, 0, hbKrylovRestart)
+		g := []complex128{complex(beta, 0.0)}
+		for j := 0; j < hbKrylovRestart && iterations < hbKrylovIterations; j++ {
+			iterations++
+			Z = append(Z, M(V[j]))
+			w := A(Z[j])
+			h := make([]complex128, j+2)
+			for i := 0; i <= j; i++ {
+				h[i] = hbDot(V[i], w)
+				for l := range w {
+					w[l] -= h[i] * V[i][l]
+				}
+			}
+			norm := hbNorm(w)
+			h[j+1] = complex(norm, 0.0)
+
+			for i := 0; i < j; i++ {
+				h[i], h[i+1] = complex(c[i], 0.0)*h[i]+sn[i]*h[i+1], -cmplx.Conj(sn[i])*h[i]+complex(c[i], 0.0)*h[i+1]
+			}
+			rho := math.Hypot(cmplx.Abs(h[j]), norm)
+			cj, sj := 0.0, complex(1.0, 0.0)
+			if h[j] != 0.0 {
+				cj = cmplx.Abs(h[j]) / rho
+				sj = h[j] / complex(cmplx.Abs(h[j]), 0.0) * complex(norm/rho, 0.0)
+			}
+			h[j], h[j+1] = complex(cj, 0.0)*h[j]+sj*h[j+1], 0.0
+			c, sn = append(c, cj), append(sn, sj)
+			g = append(g, -cmplx.Conj(sj)*g[j])
+			g[j] = complex(cj, 0.0) * g[j]
+			H = append(H, h)
+
+			if cmplx.Abs(g[j+1]) <= target || norm == 0.0 {
+				break
+			}
+			V = append(V, hbScale(w, complex(1.0/norm, 0.0)))
+		}
+
+		// The triangular system gives the combination of the preconditioned vectors
+		y := make([]complex128, len(H))
+		for i := len(H) - 1; i >= 0; i-- {
+			y[i] = g[i]
+			for l := i + 1; l < len(H); l++ {
+				y[i] -= H[l][i] * y[l]
+			}
+			y[i] = y[i] / H[i][i]
+		}
+		for i := range y {
+			for l := range x {
+				x[l] += y[i] * Z[i][l]
+			}
+		}
+
+		Ax := A(x)
+		for l := range r {
+			r[l] = b[l] - Ax[l]
+		}
+	}
+	return x, iterations
+}
+
+// hbDot returns the inner product of a and b, a conjugated.
+func hbDot(a []complex128, b []complex128) complex128 {
+	sum := complex(0.0, 0.0)
+	for i := range a {
+		sum += cmplx.Conj(a[i]) * b[i]
+	}
+	return sum
+}
+
+// hbNorm returns the Euclidean norm of x.
+func hbNorm(x []complex128) float64 {
+	return math.Sqrt(real(hbDot(x, x)))
+}
+
+// hbScale returns c x.
+func hbScale(x []complex128, c complex128) []complex128 {
+	scaled := make([]complex128, len(x))
+	for i := range x {
+		scaled[i] = c * x[i]
+	}
+	return scaled
+}
+
+// hbNewton solves the harmonic balance equations from X, the tones scaled by excitation and the DC sources at their
+// value. A step that makes the residual grow is halved. Converges, as Newton-Raphson does in DC, when the step is
+// within the tolerances. Returns the solution, the Newton-Raphson and GMRES iterations taken, and whether it
+// converged.
+func hbNewton(s *hbSystem, X []complex128, excitation float64, options SimOptions) ([]complex128, int, int, bool) {
+	nonlinear := hbEvaluate(s, X)
+	F := hbResidual(s, X, nonlinear, excitation)
+	krylov := 0
+
+	for iteration := 0; iteration < options.Itl1; iteration++ {
+		R := hbScale(F, -1.0)
+		delta, inner := hbSolveLinear(s, nonlinear, R)
+		krylov = krylov + inner
+
+		converged := true
+		for i := range delta {
+			if cmplx.IsNaN(delta[i]) || cmplx.IsInf(delta[i]) {
+				return X, iteration + 1, krylov, false
+			}
+			absTol := options.VNTol
+			if i%s.size >= s.size-s.currents {
+				absTol = options.AbsTol
+			}
+			if cmplx.Abs(delta[i]) > options.RelTol*math.Max(cmplx.Abs(X[i]+delta[i]), cmplx.Abs(X[i]))+absTol {
+				converged = false
+			}
+		}
+
+		norm := hbNorm(F)
+		step := complex(1.0, 0.0)
+		var trial []complex128
+		for halving := 0; ; halving++ {
+			trial = make([]complex128, len(X))
+			for i := range trial {
+				trial[i] = X[i] + step*delta[i]
+			}
+			nonlinear = hbEvaluate(s, trial)
+			F = hbResidual(s, trial, nonlinear, excitation)
+			if hbNorm(F) <= norm || halving == hbLineSearch || converged {
+				break
+			}
+			step = step / 2.0
+		}
+		X = trial
+		if converged {
+			return X, iteration + 1, krylov, true
+		}
+	}
+	return X, options.Itl1, krylov, false
+}
+
+// hbPrint prints the DC component of an output and its spectrum over the positive products, each relative to the
+// strongest of the tones. With one tone the distortion is the THD in percent; with more, it is the strongest third
+// order intermodulation product in dBc, made of more than one tone. Returns the name and value of the distortion,
+// no name without third order products or tones to refer them to.
+func hbPrint(h harmonicBalance, products []hbProduct, phasors []complex128, name string, digits int) (string,
+	float64) {
+	dc := len(products) / 2
+	fmt.Printf("\t%s: DC component %.*g\n\n", name, digits+1, real(phasors[dc]))
+
+	// The amplitude of a product is twice its phasor, the other half sitting at the negative product
+	reference := 0.0
+	for p := dc + 1; p < len(products); p++ {
+		order := 0
+		for _, ki := range products[p].k {
+			order = order + int(math.Abs(float64(ki)))
+		}
+		if order == 1 {
+			reference = math.Max(reference, 2.0*cmplx.Abs(phasors[p]))
+		}
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(writer, "\tproduct\tfrequency\tmagnitude\tphase\tlevel (dBc)\t\n")
+	harmonics := make([]fourierComponent, h.harmonics+1)
+	intermodulation := math.Inf(-1)
+	for p := dc + 1; p < len(products); p++ {
+		magnitude := 2.0 * cmplx.Abs(phasors[p])
+		// Phases are relative to a sine, as in Fourier analysis
+		phase := math.Remainder(cmplx.Phase(phasors[p])*180.0/math.Pi+90.0, 360.0)
+		fmt.Fprintf(writer, "\t%s\t%g\t%.*g\t", hbProductName(products[p]), products[p].frequency, digits+1, magnitude)
+		if magnitude > 0.0 {
+			fmt.Fprintf(writer, "%.*f\t", digits, phase)
+		} else {
+			fmt.Fprintf(writer, "-\t")
+		}
+		level := math.Inf(-1)
+		if magnitude > 0.0 && reference > 0.0 {
+			level = 20.0 * math.Log10(magnitude/reference)
+			fmt.Fprintf(writer, "%.*g\t\n", digits+1, level)
+		} else {
+			fmt.Fprintf(writer, "-\t\n")
+		}
+
+		order, tones := 0, 0
+		for _, ki := range products[p].k {
+			order = order + int(math.Abs(float64(ki)))
+			if ki != 0 {
+				tones++
+			}
+		}
+		if len(h.tones) == 1 {
+			harmonics[products[p].k[0]] = fourierComponent{magnitude: magnitude}
+		} else if order == 3 && tones > 1 {
+			intermodulation = math.Max(intermodulation, level)
+		}
+	}
+	writer.Flush()
+
+	if len(h.tones) == 1 {
+		thd := fourierTHD(harmonics)
+		fmt.Printf("\n\tTHD: %.*g %%\n\n", digits+1, thd)
+		return "THD", thd
+	}
+	if h.harmonics < 3 || reference == 0.0 {
+		fmt.Printf("\n")
+		return "", 0.0
+	}
+	fmt.Printf("\n\tIM3: %.*g dBc\n\n", digits+1, intermodulation)
+	return "IM3", intermodulation
+}
+
+// hbSpectrum returns the single-sided spectrum of an output in dB, from DC to the highest product.
+func hbSpectrum(products []hbProduct, phasors []complex128) ([]float64, []float64) {
+	dc := len(products) / 2
+	frequencies := make([]float64, 0, len(products)-dc)
+	magnitudes := make([]float64, 0, len(products)-dc)
+	peak := 0.0
+	for p := dc; p < len(products); p++ {
+		magnitude := 2.0 * cmplx.Abs(phasors[p])
+		if p == dc {
+			magnitude = math.Abs(real(phasors[p]))
+		}
+		frequencies = append(frequencies, products[p].frequency)
+		magnitudes = append(magnitudes, magnitude)
+		peak = math.Max(peak, magnitude)
+	}
+	// Keep exact zeros on the plot
+	for i, m := range magnitudes {
+		magnitudes[i] = 20.0 * math.Log10(math.Max(m, 1e-12*peak))
+	}
+	return frequencies, magnitudes
+}
+
+// hbPlot draws the spectrum of every output, one curve per run.
+func hbPlot(spectra hbSpectra) error {
+	for _, name := range spectra.names {
+		if err := graphRender(name, "f", "dB", spectra.curves[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
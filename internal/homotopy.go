@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"math"
+)
+
+const (
+	homotopyGminStart   = 1e-2 // diagonal conductance of the first gmin step
+	homotopyMinStep     = 1e-4 // smallest source step before giving up
+	homotopyPtranStart  = 1.0  // pseudo-transient capacitance over timestep of the first step
+	homotopyPtranSteady = 1e-6 // relative change that counts as steady state
+)
+
+// homotopyResult tells how the operating point was found
+type homotopyResult struct {
+	method     string
+	iterations int
+	converged  bool
+}
+
+// homotopySolve finds the operating point of H x = B plus the nonlinear elements, trying plain Newton-Raphson,
+// gmin stepping, source stepping and pseudo-transient continuation in sequence. nodeCount is the number of node
+// voltages, which come first in x.
+func homotopySolve(elementList *Element, currentNodes map[string]int, H [][]float64, B []float64,
+	X0 []float64, nodeCount int, options SimOptions) ([]float64, [][]float64, []float64, homotopyResult) {
+	result := homotopyResult{}
+
+	if !options.NoOpIter {
+		X, linearH, linearB, iterations, converged := mnaNewton(elementList, currentNodes, H, B, X0, 0, nil, 0, options, options.Itl1)
+		result.iterations += iterations
+		if converged {
+			result.method = "newton"
+			result.converged = true
+			return X, linearH, linearB, result
+		}
+	}
+
+	methods := []struct {
+		name  string
+		steps int
+		solve func() ([]float64, int, bool)
+	}{
+		{"gmin stepping", options.GminSteps, func() ([]float64, int, bool) {
+			return homotopyGminStepping(elementList, currentNodes, H, B, X0, nodeCount, options)
+		}},
+		{"source stepping", options.SrcSteps, func() ([]float64, int, bool) {
+			return homotopySourceStepping(elementList, currentNodes, H, B, options)
+		}},
+		{"pseudo-transient", options.PtranSteps, func() ([]float64, int, bool) {
+			return homotopyPseudoTransient(elementList, currentNodes, H, B, X0, nodeCount, options)
+		}},
+	}
+
+	for _, m := range methods {
+		if m.steps == 0 {
+			continue
+		}
+
+		guess, iterations, converged := m.solve()
+		result.iterations += iterations
+		if !converged {
+			continue
+		}
+
+		// Final solve of the unmodified circuit from the continuation result
+		X, linearH, linearB, iterations, converged := mnaNewton(elementList, currentNodes, H, B, guess, 0, nil, 0, options, options.Itl1)
+		result.iterations += iterations
+		if converged {
+			result.method = m.name
+			result.converged = true
+			return X, linearH, linearB, result
+		}
+	}
+
+	return X0, H, B, result
+}
+
+// homotopyGminStepping adds a conductance from every node to ground, decreasing it geometrically from
+// homotopyGminStart to options.Gmin in options.GminSteps steps, each step starting from the last solution. A failed
+// step is split at its geometric midpoint until it converges or becomes smaller than homotopyMinStep.
+func homotopyGminStepping(elementList *Element, currentNodes map[string]int, H [][]float64, B []float64,
+	X0 []float64, nodeCount int, options SimOptions) ([]float64, int, bool) {
+	if options.Gmin >= homotopyGminStart {
+		// There is nothing to step down from
+		return X0, 0, false
+	}
+
+	total := 0
+	X := X0
+	lastGood := 0.0
+	ratio := math.Log(options.Gmin / homotopyGminStart)
+
+	for k := 0; k <= options.GminSteps; k++ {
+		target := homotopyGminStart * math.Exp(ratio*float64(k)/float64(options.GminSteps))
+		if k == options.GminSteps {
+			target = options.Gmin
+		}
+
+		gmin := target
+		for {
+			steppedH, steppedB := mnaCopyMatrixAndVector(H, B)
+			for n := 1; n <= nodeCount; n++ {
+				mnaStampConductance(steppedH, n, 0, gmin)
+			}
+
+			newX, _, _, iterations, converged := mnaNewton(elementList, currentNodes, steppedH, steppedB, X, 0, nil, 0, options, options.Itl1)
+			total += iterations
+			if converged {
+				X = newX
+				lastGood = gmin
+				if gmin == target {
+					break
+				}
+				gmin = target
+				continue
+			}
+
+			if lastGood == 0.0 {
+				// Not even the largest gmin helps
+				return X, total, false
+			}
+			gmin = math.Sqrt(lastGood * gmin)
+			if lastGood/gmin < 1.0+homotopyMinStep {
+				return X, total, false
+			}
+		}
+	}
+
+	return X, total, true
+}
+
+// homotopySourceStepping ramps every independent source from zero to its value. At t = 0 each entry of B comes
+// from a source (retrieveSourceValue) or an initial condition, so ramping the sources is scaling B. Failed steps
+// are retried with half the step.
+func homotopySourceStepping(elementList *Element, currentNodes map[string]int, H [][]float64, B []float64,
+	options SimOptions) ([]float64, int, bool) {
+	total := 0
+	X := make([]float64, len(B))
+	scaledB := make([]float64, len(B))
+	alpha := 0.0
+	step := 1.0 / float64(options.SrcSteps)
+
+	for alpha < 1.0 {
+		next := math.Min(alpha+step, 1.0)
+		for i := range B {
+			scaledB[i] = next * B[i]
+		}
+
+		newX, _, _, iterations, converged := mnaNewton(elementList, currentNodes, H, scaledB, X, 0, nil, 0, options, options.Itl1)
+		total += iterations
+		if converged {
+			X = newX
+			alpha = next
+		} else {
+			step = step / 2.0
+			if step < homotopyMinStep {
+				return X, total, false
+			}
+		}
+	}
+
+	return X, total, true
+}
+
+// homotopyPseudoTransient integrates the circuit with a capacitor from every node to ground (backward Euler,
+// conductance c/h) until it settles. The pseudo timestep grows after each accepted step and shrinks after a
+// failed one.
+func homotopyPseudoTransient(elementList *Element, currentNodes map[string]int, H [][]float64, B []float64,
+	X0 []float64, nodeCount int, options SimOptions) ([]float64, int, bool) {
+	total := 0
+	X := make([]float64, len(B))
+	if X0 != nil {
+		copy(X, X0)
+	}
+	g := homotopyPtranStart
+
+	for step := 0; step < options.PtranSteps; step++ {
+		steppedH, steppedB := mnaCopyMatrixAndVector(H, B)
+		for n := 1; n <= nodeCount; n++ {
+			mnaStampConductance(steppedH, n, 0, g)
+			steppedB[n-1] += g * X[n-1]
+		}
+
+		newX, _, _, iterations, converged := mnaNewton(elementList, currentNodes, steppedH, steppedB, X, 0, nil, 0, options, options.Itl1)
+		total += iterations
+		if !converged {
+			g = g * 4.0
+			continue
+		}
+
+		// Steady state: the pseudo capacitors carry no current anymore
+		change := 0.0
+		for n := 0; n < nodeCount; n++ {
+			change = math.Max(change, math.Abs(newX[n]-X[n])/(math.Abs(newX[n])+options.VNTol))
+		}
+		X = newX
+		if change < homotopyPtranSteady {
+			return X, total, true
+		}
+		g = g / 2.0
+	}
+
+	return X, total, false
+}
@@ -0,0 +1,96 @@
+package internal
+
+import "math"
+
+// jfetDrainCurrent evaluates the Shichman-Hodges drain current of a N-channel JFET and its
+// derivatives with respect to vgs and vds. For vds < 0 drain and source swap their roles.
+func jfetDrainCurrent(desc *jfetDescriptor, vgs float64, vds float64) (float64, float64, float64) {
+	beta := desc.beta * desc.area
+
+	if vds >= 0 {
+		vgst := vgs - desc.vto
+		if vgst <= 0 {
+			return 0.0, 0.0, 0.0
+		}
+
+		betap := beta * (1 + desc.lambda*vds)
+		if vgst <= vds {
+			// Saturation
+			id := betap * vgst * vgst
+			return id, 2 * betap * vgst, beta * desc.lambda * vgst * vgst
+		}
+
+		// Linear region
+		id := betap * vds * (2*vgst - vds)
+		return id, 2 * betap * vds, betap*(2*vgst-2*vds) + beta*desc.lambda*vds*(2*vgst-vds)
+	}
+
+	// Inverse mode: the gate-drain voltage controls the channel
+	vgdt := vgs - vds - desc.vto
+	if vgdt <= 0 {
+		return 0.0, 0.0, 0.0
+	}
+
+	betap := beta * (1 - desc.lambda*vds)
+	if vgdt <= -vds {
+		id := -betap * vgdt * vgdt
+		return id, -2 * betap * vgdt, beta*desc.lambda*vgdt*vgdt + 2*betap*vgdt
+	}
+
+	f := vds * (2*vgdt + vds)
+	id := betap * f
+	return id, 2 * betap * vds, -beta*desc.lambda*f + 2*betap*vgdt
+}
+
+// jfetJunctionCurrent evaluates a gate junction diode current and conductance at the device temperature.
+func jfetJunctionCurrent(desc *jfetDescriptor, v float64, gmin float64) (float64, float64) {
+	is := desc.isT * desc.area
+	vt := desc.vt
+
+	if v > -5*vt {
+		ev := math.Exp(v / vt)
+		return is*(ev-1) + gmin*v, is*ev/vt + gmin
+	}
+
+	return -is + gmin*v, gmin
+}
+
+// jfetJunctionCharge evaluates the depletion charge and capacitance of a gate junction with
+// zero-bias capacitance cj0 (grading coefficient 0.5), linearized above fc*pb.
+func jfetJunctionCharge(desc *jfetDescriptor, cj0 float64, v float64) (float64, float64) {
+	cj0 = cj0 * desc.area
+	pb := desc.pb
+	fc := desc.fc
+
+	if v < fc*pb {
+		sq := math.Sqrt(1 - v/pb)
+		return 2 * pb * cj0 * (1 - sq), cj0 / sq
+	}
+
+	f1 := 2 * pb * (1 - math.Sqrt(1-fc))
+	f2 := math.Pow(1-fc, 1.5)
+	f3 := 1 - fc*1.5
+	vf := fc * pb
+	q := cj0*f1 + cj0/f2*(f3*(v-vf)+0.25/pb*(v*v-vf*vf))
+	return q, cj0 / f2 * (f3 + 0.5*v/pb)
+}
+
+// jfetLimitJunction limits the change of a junction voltage between Newton iterations so the
+// exponential does not overflow (SPICE pnjlim).
+func jfetLimitJunction(desc *jfetDescriptor, vNew float64, vOld float64) float64 {
+	vt := desc.vt
+	vCrit := vt * math.Log(vt/(math.Sqrt2*desc.isT*desc.area))
+
+	if vNew > vCrit && math.Abs(vNew-vOld) > 2*vt {
+		if vOld > 0 {
+			arg := 1 + (vNew-vOld)/vt
+			if arg > 0 {
+				return vOld + vt*math.Log(arg)
+			}
+			return vCrit
+		}
+		return vt * math.Log(vNew/vt)
+	}
+
+	return vNew
+}
@@ -6,23 +6,35 @@ import (
 )
 
 type Lexer struct {
+	fileName    string
 	netlistFile []byte
 	position    int
 	lineNumber  int
+	lineStart   int    // position of the first byte of the current line
+	Title       string // first line of the netlist
 	eof         bool
 }
 
 type TokenType int
 
 const (
-	TokenStr       TokenType = iota
-	TokenLineBreak TokenType = iota
-	TokenCommand   TokenType = iota
+	TokenStr        TokenType = iota
+	TokenLineBreak  TokenType = iota
+	TokenCommand    TokenType = iota
+	TokenOpenParen  TokenType = iota // (
+	TokenCloseParen TokenType = iota // )
+	TokenEqual      TokenType = iota // =
+	TokenComma      TokenType = iota // ,
 )
 
+var lexerPunctuation = map[byte]TokenType{'(': TokenOpenParen, ')': TokenCloseParen, '=': TokenEqual, ',': TokenComma}
+
 type Token struct {
 	TokenType  TokenType
 	TokenValue string
+	File       string
+	Line       int
+	Column     int
 }
 
 func LexerInit(netlistPath string) Lexer {
@@ -32,38 +44,83 @@ func LexerInit(netlistPath string) Lexer {
 		panic(err)
 	}
 
-	lexer := Lexer{
-		netlistFile: data,
-		position:    0,
-		lineNumber:  1,
-		eof:         false}
+	lexer := lexerNew(netlistPath, data)
 
-	// Ignore file's first line
+	// File's first line is the circuit title
 	lexerIgnoreLine(&lexer)
+	lexer.Title = strings.TrimSpace(strings.TrimLeft(string(data[:lexer.position]), "*"))
 
 	return lexer
 }
 
+// lexerInitLibrary opens a .lib file, which has no title line.
+func lexerInitLibrary(libraryPath string) (bool, Lexer) {
+	data, err := ioutil.ReadFile(libraryPath)
+	if err != nil {
+		return true, Lexer{}
+	}
+
+	return false, lexerNew(libraryPath, data)
+}
+
+func lexerNew(fileName string, data []byte) Lexer {
+	return Lexer{
+		fileName:    fileName,
+		netlistFile: data,
+		position:    0,
+		lineNumber:  1,
+		lineStart:   0,
+		eof:         len(data) == 0}
+}
+
 func LexerNextToken(lexer *Lexer) Token {
 	var newToken Token
 
-	if lexer.eof {
-		return newToken
+	// Ignore comments, spaces and continuation lines
+	if !lexer.eof {
+		lexerJumpCommentsAndSpaces(lexer)
 	}
 
-	// Ignore comments and spaces
-	lexerJumpCommentsAndSpaces(lexer)
+	newToken.File = lexer.fileName
+	newToken.Line = lexer.lineNumber
+	newToken.Column = lexer.position - lexer.lineStart + 1
+
+	// The end of file behaves as a final line break
+	if lexer.eof || lexer.position >= len(lexer.netlistFile) {
+		lexer.eof = true
+		newToken.TokenType = TokenLineBreak
+		return newToken
+	}
 
 	// If lexeme starts with '\n', we assume it is just a line break
-	if lexer.netlistFile[lexer.position] == '\n' || lexer.netlistFile[lexer.position] == '\r' {
-		if lexer.netlistFile[lexer.position] == '\r' && lexer.position < len(lexer.netlistFile)-1 &&
-			lexer.netlistFile[lexer.position+1] == '\n' {
-			lexer.position = lexer.position + 2
-		} else {
+	if lexerCurrentByteIsLineBreak(lexer) {
+		lexerJumpLineBreak(lexer)
+		newToken.TokenType = TokenLineBreak
+		lexer.eof = lexer.position == len(lexer.netlistFile)
+		return newToken
+	}
+
+	// An expression runs until its closing brace, spaces and punctuation included
+	if lexer.netlistFile[lexer.position] == '{' {
+		valueStartPosition := lexer.position
+		for lexer.position < len(lexer.netlistFile) && !lexerCurrentByteIsLineBreak(lexer) &&
+			lexer.netlistFile[lexer.position] != '}' {
 			lexer.position = lexer.position + 1
 		}
-		lexer.lineNumber = lexer.lineNumber + 1
-		newToken.TokenType = TokenLineBreak
+		if lexer.position < len(lexer.netlistFile) && lexer.netlistFile[lexer.position] == '}' {
+			lexer.position = lexer.position + 1
+		}
+		newToken.TokenType = TokenStr
+		newToken.TokenValue = strings.ToLower(string(lexer.netlistFile[valueStartPosition:lexer.position]))
+		lexer.eof = lexer.position == len(lexer.netlistFile)
+		return newToken
+	}
+
+	// Punctuation is always a token on its own
+	if tokenType, isPunctuation := lexerPunctuation[lexer.netlistFile[lexer.position]]; isPunctuation {
+		newToken.TokenType = tokenType
+		newToken.TokenValue = string(lexer.netlistFile[lexer.position])
+		lexer.position = lexer.position + 1
 		lexer.eof = lexer.position == len(lexer.netlistFile)
 		return newToken
 	}
@@ -78,32 +135,52 @@ func LexerNextToken(lexer *Lexer) Token {
 
 	valueStartPosition := lexer.position
 	for lexer.position < len(lexer.netlistFile) && !lexerCurrentByteIsSpace(lexer) &&
-		lexer.netlistFile[lexer.position] != '\n' && lexer.netlistFile[lexer.position] != '\r' {
+		!lexerCurrentByteIsLineBreak(lexer) && lexer.netlistFile[lexer.position] != ';' {
+		if _, isPunctuation := lexerPunctuation[lexer.netlistFile[lexer.position]]; isPunctuation {
+			break
+		}
 		lexer.position = lexer.position + 1
 	}
 	newToken.TokenValue = strings.ToLower(string(lexer.netlistFile[valueStartPosition:lexer.position]))
 	lexer.eof = lexer.position == len(lexer.netlistFile)
+
+	// Nothing after ".end" is part of the circuit
+	if newToken.TokenType == TokenCommand && newToken.TokenValue == ".end" {
+		lexer.eof = true
+		newToken.TokenType = TokenLineBreak
+		newToken.TokenValue = ""
+	}
+
 	return newToken
 }
 
 func lexerIgnoreLine(lexer *Lexer) {
-	for lexer.position < len(lexer.netlistFile) && lexer.netlistFile[lexer.position] != '\n' &&
-		lexer.netlistFile[lexer.position] != '\r' {
+	lexerIgnoreComment(lexer)
+	lexerJumpLineBreak(lexer)
+
+	if lexer.position >= len(lexer.netlistFile) {
+		lexer.eof = true
+	}
+}
+
+// lexerIgnoreComment skips until the end of the current line, keeping the line break.
+func lexerIgnoreComment(lexer *Lexer) {
+	for lexer.position < len(lexer.netlistFile) && !lexerCurrentByteIsLineBreak(lexer) {
 		lexer.position = lexer.position + 1
 	}
+}
 
+func lexerJumpLineBreak(lexer *Lexer) {
 	if lexer.position < len(lexer.netlistFile) && lexer.netlistFile[lexer.position] == '\r' {
 		lexer.position = lexer.position + 1
 	}
 
 	if lexer.position < len(lexer.netlistFile) && lexer.netlistFile[lexer.position] == '\n' {
 		lexer.position = lexer.position + 1
-		lexer.lineNumber = lexer.lineNumber + 1
 	}
 
-	if lexer.position >= len(lexer.netlistFile) {
-		lexer.eof = true
-	}
+	lexer.lineNumber = lexer.lineNumber + 1
+	lexer.lineStart = lexer.position
 }
 
 func lexerCurrentByteIsSpace(lexer *Lexer) bool {
@@ -115,21 +192,84 @@ func lexerCurrentByteIsSpace(lexer *Lexer) bool {
 	return false
 }
 
+func lexerCurrentByteIsLineBreak(lexer *Lexer) bool {
+	return lexer.netlistFile[lexer.position] == '\n' || lexer.netlistFile[lexer.position] == '\r'
+}
+
+// lexerAtLineStart tells whether only spaces precede the current position in its line.
+func lexerAtLineStart(lexer *Lexer) bool {
+	for i := lexer.lineStart; i < lexer.position; i++ {
+		if lexer.netlistFile[i] != ' ' && lexer.netlistFile[i] != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// lexerContinues tells whether the line break at the current position is followed by a '+'
+// continuation line, possibly after full-line comments.
+func lexerContinues(lexer *Lexer) bool {
+	position := lexer.position
+	for position < len(lexer.netlistFile) {
+		// Jump the line break
+		if lexer.netlistFile[position] == '\r' {
+			position = position + 1
+		}
+		if position < len(lexer.netlistFile) && lexer.netlistFile[position] == '\n' {
+			position = position + 1
+		}
+
+		for position < len(lexer.netlistFile) &&
+			(lexer.netlistFile[position] == ' ' || lexer.netlistFile[position] == '\t') {
+			position = position + 1
+		}
+		if position >= len(lexer.netlistFile) {
+			return false
+		}
+
+		switch lexer.netlistFile[position] {
+		case '+':
+			return true
+		case '*':
+			for position < len(lexer.netlistFile) && lexer.netlistFile[position] != '\n' &&
+				lexer.netlistFile[position] != '\r' {
+				position = position + 1
+			}
+		default:
+			return false
+		}
+	}
+	return false
+}
+
 func lexerJumpCommentsAndSpaces(lexer *Lexer) {
-	isComment := lexer.netlistFile[lexer.position] == '*'
-	isSpace := lexerCurrentByteIsSpace(lexer)
-	for isComment || isSpace {
-		if isComment {
+	for lexer.position < len(lexer.netlistFile) {
+		current := lexer.netlistFile[lexer.position]
+		if lexerCurrentByteIsSpace(lexer) {
+			lexer.position = lexer.position + 1
+		} else if current == '*' && lexerAtLineStart(lexer) {
+			// Full-line comment
 			lexerIgnoreLine(lexer)
-		} else if isSpace {
+		} else if current == ';' || current == '$' {
+			// Inline comment, the line break still ends the line
+			lexerIgnoreComment(lexer)
+		} else if lexerCurrentByteIsLineBreak(lexer) && lexerContinues(lexer) {
+			// Join the next line, comments in between included
+			for lexer.netlistFile[lexer.position] != '+' {
+				if lexerCurrentByteIsLineBreak(lexer) {
+					lexerJumpLineBreak(lexer)
+				} else {
+					lexer.position = lexer.position + 1
+				}
+			}
 			lexer.position = lexer.position + 1
-		}
-
-		if lexer.position >= len(lexer.netlistFile) {
+		} else {
 			return
 		}
-
-		isComment = lexer.netlistFile[lexer.position] == '*'
-		isSpace = lexerCurrentByteIsSpace(lexer)
 	}
 }
+
+// lexerLexeme returns the token just read as written in the file, without lowercasing it.
+func lexerLexeme(lexer *Lexer, token Token) string {
+	return string(lexer.netlistFile[lexer.position-len(token.TokenValue) : lexer.position])
+}
@@ -0,0 +1,69 @@
+package internal
+
+// librarySection is a ".lib <name>" ... ".endl" block of models and parameters, such as a process corner
+type librarySection struct {
+	models map[string]*Model
+	params []paramDefinition
+	token  Token // section name, for diagnostics
+}
+
+// library holds the sections defined in the netlist and in the files it loads, and the ones it uses
+type library struct {
+	sections map[string]*librarySection
+	selected []string // sections used by ".lib <file> <section>", in order
+}
+
+// librarySections returns the sections in use at a .step point: the selected ones, then the stepped one.
+func librarySections(lib library, sweeps []stepSweep, point []float64) []*librarySection {
+	sections := make([]*librarySection, 0)
+	for _, name := range lib.selected {
+		sections = append(sections, lib.sections[name])
+	}
+	for i, s := range sweeps {
+		if s.kind == stepKindLib {
+			sections = append(sections, lib.sections[s.names[int(point[i])]])
+		}
+	}
+	return sections
+}
+
+// libraryModels adds the models of the sections to the ones of the netlist, later sections taking precedence.
+func libraryModels(models map[string]*Model, sections []*librarySection) map[string]*Model {
+	if len(sections) == 0 {
+		return models
+	}
+
+	merged := make(map[string]*Model)
+	for name, model := range models {
+		merged[name] = model
+	}
+	for _, section := range sections {
+		for name, model := range section.models {
+			merged[name] = model
+		}
+	}
+	return merged
+}
+
+// libraryParams puts the parameters of the sections before the ones of the netlist, so the netlist can use them.
+// A netlist parameter with the name of a section parameter is left out: the corner decides its value.
+func libraryParams(params []paramDefinition, sections []*librarySection) []paramDefinition {
+	if len(sections) == 0 {
+		return params
+	}
+
+	defined := make(map[string]bool)
+	merged := make([]paramDefinition, 0)
+	for _, section := range sections {
+		for _, p := range section.params {
+			defined[p.name] = true
+			merged = append(merged, p)
+		}
+	}
+	for _, p := range params {
+		if !defined[p.name] {
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,486 @@
+package internal
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"text/tabwriter"
+)
+
+type measureKind int
+
+const (
+	measureTrigTarg measureKind = iota // x distance between two conditions (delay, rise and fall times)
+	measureFind     measureKind = iota // value of an output at a condition
+	measureWhen     measureKind = iota // x position of a condition
+	measureDeriv    measureKind = iota // derivative of an output at a condition
+	measureAvg      measureKind = iota
+	measureRms      measureKind = iota
+	measureMin      measureKind = iota
+	measureMax      measureKind = iota
+	measurePP       measureKind = iota // peak to peak
+	measureInteg    measureKind = iota
+	measureParam    measureKind = iota // expression of parameters and other measurements
+)
+
+var measureAggregates = map[string]measureKind{"avg": measureAvg, "rms": measureRms, "min": measureMin,
+	"max": measureMax, "pp": measurePP, "integ": measureInteg}
+
+type measureEdge int
+
+const (
+	measureCross measureEdge = iota
+	measureRise  measureEdge = iota
+	measureFall  measureEdge = iota
+)
+
+// measureCondition locates a point of the x axis (time or frequency): a fixed position, or the n-th time an
+// output crosses a level or another output. Positions and levels are expressions.
+type measureCondition struct {
+	at      string // position, empty for a crossing
+	output  outputVariable
+	level   string
+	against *outputVariable // output crossed instead of a level
+	edge    measureEdge
+	count   int    // which crossing, 0 for the last one
+	delay   string // crossings before it are ignored, empty for none
+}
+
+// measure is one .meas line
+type measure struct {
+	analysis   string // tran, ac or dc
+	name       string
+	kind       measureKind
+	output     outputVariable   // what is found, derived or aggregated
+	trig       measureCondition // TRIG, or the condition of FIND, WHEN and DERIV
+	targ       measureCondition
+	from       string // window of aggregates, empty for the whole results
+	to         string
+	expression string // PARAM
+	token      Token
+}
+
+// measureResult is a measurement of one run, err telling why it could not be made
+type measureResult struct {
+	value float64
+	err   string
+}
+
+// measureTable holds the measurements of an analysis: one row for every run, or every group of runs for dc
+type measureTable struct {
+	analysis string
+	names    []string
+	labels   []string
+	rows     [][]measureResult
+}
+
+// measureWave returns the values of an output over the x axis of the results.
+type measureWave func(o outputVariable) []float64
+
+// measureOutputs lists the outputs the measurements of an analysis use.
+func measureOutputs(measures []measure, analysis string) []outputVariable {
+	outputs := make([]outputVariable, 0)
+	used := make(map[string]bool)
+	add := func(o outputVariable) {
+		if !used[outputName(o)] {
+			used[outputName(o)] = true
+			outputs = append(outputs, o)
+		}
+	}
+	for _, m := range measures {
+		if m.analysis != analysis || m.kind == measureParam {
+			continue
+		}
+		for _, c := range []measureCondition{m.trig, m.targ} {
+			if c.at == "" && c.output.node != "" {
+				add(c.output)
+			}
+			if c.against != nil {
+				add(*c.against)
+			}
+		}
+		if m.output.node != "" {
+			add(m.output)
+		}
+	}
+	return outputs
+}
+
+// measureRun evaluates the measurements of an analysis on the results of a run. Expressions may use the .param
+// values and the measurements before them.
+func measureRun(measures []measure, analysis string, x []float64, wave measureWave,
+	params map[string]float64) ([]string, []measureResult) {
+	names := make([]string, 0)
+	results := make([]measureResult, 0)
+	values := make(map[string]float64)
+	for name, value := range params {
+		values[name] = value
+	}
+	failed := make([]string, 0)
+
+	for _, m := range measures {
+		if m.analysis != analysis {
+			continue
+		}
+		err, value := measureEvaluate(m, x, wave, exprScope{params: values})
+		if err != "" {
+			for _, name := range failed {
+				if err == fmt.Sprintf("parameter '%s' is not defined", name) {
+					err = fmt.Sprintf("measurement '%s' failed", name)
+				}
+			}
+			failed = append(failed, m.name)
+		} else {
+			values[m.name] = value
+		}
+		names = append(names, m.name)
+		results = append(results, measureResult{value: value, err: err})
+	}
+	return names, results
+}
+
+// measureEvaluate makes a measurement. It returns an error message, empty on success.
+func measureEvaluate(m measure, x []float64, wave measureWave, scope exprScope) (string, float64) {
+	if m.kind == measureParam {
+		return exprEvaluate(m.expression, scope)
+	}
+	if len(x) == 0 {
+		return "there are no results", 0.0
+	}
+
+	switch m.kind {
+	case measureTrigTarg:
+		err, trig := measureLocate(m.trig, x, wave, scope)
+		if err != "" {
+			return "trig: " + err, 0.0
+		}
+		err, targ := measureLocate(m.targ, x, wave, scope)
+		if err != "" {
+			return "targ: " + err, 0.0
+		}
+		return "", targ - trig
+	case measureWhen:
+		return measureLocate(m.trig, x, wave, scope)
+	case measureFind, measureDeriv:
+		err, position := measureLocate(m.trig, x, wave, scope)
+		if err != "" {
+			return err, 0.0
+		}
+		if m.kind == measureFind {
+			return measureInterpolate(x, wave(m.output), position)
+		}
+		return measureDerivative(x, wave(m.output), position)
+	}
+
+	// Aggregates over the window
+	from, to := x[0], x[len(x)-1]
+	for _, bound := range []struct {
+		expression string
+		value      *float64
+	}{{m.from, &from}, {m.to, &to}} {
+		if bound.expression != "" {
+			err, value := exprEvaluate(bound.expression, scope)
+			if err != "" {
+				return err, 0.0
+			}
+			*bound.value = value
+		}
+	}
+	if from > to || from < x[0] || to > x[len(x)-1] {
+		return fmt.Sprintf("window from %g to %g is not within the results (%g to %g)", from, to, x[0], x[len(x)-1]), 0.0
+	}
+	wx, wy := measureWindow(x, wave(m.output), from, to)
+
+	switch m.kind {
+	case measureMin, measureMax, measurePP:
+		min, max := wy[0], wy[0]
+		for _, y := range wy {
+			min = math.Min(min, y)
+			max = math.Max(max, y)
+		}
+		if m.kind == measureMin {
+			return "", min
+		} else if m.kind == measureMax {
+			return "", max
+		}
+		return "", max - min
+	case measureInteg:
+		return "", measureIntegrate(wx, wy)
+	}
+
+	if to == from {
+		return "the window is empty", 0.0
+	}
+	if m.kind == measureAvg {
+		return "", measureIntegrate(wx, wy) / (to - from)
+	}
+	squares := make([]float64, len(wy))
+	for i, y := range wy {
+		squares[i] = y * y
+	}
+	return "", math.Sqrt(measureIntegrate(wx, squares) / (to - from))
+}
+
+// measureLocate returns the x position of a condition.
+func measureLocate(c measureCondition, x []float64, wave measureWave, scope exprScope) (string, float64) {
+	if c.at != "" {
+		err, at := exprEvaluate(c.at, scope)
+		if err != "" {
+			return err, 0.0
+		}
+		if at < x[0] || at > x[len(x)-1] {
+			return fmt.Sprintf("%g is not within the results (%g to %g)", at, x[0], x[len(x)-1]), 0.0
+		}
+		return "", at
+	}
+
+	// A crossing of another output is a crossing of zero by the difference
+	y := wave(c.output)
+	level := 0.0
+	what := ""
+	if c.against != nil {
+		other := wave(*c.against)
+		difference := make([]float64, len(y))
+		for i := range y {
+			difference[i] = y[i] - other[i]
+		}
+		y = difference
+		what = outputName(*c.against)
+	} else {
+		err := ""
+		err, level = exprEvaluate(c.level, scope)
+		if err != "" {
+			return err, 0.0
+		}
+		what = fmt.Sprintf("%g", level)
+	}
+	delay := x[0]
+	if c.delay != "" {
+		err := ""
+		err, delay = exprEvaluate(c.delay, scope)
+		if err != "" {
+			return err, 0.0
+		}
+	}
+
+	found, position, crossings := measureCrossing(x, y, level, c.edge, c.count, delay)
+	if !found {
+		edge := map[measureEdge]string{measureCross: "crosses", measureRise: "rises through", measureFall: "falls through"}[c.edge]
+		if crossings == 0 {
+			return fmt.Sprintf("%s never %s %s after %g", outputName(c.output), edge, what, delay), 0.0
+		}
+		return fmt.Sprintf("%s %s %s only %d time(s) after %g", outputName(c.output), edge, what, crossings, delay), 0.0
+	}
+	return "", position
+}
+
+// measureCrossing finds the count-th crossing (the last one for 0) of a level from delay on, interpolating
+// between the points of the results. It also returns how many crossings there are.
+func measureCrossing(x []float64, y []float64, level float64, edge measureEdge, count int,
+	delay float64) (bool, float64, int) {
+	found := false
+	position := 0.0
+	crossings := 0
+	for i := 1; i < len(x); i++ {
+		before, after := y[i-1]-level, y[i]-level
+		rising := before < 0.0 && after >= 0.0
+		falling := before > 0.0 && after <= 0.0
+		if !(rising && edge != measureFall) && !(falling && edge != measureRise) {
+			continue
+		}
+		crossing := x[i-1] + (x[i]-x[i-1])*before/(before-after)
+		if crossing < delay {
+			continue
+		}
+		crossings = crossings + 1
+		found, position = true, crossing
+		if crossings == count {
+			return true, position, crossings
+		}
+	}
+	return found && count == 0, position, crossings
+}
+
+// measureInterpolate returns the value at position, linear between the points of the results.
+func measureInterpolate(x []float64, y []float64, position float64) (string, float64) {
+	for i := 1; i < len(x); i++ {
+		if position <= x[i] && x[i] > x[i-1] {
+			return "", y[i-1] + (y[i]-y[i-1])*(position-x[i-1])/(x[i]-x[i-1])
+		}
+	}
+	if len(x) > 0 && position == x[len(x)-1] {
+		return "", y[len(y)-1]
+	}
+	return fmt.Sprintf("%g is not within the results", position), 0.0
+}
+
+// measureDerivative returns the slope at position: the one of its segment, or the mean slope around a point.
+func measureDerivative(x []float64, y []float64, position float64) (string, float64) {
+	slope := func(i int, j int) float64 {
+		return (y[j] - y[i]) / (x[j] - x[i])
+	}
+	for i := 1; i < len(x); i++ {
+		if position > x[i] || x[i] == x[i-1] {
+			continue
+		}
+		if position == x[i] && i+1 < len(x) && x[i+1] > x[i] {
+			return "", slope(i-1, i+1)
+		}
+		return "", slope(i-1, i)
+	}
+	return fmt.Sprintf("can not derive at %g, the results need two points around it", position), 0.0
+}
+
+// measureWindow returns the points from from to to, the bounds interpolated.
+func measureWindow(x []float64, y []float64, from float64, to float64) ([]float64, []float64) {
+	_, first := measureInterpolate(x, y, from)
+	_, last := measureInterpolate(x, y, to)
+	wx := []float64{from}
+	wy := []float64{first}
+	for i := range x {
+		if x[i] > from && x[i] < to {
+			wx = append(wx, x[i])
+			wy = append(wy, y[i])
+		}
+	}
+	return append(wx, to), append(wy, last)
+}
+
+// measureIntegrate integrates by the trapezoidal rule.
+func measureIntegrate(x []float64, y []float64) float64 {
+	integral := 0.0
+	for i := 1; i < len(x); i++ {
+		integral = integral + (x[i]-x[i-1])*(y[i]+y[i-1])/2.0
+	}
+	return integral
+}
+
+// measureReport prints a table of the measurements of every analysis and the reason of each failure, and writes
+// them all to file unless it is empty.
+func measureReport(tables []measureTable, file string, digits int) {
+	for _, t := range tables {
+		if len(t.names) == 0 {
+			continue
+		}
+		stepped := false
+		for _, label := range t.labels {
+			stepped = stepped || label != ""
+		}
+
+		fmt.Printf("Measurements (%s):\n\n", t.analysis)
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintf(writer, "\t")
+		if stepped {
+			fmt.Fprintf(writer, "step\t")
+		}
+		for _, name := range t.names {
+			fmt.Fprintf(writer, "%s\t", name)
+		}
+		fmt.Fprintf(writer, "\n")
+		for run, row := range t.rows {
+			fmt.Fprintf(writer, "\t")
+			if stepped {
+				fmt.Fprintf(writer, "%s\t", t.labels[run])
+			}
+			for _, r := range row {
+				if r.err != "" {
+					fmt.Fprintf(writer, "failed\t")
+				} else {
+					fmt.Fprintf(writer, "%.*g\t", digits+1, r.value)
+				}
+			}
+			fmt.Fprintf(writer, "\n")
+		}
+		writer.Flush()
+
+		for run, row := range t.rows {
+			for i, r := range row {
+				if r.err == "" {
+					continue
+				}
+				if stepped {
+					fmt.Printf("\tfailed: %s (%s): %s\n", t.names[i], t.labels[run], r.err)
+				} else {
+					fmt.Printf("\tfailed: %s: %s\n", t.names[i], r.err)
+				}
+			}
+		}
+		fmt.Printf("\n")
+	}
+
+	if file != "" && measureExport(tables, file) {
+		os.Exit(1)
+	}
+}
+
+// measureExport writes the measurements as CSV, one line per measurement of each run.
+func measureExport(tables []measureTable, file string) bool {
+	f, err := os.Create(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Measure Error: %s\n", err)
+		return true
+	}
+	defer f.Close()
+
+	writer := csv.NewWriter(f)
+	writer.Write([]string{"analysis", "step", "measurement", "value", "error"})
+	for _, t := range tables {
+		for run, row := range t.rows {
+			for i, r := range row {
+				value := ""
+				if r.err == "" {
+					value = fmt.Sprintf("%.*g", 15, r.value)
+				}
+				writer.Write([]string{t.analysis, t.labels[run], t.names[i], value, r.err})
+			}
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		fmt.Fprintf(os.Stderr, "Measure Error: %s\n", err)
+		return true
+	}
+	return false
+}
+
+// measureSweep gathers the operating points of the runs that only differ in the value of the last .step sweep,
+// the x axis of dc measurements
+type measureSweep struct {
+	groups []string
+	x      map[string][]float64
+	y      map[string]map[string][]float64 // values of each output by name
+	params map[string]map[string]float64
+}
+
+func measureSweepAdd(s *measureSweep, group string, x float64, values map[string]float64, params map[string]float64) {
+	if s.x == nil {
+		s.x = make(map[string][]float64)
+		s.y = make(map[string]map[string][]float64)
+		s.params = make(map[string]map[string]float64)
+	}
+	if _, exists := s.x[group]; !exists {
+		s.groups = append(s.groups, group)
+		s.y[group] = make(map[string][]float64)
+	}
+	s.x[group] = append(s.x[group], x)
+	for name, value := range values {
+		s.y[group][name] = append(s.y[group][name], value)
+	}
+	s.params[group] = params
+}
+
+// measureSweepRun evaluates the dc measurements of every group.
+func measureSweepRun(s measureSweep, measures []measure) measureTable {
+	table := measureTable{analysis: "dc"}
+	for _, group := range s.groups {
+		wave := func(o outputVariable) []float64 {
+			return s.y[group][outputName(o)]
+		}
+		names, results := measureRun(measures, "dc", s.x[group], wave, s.params[group])
+		table.names = names
+		table.labels = append(table.labels, group)
+		table.rows = append(table.rows, results)
+	}
+	return table
+}
@@ -4,8 +4,30 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"strings"
 )
 
+const (
+	mnaGClamp = 1e10 // conductance holding the nodes of .ic and .nodeset at their voltages
+)
+
+// mnaInitialState tells how capacitors and inductors are stamped at t = 0
+type mnaInitialState int
+
+const (
+	mnaStateDC        mnaInitialState = iota // capacitors open and inductors shorted
+	mnaStateTransient mnaInitialState = iota // as DC, but capacitors and inductors with ic= held at it
+	mnaStateUIC       mnaInitialState = iota // capacitors and inductors at their initial conditions, or at X when not given
+)
+
+// mnaConditions are the user given conditions that shape the solution at t = 0, indexed by node
+type mnaConditions struct {
+	ic      map[int]float64 // voltages held while computing the initial transient solution (.ic)
+	nodeset map[int]float64 // voltages guiding the nonlinear DC solution (.nodeset)
+	uic     bool            // start the transient from the initial conditions instead of the operating point
+	quiet   bool            // no convergence report, for analyses that solve the operating point many times
+}
+
 func retrieveSourceValue(e Element, time float64) float64 {
 	if e.ElementType != ElementCurrentSource && e.ElementType != ElementVoltageSource {
 		panic("retrieveSourceValue must receive source element")
@@ -46,7 +68,7 @@ func mnaIdentifyGroups(elementList *Element) {
 	for currentElement != nil {
 		if currentElement.ElementType == ElementVoltageSource || currentElement.ElementType == ElementVCVS ||
 			currentElement.ElementType == ElementCCVS || currentElement.ElementType == ElementCapacitor ||
-			currentElement.ElementType == ElementInductor {
+			currentElement.ElementType == ElementInductor || currentElement.ElementType == ElementProbe {
 			currentElement.PreserveCurrent = true
 		}
 
@@ -74,33 +96,248 @@ func assignIndicesToCurrentNodes(elementList *Element, nodesMap map[string]int)
 			startingIndex = startingIndex + 1
 		}
 
+		if currentElement.ElementType == ElementTLine {
+			// Each port of a transmission line has its own branch current
+			currentNodes[currentElement.Label+"#1"] = startingIndex
+			currentNodes[currentElement.Label+"#2"] = startingIndex + 1
+			startingIndex = startingIndex + 2
+		}
+
+		if currentElement.ElementType == ElementLossyLine {
+			// Series currents and inner voltages of the lumped sections are internal unknowns
+			segments := currentElement.Extra.(*ltraDescriptor).segments
+			for k := 1; k <= segments; k++ {
+				currentNodes[mnaLossyLineCurrent(currentElement, k)] = startingIndex
+				startingIndex = startingIndex + 1
+			}
+			for k := 1; k < segments; k++ {
+				currentNodes[mnaLossyLineVoltage(currentElement, k)] = startingIndex
+				startingIndex = startingIndex + 1
+			}
+		}
+
 		currentElement = currentElement.Next
 	}
 
 	return currentNodes
 }
 
-func mnaSolveLinear(elementList *Element, nodesMap map[string]int) {
+// mnaIsInternal tells whether a key of currentNodes is an internal unknown that should not be reported.
+func mnaIsInternal(key string) bool {
+	return strings.HasPrefix(key, "#")
+}
+
+func mnaLossyLineCurrent(e *Element, k int) string {
+	return fmt.Sprintf("#%s.i%d", e.Label, k)
+}
+
+func mnaLossyLineVoltage(e *Element, k int) string {
+	return fmt.Sprintf("#%s.v%d", e.Label, k)
+}
+
+func mnaVoltageAcross(X []float64, nPlus int, nMinus int) float64 {
+	v1 := 0.0
+	v2 := 0.0
+	if nPlus != 0 {
+		v1 = X[nPlus-1]
+	}
+	if nMinus != 0 {
+		v2 = X[nMinus-1]
+	}
+	return v1 - v2
+}
+
+// mnaMaximumTimeStep returns the largest timestep allowed by the circuit elements, or 0 if there is no limit.
+func mnaMaximumTimeStep(elementList *Element) float64 {
+	maxStep := 0.0
+
+	for e := elementList; e != nil; e = e.Next {
+		if e.ElementType == ElementTLine {
+			td := e.Extra.(*tlineDescriptor).td
+			if maxStep == 0.0 || td < maxStep {
+				maxStep = td
+			}
+		}
+	}
+
+	return maxStep
+}
+
+// mnaUpdateHistory stores the accepted solution X at time t in the elements that depend on past values.
+func mnaUpdateHistory(elementList *Element, currentNodes map[string]int, t float64, X []float64) {
+	for e := elementList; e != nil; e = e.Next {
+		if e.ElementType == ElementTLine {
+			desc := e.Extra.(*tlineDescriptor)
+			if t == 0 {
+				desc.history = desc.history[:0]
+			}
+
+			desc.history = append(desc.history, tlineHistoryPoint{
+				t:  t,
+				v1: mnaVoltageAcross(X, e.Nodes[0], e.Nodes[1]),
+				i1: X[currentNodes[e.Label+"#1"]-1],
+				v2: mnaVoltageAcross(X, e.Nodes[2], e.Nodes[3]),
+				i2: X[currentNodes[e.Label+"#2"]-1],
+			})
+
+			// Drop points that can no longer be reached by t - td
+			for len(desc.history) > 2 && desc.history[1].t < t-desc.td {
+				desc.history = desc.history[1:]
+			}
+		}
+
+		if e.ElementType == ElementJFET {
+			desc := e.Extra.(*jfetDescriptor)
+			desc.qgs, _ = jfetJunctionCharge(desc, desc.cgs, desc.polarity*mnaVoltageAcross(X, e.Nodes[1], e.Nodes[2]))
+			desc.qgd, _ = jfetJunctionCharge(desc, desc.cgd, desc.polarity*mnaVoltageAcross(X, e.Nodes[1], e.Nodes[0]))
+		}
+	}
+}
+
+// mnaTLineHistoryAt interpolates the port voltages and currents of a transmission line at time t.
+func mnaTLineHistoryAt(desc *tlineDescriptor, t float64) tlineHistoryPoint {
+	h := desc.history
+	if t <= h[0].t {
+		return h[0]
+	}
+
+	for i := 1; i < len(h); i++ {
+		if h[i].t >= t {
+			a := (t - h[i-1].t) / (h[i].t - h[i-1].t)
+			return tlineHistoryPoint{
+				t:  t,
+				v1: h[i-1].v1 + a*(h[i].v1-h[i-1].v1),
+				i1: h[i-1].i1 + a*(h[i].i1-h[i-1].i1),
+				v2: h[i-1].v2 + a*(h[i].v2-h[i-1].v2),
+				i2: h[i-1].i2 + a*(h[i].i2-h[i-1].i2),
+			}
+		}
+	}
+
+	return h[len(h)-1]
+}
+
+// mnaSolveLinear finds the DC operating point and returns it with the system it satisfies and the indices of
+// the branch currents.
+func mnaSolveLinear(elementList *Element, nodesMap map[string]int, conditions mnaConditions,
+	options SimOptions) ([]float64, [][]float64, []float64, map[string]int) {
 	mnaIdentifyGroups(elementList)
 	currentNodes := assignIndicesToCurrentNodes(elementList, nodesMap)
 
+	X, H, B := mnaOperatingPoint(elementList, currentNodes, len(nodesMap)+len(currentNodes)-1, conditions, options, mnaStateDC)
+	return X, H, B, currentNodes
+}
+
+// mnaOperatingPoint solves the circuit at t = 0 and returns the solution together with the
+// (linearized) system it satisfies. Outside DC, the nodes of .ic are held at their voltages.
+func mnaOperatingPoint(elementList *Element, currentNodes map[string]int, size int,
+	conditions mnaConditions, options SimOptions, state mnaInitialState) ([]float64, [][]float64, []float64) {
 	// Create H Matrix
-	staticH := make([][]float64, len(nodesMap)+len(currentNodes)-1)
-	dynamicH := make([][]float64, len(nodesMap)+len(currentNodes)-1)
+	staticH := make([][]float64, size)
+	dynamicH := make([][]float64, size)
 	for i, _ := range staticH {
-		staticH[i] = make([]float64, len(nodesMap)+len(currentNodes)-1)
-		dynamicH[i] = make([]float64, len(nodesMap)+len(currentNodes)-1)
+		staticH[i] = make([]float64, size)
+		dynamicH[i] = make([]float64, size)
 	}
 
 	// Create B Array
-	staticB := make([]float64, len(nodesMap)+len(currentNodes)-1)
-	dynamicB := make([]float64, len(nodesMap)+len(currentNodes)-1)
+	staticB := make([]float64, size)
+	dynamicB := make([]float64, size)
+
+	// Without an operating point, capacitors start at the voltages given by .ic
+	var X0 []float64
+	if state == mnaStateUIC {
+		X0 = make([]float64, size)
+		for node, v := range conditions.ic {
+			X0[node-1] = v
+		}
+	}
 
 	mnaBuildStaticMatrices(elementList, currentNodes, staticH, staticB)
-	mnaBuildDynamicMatrices(elementList, currentNodes, dynamicH, dynamicB, 0, nil, 0)
+	mnaBuildDynamicMatrices(elementList, currentNodes, dynamicH, dynamicB, 0, X0, 0, state, options)
 	H, B := mnaSumMatricesAndVectors(staticH, staticB, dynamicH, dynamicB)
 
+	if state != mnaStateDC {
+		mnaStampClamps(H, B, conditions.ic)
+	}
+
+	// Nodeset: solve first with the nodes held, then release them starting from that solution
+	if len(conditions.nodeset) > 0 && mnaHasNonlinear(elementList) {
+		clampedH, clampedB := mnaCopyMatrixAndVector(H, B)
+		mnaStampClamps(clampedH, clampedB, conditions.nodeset)
+		guess, _, _, converged := mnaSolveNewton(elementList, currentNodes, clampedH, clampedB, X0, 0, nil, 0, options)
+		if converged {
+			X0 = guess
+		}
+	}
+
+	X, H, B, result := homotopySolve(elementList, currentNodes, H, B, X0, size-len(currentNodes), options)
+	if !result.converged {
+		fmt.Fprintf(os.Stderr, "MNA Error: Operating point did not converge after %d iterations\n", result.iterations)
+		os.Exit(1)
+	}
+
+	if mnaHasNonlinear(elementList) && !conditions.quiet {
+		fmt.Printf("Operating point: %s converged in %d iteration(s)\n\n", result.method, result.iterations)
+	}
+
+	return X, H, B
+}
+
+// mnaReleaseOperatingPoint solves t = 0 again with capacitors and inductors starting where the operating point
+// left them, but without the nodes of .ic held, so the transient starts from consistent branch currents.
+func mnaReleaseOperatingPoint(elementList *Element, currentNodes map[string]int, Xop []float64,
+	options SimOptions) []float64 {
+	size := len(Xop)
+	H := make([][]float64, size)
+	dynamicH := make([][]float64, size)
+	for i := range H {
+		H[i] = make([]float64, size)
+		dynamicH[i] = make([]float64, size)
+	}
+	B := make([]float64, size)
+	dynamicB := make([]float64, size)
+
+	mnaBuildStaticMatrices(elementList, currentNodes, H, B)
+	mnaBuildDynamicMatrices(elementList, currentNodes, dynamicH, dynamicB, 0, Xop, 0, mnaStateUIC, options)
+	H, B = mnaSumMatricesAndVectors(H, B, dynamicH, dynamicB)
+
+	X, _, _, converged := mnaSolveNewton(elementList, currentNodes, H, B, Xop, 0, nil, 0, options)
+	if !converged {
+		fmt.Fprintf(os.Stderr, "MNA Error: Initial transient solution did not converge\n")
+		os.Exit(1)
+	}
+
+	return X
+}
+
+// mnaStampClamps holds each node at its voltage through a large conductance to ground.
+func mnaStampClamps(H [][]float64, B []float64, voltages map[int]float64) {
+	for node, v := range voltages {
+		mnaStampConductance(H, node, 0, mnaGClamp)
+		B[node-1] += mnaGClamp * v
+	}
+}
+
+func mnaHasNonlinear(elementList *Element) bool {
+	for e := elementList; e != nil; e = e.Next {
+		if e.ElementType == ElementJFET {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mnaSolveSystem solves H x = B by LU factorization.
+func mnaSolveSystem(H [][]float64, B []float64) []float64 {
 	LU, P := mnaLUFactorization(H, B)
+	return mnaLUSolve(LU, P, B)
+}
+
+// mnaLUSolve solves H x = B with the factors of H given by mnaLUFactorization, so a system can be solved for
+// several right-hand sides while being factored once.
+func mnaLUSolve(LU [][]float64, P []int, B []float64) []float64 {
 	Y := mnaProgressiveSubstitution(LU, B, P)
 	Xp := mnaRegressiveSubstitution(LU, Y, P)
 
@@ -110,10 +347,176 @@ func mnaSolveLinear(elementList *Element, nodesMap map[string]int) {
 		X[i] = Xp[P[i]]
 	}
 
-	mnaPrintMatrices(H, B, X, nodesMap, currentNodes)
+	return X
+}
+
+// mnaSolveNewton solves H x = B together with the nonlinear elements by Newton-Raphson, starting from
+// X0 (zero if nil). Xprev and tStep are the last accepted solution and timestep in transient analysis.
+// It returns the solution, the last linearized system and whether the iterations converged.
+func mnaSolveNewton(elementList *Element, currentNodes map[string]int, H [][]float64, B []float64,
+	X0 []float64, t float64, Xprev []float64, tStep float64, options SimOptions) ([]float64, [][]float64, []float64, bool) {
+	X, linearH, linearB, _, converged := mnaNewton(elementList, currentNodes, H, B, X0, t, Xprev, tStep, options, options.Itl1)
+	return X, linearH, linearB, converged
+}
+
+// mnaNewton is mnaSolveNewton with an iteration limit, also returning the number of iterations taken.
+func mnaNewton(elementList *Element, currentNodes map[string]int, H [][]float64, B []float64,
+	X0 []float64, t float64, Xprev []float64, tStep float64, options SimOptions, maxIterations int) ([]float64, [][]float64, []float64, int, bool) {
+	if !mnaHasNonlinear(elementList) {
+		return mnaSolveSystem(H, B), H, B, 1, true
+	}
+
+	X := make([]float64, len(B))
+	if X0 != nil {
+		copy(X, X0)
+	}
+
+	// Junction limiting starts from the initial guess
+	for e := elementList; e != nil; e = e.Next {
+		if e.ElementType == ElementJFET {
+			desc := e.Extra.(*jfetDescriptor)
+			desc.vgsLast = desc.polarity * mnaVoltageAcross(X, e.Nodes[1], e.Nodes[2])
+			desc.vgdLast = desc.polarity * mnaVoltageAcross(X, e.Nodes[1], e.Nodes[0])
+		}
+	}
+
+	var linearH [][]float64
+	var linearB []float64
+
+	for iteration := 0; iteration < maxIterations; iteration++ {
+		linearH, linearB = mnaCopyMatrixAndVector(H, B)
+		mnaBuildNonlinearMatrices(elementList, currentNodes, linearH, linearB, X, t, Xprev, tStep, options)
+		newX := mnaSolveSystem(linearH, linearB)
+
+		// Node voltages come first, branch currents after them
+		converged := true
+		for i := range newX {
+			if math.IsNaN(newX[i]) || math.IsInf(newX[i], 0) {
+				return newX, linearH, linearB, iteration + 1, false
+			}
+			absTol := options.VNTol
+			if i >= len(newX)-len(currentNodes) {
+				absTol = options.AbsTol
+			}
+			if math.Abs(newX[i]-X[i]) > options.RelTol*math.Max(math.Abs(newX[i]), math.Abs(X[i]))+absTol {
+				converged = false
+			}
+		}
+
+		X = newX
+		if converged && iteration > 0 {
+			return X, linearH, linearB, iteration + 1, true
+		}
+	}
+
+	return X, linearH, linearB, maxIterations, false
+}
+
+// mnaBuildNonlinearMatrices stamps the companion models of the nonlinear elements linearized around X.
+func mnaBuildNonlinearMatrices(elementList *Element, currentNodes map[string]int, H [][]float64, B []float64,
+	X []float64, t float64, Xprev []float64, tStep float64, options SimOptions) {
+	for e := elementList; e != nil; e = e.Next {
+		if e.ElementType == ElementJFET {
+			mnaStampJFET(e, H, B, X, t, tStep, options.Gmin)
+		}
+	}
+}
+
+func mnaStampJFET(e *Element, H [][]float64, B []float64, X []float64, t float64, tStep float64, gmin float64) {
+	desc := e.Extra.(*jfetDescriptor)
+	d, g, s := e.Nodes[0], e.Nodes[1], e.Nodes[2]
+
+	vgs := jfetLimitJunction(desc, desc.polarity*mnaVoltageAcross(X, g, s), desc.vgsLast)
+	vgd := jfetLimitJunction(desc, desc.polarity*mnaVoltageAcross(X, g, d), desc.vgdLast)
+	desc.vgsLast = vgs
+	desc.vgdLast = vgd
+	vds := vgs - vgd
+
+	id, gm, gds := jfetDrainCurrent(desc, vgs, vds)
+	igs, ggs := jfetJunctionCurrent(desc, vgs, gmin)
+	igd, ggd := jfetJunctionCurrent(desc, vgd, gmin)
+
+	if t != 0 {
+		// Junction capacitances, integrated with backward Euler on the charge
+		qgs, cgs := jfetJunctionCharge(desc, desc.cgs, vgs)
+		qgd, cgd := jfetJunctionCharge(desc, desc.cgd, vgd)
+		igs += (qgs - desc.qgs) / tStep
+		ggs += cgs / tStep
+		igd += (qgd - desc.qgd) / tStep
+		ggd += cgd / tStep
+	}
+
+	mnaStampConductance(H, g, s, ggs)
+	mnaStampCurrent(B, g, s, desc.polarity*(igs-ggs*vgs))
+	mnaStampConductance(H, g, d, ggd)
+	mnaStampCurrent(B, g, d, desc.polarity*(igd-ggd*vgd))
+	mnaStampTransconductance(H, d, s, g, s, gm)
+	mnaStampConductance(H, d, s, gds)
+	mnaStampCurrent(B, d, s, desc.polarity*(id-gm*vgs-gds*vds))
 }
 
-func mnaBuildDynamicMatrices(elementList *Element, currentNodes map[string]int, H [][]float64, B []float64, t float64, X []float64, tStep float64) {
+// mnaStampConductance stamps a conductance g between nodes n1 and n2.
+func mnaStampConductance(H [][]float64, n1 int, n2 int, g float64) {
+	if n1 != 0 {
+		H[n1-1][n1-1] += g
+	}
+	if n1 != 0 && n2 != 0 {
+		H[n1-1][n2-1] -= g
+		H[n2-1][n1-1] -= g
+	}
+	if n2 != 0 {
+		H[n2-1][n2-1] += g
+	}
+}
+
+// mnaStampTransconductance stamps a current g*(v(c1) - v(c2)) flowing from n1 to n2 through the element.
+func mnaStampTransconductance(H [][]float64, n1 int, n2 int, c1 int, c2 int, g float64) {
+	if n1 != 0 && c1 != 0 {
+		H[n1-1][c1-1] += g
+	}
+	if n1 != 0 && c2 != 0 {
+		H[n1-1][c2-1] -= g
+	}
+	if n2 != 0 && c1 != 0 {
+		H[n2-1][c1-1] -= g
+	}
+	if n2 != 0 && c2 != 0 {
+		H[n2-1][c2-1] += g
+	}
+}
+
+// mnaStampCurrentBranch adds the branch current of index i, flowing from n1 to n2, to the node equations.
+func mnaStampCurrentBranch(H [][]float64, n1 int, n2 int, i int) {
+	if n1 != 0 {
+		H[n1-1][i-1] += 1.0
+	}
+	if n2 != 0 {
+		H[n2-1][i-1] -= 1.0
+	}
+}
+
+// mnaStampCurrent stamps a constant current i flowing from n1 to n2 through the element.
+func mnaStampCurrent(B []float64, n1 int, n2 int, i float64) {
+	if n1 != 0 {
+		B[n1-1] -= i
+	}
+	if n2 != 0 {
+		B[n2-1] += i
+	}
+}
+
+// mnaBuildDynamicMatrices stamps the time dependent elements at time t. At t = 0, state tells how capacitors
+// and inductors start; otherwise X is the solution at t - tStep, integrated by options.Method.
+func mnaBuildDynamicMatrices(elementList *Element, currentNodes map[string]int, H [][]float64, B []float64, t float64, X []float64, tStep float64,
+	state mnaInitialState, options SimOptions) {
+	mnaBuildDynamicMatrix(elementList, currentNodes, H, t, tStep, state, options)
+	mnaBuildDynamicVector(elementList, currentNodes, B, t, X, tStep, state, options)
+}
+
+// mnaBuildDynamicMatrix stamps the matrix of the time dependent elements. Away from t = 0 it only depends on the
+// timestep, so the transient of a linear circuit can factor it once.
+func mnaBuildDynamicMatrix(elementList *Element, currentNodes map[string]int, H [][]float64, t float64, tStep float64,
+	state mnaInitialState, options SimOptions) {
 	e := elementList
 
 	for e != nil {
@@ -123,25 +526,31 @@ func mnaBuildDynamicMatrices(elementList *Element, currentNodes map[string]int,
 		case ElementMOSFET:
 			fmt.Fprintf(os.Stderr, "MNA Error: Element not implemented.\n")
 			os.Exit(1)
-		case ElementCCCS, ElementCCVS, ElementResistor, ElementVCCS, ElementVCVS:
+		case ElementCCCS, ElementCCVS, ElementResistor, ElementVCCS, ElementVCVS, ElementProbe:
 			// Treated as static
+		case ElementJFET:
+			// Treated as nonlinear
 		case ElementCapacitor:
 			if e.PreserveCurrent {
-				capacitorVoltage := 0.0
 				if t == 0 {
-					capacitorVoltage = e.Extra.(float64)
-				} else {
-					v1 := 0.0
-					v2 := 0.0
-					if e.Nodes[0] != 0 {
-						v1 = X[e.Nodes[0]-1]
+					_, given := e.Extra.(float64)
+					if state == mnaStateDC || (state == mnaStateTransient && !given) {
+						// Open circuit: no current flows through the capacitor
+						i := currentNodes[e.Label]
+						mnaStampConductance(H, e.Nodes[0], e.Nodes[1], options.Gmin)
+						mnaStampCurrentBranch(H, e.Nodes[0], e.Nodes[1], i)
+						H[i-1][i-1] += 1.0
+						break
 					}
-					if e.Nodes[1] != 0 {
-						v2 = X[e.Nodes[1]-1]
+				} else {
+					// Companion model: v - k*i = capacitorVoltage
+					i := currentNodes[e.Label]
+					switch options.Method {
+					case "be":
+						H[i-1][i-1] -= tStep / e.Value
+					case "trap":
+						H[i-1][i-1] -= tStep / (2.0 * e.Value)
 					}
-					lastVoltage := v1 - v2
-					lastCurrent := X[currentNodes[e.Label]-1]
-					capacitorVoltage = lastVoltage + (tStep/e.Value)*lastCurrent
 				}
 
 				if e.Nodes[0] != 0 && currentNodes[e.Label] != 0 {
@@ -152,27 +561,39 @@ func mnaBuildDynamicMatrices(elementList *Element, currentNodes map[string]int,
 					H[e.Nodes[1]-1][currentNodes[e.Label]-1] -= 1.0
 					H[currentNodes[e.Label]-1][e.Nodes[1]-1] -= 1.0
 				}
-				if currentNodes[e.Label] != 0 {
-					B[currentNodes[e.Label]-1] += capacitorVoltage
-				}
 			}
 		case ElementInductor:
 			if e.PreserveCurrent {
-				inductorCurrent := 0.0
 				if t == 0 {
-					inductorCurrent = e.Extra.(float64)
+					_, given := e.Extra.(float64)
+					if state == mnaStateDC || (state == mnaStateTransient && !given) {
+						// Short circuit: no voltage across the inductor
+						i := currentNodes[e.Label]
+						mnaStampCurrentBranch(H, e.Nodes[0], e.Nodes[1], i)
+						if e.Nodes[0] != 0 {
+							H[i-1][e.Nodes[0]-1] += 1.0
+						}
+						if e.Nodes[1] != 0 {
+							H[i-1][e.Nodes[1]-1] -= 1.0
+						}
+						break
+					}
 				} else {
-					v1 := 0.0
-					v2 := 0.0
+					// Companion model: i - k*v = inductorCurrent
+					i := currentNodes[e.Label]
+					k := 0.0
+					switch options.Method {
+					case "be":
+						k = tStep / e.Value
+					case "trap":
+						k = tStep / (2.0 * e.Value)
+					}
 					if e.Nodes[0] != 0 {
-						v1 = X[e.Nodes[0]-1]
+						H[i-1][e.Nodes[0]-1] -= k
 					}
 					if e.Nodes[1] != 0 {
-						v2 = X[e.Nodes[1]-1]
+						H[i-1][e.Nodes[1]-1] += k
 					}
-					lastVoltage := v1 - v2
-					lastCurrent := X[currentNodes[e.Label]-1]
-					inductorCurrent = lastCurrent + (tStep/e.Value)*lastVoltage
 				}
 
 				if e.Nodes[0] != 0 && currentNodes[e.Label] != 0 {
@@ -183,19 +604,10 @@ func mnaBuildDynamicMatrices(elementList *Element, currentNodes map[string]int,
 				}
 				if currentNodes[e.Label] != 0 {
 					H[currentNodes[e.Label]-1][currentNodes[e.Label]-1] += 1.0
-					B[currentNodes[e.Label]-1] += inductorCurrent
 				}
 			}
 		case ElementCurrentSource:
-			cValue := retrieveSourceValue(*e, t)
-			if !e.PreserveCurrent {
-				if e.Nodes[0] != 0 {
-					B[e.Nodes[0]-1] -= cValue
-				}
-				if e.Nodes[1] != 0 {
-					B[e.Nodes[1]-1] += cValue
-				}
-			} else {
+			if e.PreserveCurrent {
 				if e.Nodes[0] != 0 && currentNodes[e.Label] != 0 {
 					H[e.Nodes[0]-1][currentNodes[e.Label]-1] += 1.0
 				}
@@ -204,12 +616,10 @@ func mnaBuildDynamicMatrices(elementList *Element, currentNodes map[string]int,
 				}
 				if currentNodes[e.Label] != 0 {
 					H[currentNodes[e.Label]-1][currentNodes[e.Label]-1] += 1.0
-					B[currentNodes[e.Label]-1] += cValue
 				}
 			}
 
 		case ElementVoltageSource:
-			vValue := retrieveSourceValue(*e, t)
 			if e.PreserveCurrent {
 				if e.Nodes[0] != 0 && currentNodes[e.Label] != 0 {
 					H[e.Nodes[0]-1][currentNodes[e.Label]-1] += 1.0
@@ -219,16 +629,269 @@ func mnaBuildDynamicMatrices(elementList *Element, currentNodes map[string]int,
 					H[e.Nodes[1]-1][currentNodes[e.Label]-1] -= 1.0
 					H[currentNodes[e.Label]-1][e.Nodes[1]-1] -= 1.0
 				}
-				if currentNodes[e.Label] != 0 {
-					B[currentNodes[e.Label]-1] += vValue
+			}
+		case ElementTLine:
+			// Method of characteristics: each port is an impedance z0 in series with a voltage source
+			// carrying the wave that left the opposite port td seconds ago.
+			// v1(t) - z0*i1(t) = v2(t-td) + z0*i2(t-td)
+			// v2(t) - z0*i2(t) = v1(t-td) + z0*i1(t-td)
+			desc := e.Extra.(*tlineDescriptor)
+			ports := [2][2]int{{e.Nodes[0], e.Nodes[1]}, {e.Nodes[2], e.Nodes[3]}}
+			branches := [2]int{currentNodes[e.Label+"#1"] - 1, currentNodes[e.Label+"#2"] - 1}
+
+			for p := 0; p < 2; p++ {
+				if ports[p][0] != 0 {
+					H[ports[p][0]-1][branches[p]] += 1.0
+					H[branches[p]][ports[p][0]-1] += 1.0
+				}
+				if ports[p][1] != 0 {
+					H[ports[p][1]-1][branches[p]] -= 1.0
+					H[branches[p]][ports[p][1]-1] -= 1.0
 				}
+				H[branches[p]][branches[p]] -= desc.z0
 			}
+
+			if t == 0 {
+				// No history yet: the line is in steady state, so the incident waves are
+				// built from the present values of the opposite port
+				for p := 0; p < 2; p++ {
+					q := 1 - p
+					if ports[q][0] != 0 {
+						H[branches[p]][ports[q][0]-1] -= 1.0
+					}
+					if ports[q][1] != 0 {
+						H[branches[p]][ports[q][1]-1] += 1.0
+					}
+					H[branches[p]][branches[q]] -= desc.z0
+				}
+			}
+		case ElementLossyLine:
+			mnaStampLossyLineMatrix(e, currentNodes, H, t, tStep)
+		case ElementNetwork:
+			// Only known in frequency: the conductance at the lowest frequency of its file
+			Y := touchstoneAdmittance(e.Extra.(*touchstoneDescriptor).data, 0.0)
+			touchstoneStamp(e, Y, func(row int, column int, y complex128) {
+				H[row][column] += real(y)
+			})
 		}
 
 		e = e.Next
 	}
 }
 
+// mnaBuildDynamicVector stamps the right-hand side of the time dependent elements: the sources at time t and the
+// history terms of the companion models, from the solution X at t - tStep.
+func mnaBuildDynamicVector(elementList *Element, currentNodes map[string]int, B []float64, t float64, X []float64,
+	tStep float64, state mnaInitialState, options SimOptions) {
+	for e := elementList; e != nil; e = e.Next {
+		switch e.ElementType {
+		case ElementCapacitor:
+			if e.PreserveCurrent {
+				capacitorVoltage := 0.0
+				if t == 0 {
+					ic, given := e.Extra.(float64)
+					if state == mnaStateDC || (state == mnaStateTransient && !given) {
+						break
+					}
+					if given {
+						capacitorVoltage = ic
+					} else if X != nil {
+						capacitorVoltage = mnaVoltageAcross(X, e.Nodes[0], e.Nodes[1])
+					}
+				} else {
+					lastVoltage := mnaVoltageAcross(X, e.Nodes[0], e.Nodes[1])
+					lastCurrent := X[currentNodes[e.Label]-1]
+					switch options.Method {
+					case "be":
+						capacitorVoltage = lastVoltage
+					case "trap":
+						capacitorVoltage = lastVoltage + (tStep/(2.0*e.Value))*lastCurrent
+					default:
+						capacitorVoltage = lastVoltage + (tStep/e.Value)*lastCurrent
+					}
+				}
+
+				if currentNodes[e.Label] != 0 {
+					B[currentNodes[e.Label]-1] += capacitorVoltage
+				}
+			}
+		case ElementInductor:
+			if e.PreserveCurrent {
+				inductorCurrent := 0.0
+				if t == 0 {
+					ic, given := e.Extra.(float64)
+					if state == mnaStateDC || (state == mnaStateTransient && !given) {
+						break
+					}
+					if given {
+						inductorCurrent = ic
+					} else if X != nil {
+						inductorCurrent = X[currentNodes[e.Label]-1]
+					}
+				} else {
+					lastVoltage := mnaVoltageAcross(X, e.Nodes[0], e.Nodes[1])
+					lastCurrent := X[currentNodes[e.Label]-1]
+					switch options.Method {
+					case "be":
+						inductorCurrent = lastCurrent
+					case "trap":
+						k := tStep / (2.0 * e.Value)
+						inductorCurrent = lastCurrent + k*lastVoltage
+					default:
+						inductorCurrent = lastCurrent + (tStep/e.Value)*lastVoltage
+					}
+				}
+
+				if currentNodes[e.Label] != 0 {
+					B[currentNodes[e.Label]-1] += inductorCurrent
+				}
+			}
+		case ElementCurrentSource:
+			cValue := retrieveSourceValue(*e, t)
+			if !e.PreserveCurrent {
+				if e.Nodes[0] != 0 {
+					B[e.Nodes[0]-1] -= cValue
+				}
+				if e.Nodes[1] != 0 {
+					B[e.Nodes[1]-1] += cValue
+				}
+			} else if currentNodes[e.Label] != 0 {
+				B[currentNodes[e.Label]-1] += cValue
+			}
+		case ElementVoltageSource:
+			if e.PreserveCurrent && currentNodes[e.Label] != 0 {
+				B[currentNodes[e.Label]-1] += retrieveSourceValue(*e, t)
+			}
+		case ElementTLine:
+			if t != 0 {
+				desc := e.Extra.(*tlineDescriptor)
+				past := mnaTLineHistoryAt(desc, t-desc.td)
+				B[currentNodes[e.Label+"#1"]-1] += past.v2 + desc.z0*past.i2
+				B[currentNodes[e.Label+"#2"]-1] += past.v1 + desc.z0*past.i1
+			}
+		case ElementLossyLine:
+			mnaStampLossyLineVector(e, currentNodes, B, t, X, tStep)
+		}
+	}
+}
+
+// mnaStampLossyLineMatrix expands a lossy line in a ladder of lumped RLGC sections. Node k of the ladder has
+// voltage u(k) (u(0) is port 1 and u(N) is port 2) and section k carries i(k) from u(k-1) to u(k). Half of
+// a section shunt is placed across each port and the reactive parts are integrated with backward Euler.
+func mnaStampLossyLineMatrix(e *Element, currentNodes map[string]int, H [][]float64, t float64, tStep float64) {
+	desc := e.Extra.(*ltraDescriptor)
+	n := desc.segments
+	z, y, zl, yc := mnaLossyLineSection(desc, t, tStep)
+
+	for k := 1; k <= n; k++ {
+		// u(k-1) - u(k) - (z + L/h) i(k) = -(L/h) i(k)'
+		row := currentNodes[mnaLossyLineCurrent(e, k)] - 1
+		for _, c := range mnaLossyLineTerminals(e, currentNodes, k-1) {
+			if c[0] >= 0 {
+				H[row][c[0]] += float64(c[1])
+			}
+		}
+		for _, c := range mnaLossyLineTerminals(e, currentNodes, k) {
+			if c[0] >= 0 {
+				H[row][c[0]] -= float64(c[1])
+			}
+		}
+		H[row][row] -= z + zl
+
+		// i(k) leaves u(k-1) and enters u(k)
+		for _, c := range mnaLossyLineTerminals(e, currentNodes, k-1) {
+			if c[0] >= 0 {
+				H[c[0]][row] += float64(c[1])
+			}
+		}
+		for _, c := range mnaLossyLineTerminals(e, currentNodes, k) {
+			if c[0] >= 0 {
+				H[c[0]][row] -= float64(c[1])
+			}
+		}
+	}
+
+	for k := 0; k <= n; k++ {
+		// Shunt (y + C/h) u(k) fed by the history current (C/h) u(k)', halved at the ports
+		scale := 1.0
+		if k == 0 || k == n {
+			scale = 0.5
+		}
+		voltage := mnaLossyLineTerminals(e, currentNodes, k)
+		for _, r := range voltage {
+			if r[0] < 0 {
+				continue
+			}
+			for _, c := range voltage {
+				if c[0] >= 0 {
+					H[r[0]][c[0]] += scale * (y + yc) * float64(r[1]*c[1])
+				}
+			}
+		}
+	}
+}
+
+// mnaStampLossyLineVector stamps the history terms of the sections of a lossy line, from the solution X at
+// t - tStep.
+func mnaStampLossyLineVector(e *Element, currentNodes map[string]int, B []float64, t float64, X []float64, tStep float64) {
+	desc := e.Extra.(*ltraDescriptor)
+	n := desc.segments
+	_, _, zl, yc := mnaLossyLineSection(desc, t, tStep)
+
+	if t != 0 {
+		for k := 1; k <= n; k++ {
+			row := currentNodes[mnaLossyLineCurrent(e, k)] - 1
+			B[row] -= zl * X[row]
+		}
+	}
+
+	for k := 0; k <= n; k++ {
+		scale := 1.0
+		if k == 0 || k == n {
+			scale = 0.5
+		}
+		voltage := mnaLossyLineTerminals(e, currentNodes, k)
+		lastVoltage := 0.0
+		if t != 0 {
+			for _, c := range voltage {
+				if c[0] >= 0 {
+					lastVoltage += float64(c[1]) * X[c[0]]
+				}
+			}
+		}
+		for _, r := range voltage {
+			if r[0] >= 0 {
+				B[r[0]] += scale * yc * lastVoltage * float64(r[1])
+			}
+		}
+	}
+}
+
+// mnaLossyLineSection returns the series impedance and shunt admittance of one section of a lossy line, with the
+// impedance of its inductance and the admittance of its capacitance over a timestep, zero at t = 0.
+func mnaLossyLineSection(desc *ltraDescriptor, t float64, tStep float64) (float64, float64, float64, float64) {
+	dx := desc.length / float64(desc.segments)
+	zl, yc := 0.0, 0.0
+	if t != 0 {
+		zl = desc.l * dx / tStep
+		yc = desc.c * dx / tStep
+	}
+	return desc.r * dx, desc.g * dx, zl, yc
+}
+
+// mnaLossyLineTerminals returns the voltage u(k) of a lossy line as a list of (unknown, sign) pairs, the unknown -1
+// for ground.
+func mnaLossyLineTerminals(e *Element, currentNodes map[string]int, k int) [][2]int {
+	n := e.Extra.(*ltraDescriptor).segments
+	if k == 0 {
+		return [][2]int{{e.Nodes[0] - 1, 1}, {e.Nodes[1] - 1, -1}}
+	}
+	if k == n {
+		return [][2]int{{e.Nodes[2] - 1, 1}, {e.Nodes[3] - 1, -1}}
+	}
+	return [][2]int{{currentNodes[mnaLossyLineVoltage(e, k)] - 1, 1}}
+}
+
 func mnaBuildStaticMatrices(elementList *Element, currentNodes map[string]int, H [][]float64, B []float64) {
 	e := elementList
 
@@ -237,8 +900,11 @@ func mnaBuildStaticMatrices(elementList *Element, currentNodes map[string]int, H
 		case ElementBJT, ElementDiode, ElementMOSFET:
 			fmt.Fprintf(os.Stderr, "MNA Error: Element not implemented.\n")
 			os.Exit(1)
-		case ElementCapacitor, ElementInductor, ElementCurrentSource, ElementVoltageSource:
+		case ElementCapacitor, ElementInductor, ElementCurrentSource, ElementVoltageSource, ElementTLine,
+			ElementLossyLine, ElementNetwork:
 			// Treated as dynamic
+		case ElementJFET:
+			// Treated as nonlinear
 		case ElementCCCS:
 			if !e.PreserveCurrent {
 				controlElement := elementListFindByLabel(elementList, e.Extra.(string))
@@ -351,6 +1017,16 @@ func mnaBuildStaticMatrices(elementList *Element, currentNodes map[string]int, H
 					H[currentNodes[e.Label]-1][e.Nodes[3]-1] += e.Value
 				}
 			}
+		case ElementProbe:
+			// v1 - v2 = 0, carrying the loop current
+			if e.Nodes[0] != 0 {
+				H[e.Nodes[0]-1][currentNodes[e.Label]-1] += 1.0
+				H[currentNodes[e.Label]-1][e.Nodes[0]-1] += 1.0
+			}
+			if e.Nodes[1] != 0 {
+				H[e.Nodes[1]-1][currentNodes[e.Label]-1] -= 1.0
+				H[currentNodes[e.Label]-1][e.Nodes[1]-1] -= 1.0
+			}
 		}
 
 		e = e.Next
@@ -437,92 +1113,151 @@ func mnaLUFactorization(H [][]float64, B []float64) ([][]float64, []int) {
 	return LU, P
 }
 
-func mnaPrintMatrices(H [][]float64, B []float64, X []float64, nodesMap map[string]int, currentNodes map[string]int) {
+func mnaPrintMatrices(H [][]float64, B []float64, X []float64, nodesMap map[string]int, currentNodes map[string]int, digits int) {
 	fmt.Printf("Matrix H (Row-Major):\n\n")
 	for i, l := range H {
 		for j, v := range l {
-			fmt.Printf("\tH(%d,%d) = %.3f\n", i, j, v)
+			fmt.Printf("\tH(%d,%d) = %.*f\n", i, j, digits, v)
 		}
 	}
 
 	fmt.Printf("\nVector s:\n\n")
 	for i, v := range B {
-		fmt.Printf("\ts(%d) = %.3f\n", i, v)
+		fmt.Printf("\ts(%d) = %.*f\n", i, digits, v)
 	}
 
 	fmt.Printf("\nResults:\n\n")
 	fmt.Printf("\tVoltages:\n")
 	for k, v := range nodesMap {
 		if v != 0 {
-			fmt.Printf("\tV(%s) = %.3f V\n", k, X[v-1])
+			fmt.Printf("\tV(%s) = %.*f V\n", k, digits, X[v-1])
 		}
 	}
 	fmt.Printf("\n\tCurrents:\n")
 	for k, v := range currentNodes {
-		if v != 0 {
-			fmt.Printf("\tI(%s) = %.3f A\n", k, X[v-1])
+		if v != 0 && !mnaIsInternal(k) {
+			fmt.Printf("\tI(%s) = %.*f A\n", k, digits, X[v-1])
 		}
 	}
 }
 
-func mnaSolveDynamic(elementList *Element, nodesMap map[string]int, tStep float64, tStop float64) {
+// mnaAccept receives an accepted timepoint of a transient, the indices of the branch currents telling where they
+// are in X.
+type mnaAccept func(t float64, X []float64, currentNodes map[string]int)
+
+// mnaSolveDynamic runs the transient analysis, handing every timepoint to accept as soon as it is computed so the
+// run need not be held in memory. It returns the last timepoint, the solution at it and the indices of the branch
+// currents.
+func mnaSolveDynamic(elementList *Element, nodesMap map[string]int, tStep float64, tStop float64,
+	conditions mnaConditions, options SimOptions, accept mnaAccept) (float64, []float64, map[string]int) {
 	mnaIdentifyGroups(elementList)
 	currentNodes := assignIndicesToCurrentNodes(elementList, nodesMap)
 
 	// Create H Matrix
 	staticH := make([][]float64, len(nodesMap)+len(currentNodes)-1)
-	dynamicH := make([][]float64, len(nodesMap)+len(currentNodes)-1)
 	for i, _ := range staticH {
 		staticH[i] = make([]float64, len(nodesMap)+len(currentNodes)-1)
-		dynamicH[i] = make([]float64, len(nodesMap)+len(currentNodes)-1)
 	}
 
 	// Create B Array
 	staticB := make([]float64, len(nodesMap)+len(currentNodes)-1)
-	dynamicB := make([]float64, len(nodesMap)+len(currentNodes)-1)
 
 	mnaBuildStaticMatrices(elementList, currentNodes, staticH, staticB)
-	mnaBuildDynamicMatrices(elementList, currentNodes, dynamicH, dynamicB, 0, nil, 0)
-	H, B := mnaSumMatricesAndVectors(staticH, staticB, dynamicH, dynamicB)
-
-	LU, P := mnaLUFactorization(H, B)
-	Y := mnaProgressiveSubstitution(LU, B, P)
-	Xp := mnaRegressiveSubstitution(LU, Y, P)
 
-	X := make([][]float64, 1)
-	X[0] = make([]float64, len(Xp))
+	X, state := mnaTransientStart(elementList, currentNodes, len(nodesMap)+len(currentNodes)-1, conditions, options)
+	lastT := 0.0
+	accept(lastT, X, currentNodes)
 
-	for i := range X[0] {
-		X[0][i] = Xp[P[i]]
+	// Some elements (transmission lines) can not be stepped over with a timestep larger than their delay
+	if maxStep := mnaMaximumTimeStep(elementList); maxStep > 0 && tStep > maxStep {
+		tStep = tStep / math.Ceil(tStep/maxStep)
 	}
 
-	for t := tStep; t <= tStop; t += tStep {
-		// generate dynamic H and B again to clean old values
-		dynamicH := make([][]float64, len(nodesMap)+len(currentNodes)-1)
-		for i, _ := range dynamicH {
-			dynamicH[i] = make([]float64, len(nodesMap)+len(currentNodes)-1)
+	// Timepoints are counted rather than summed so that rounding does not lose tStop. A tStop that is not a
+	// multiple of the timestep ends with a shorter step onto it.
+	steps := int(math.Ceil(tStop/tStep - 1e-9))
+	var system mnaTransientSystem
+	for i := 1; i <= steps; i++ {
+		t, h := float64(i)*tStep, tStep
+		if i == steps {
+			if math.Abs(t-tStop) > 1e-9*tStop {
+				h = tStop - float64(i-1)*tStep
+			}
+			t = tStop
 		}
-		dynamicB := make([]float64, len(nodesMap)+len(currentNodes)-1)
 
-		mnaBuildDynamicMatrices(elementList, currentNodes, dynamicH, dynamicB, t, X[len(X)-1], tStep)
-		H, B = mnaSumMatricesAndVectors(staticH, staticB, dynamicH, dynamicB)
-		LU, P = mnaLUFactorization(H, B)
-		Y = mnaProgressiveSubstitution(LU, B, P)
-		Xp = mnaRegressiveSubstitution(LU, Y, P)
-		newX := make([]float64, len(Xp))
-		for i := range newX {
-			newX[i] = Xp[P[i]]
+		newX, _, converged := mnaTransientStep(elementList, currentNodes, staticH, staticB, t, X, h, state,
+			options, &system)
+		if !converged {
+			fmt.Fprintf(os.Stderr, "MNA Error: Transient analysis did not converge at t = %g\n", t)
+			os.Exit(1)
 		}
-		X = append(X, newX)
+
+		X, lastT = newX, t
+		accept(t, X, currentNodes)
+		mnaUpdateHistory(elementList, currentNodes, t, newX)
+	}
+
+	return lastT, X, currentNodes
+}
+
+// mnaTransientStart returns the solution the transient starts from, the operating point or the initial conditions
+// with uic, and how capacitors and inductors were stamped for it. The history of the elements starts there.
+func mnaTransientStart(elementList *Element, currentNodes map[string]int, size int, conditions mnaConditions,
+	options SimOptions) ([]float64, mnaInitialState) {
+	state := mnaStateTransient
+	if conditions.uic {
+		state = mnaStateUIC
+	}
+	X, _, _ := mnaOperatingPoint(elementList, currentNodes, size, conditions, options, state)
+	if !conditions.uic {
+		X = mnaReleaseOperatingPoint(elementList, currentNodes, X, options)
 	}
 
-	if generateGraphs {
-		err := genAllGraphs(currentNodes, nodesMap, X)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error generating graphs: %s", err)
-			os.Exit(-1)
+	mnaUpdateHistory(elementList, currentNodes, 0, X)
+	return X, state
+}
+
+// mnaTransientSystem keeps the matrix of the transient between timesteps. Away from t = 0 it only changes with
+// the timestep, so a linear circuit is factored once and each step only rebuilds the right-hand side.
+type mnaTransientSystem struct {
+	tStep float64     // timestep H was built for
+	H     [][]float64 // static and dynamic elements, nil until the first step
+	LU    [][]float64 // factors of H, nil for nonlinear circuits
+	P     []int
+}
+
+// mnaTransientStep solves the circuit at time t from the solution lastX at t - tStep. It returns the solution, the
+// last linearized system and whether the iterations converged. The matrix is reused from system while the
+// timestep does not change.
+func mnaTransientStep(elementList *Element, currentNodes map[string]int, staticH [][]float64, staticB []float64,
+	t float64, lastX []float64, tStep float64, state mnaInitialState, options SimOptions,
+	system *mnaTransientSystem) ([]float64, [][]float64, bool) {
+	if system.H == nil || system.tStep != tStep {
+		dynamicH := make([][]float64, len(staticB))
+		for i := range dynamicH {
+			dynamicH[i] = make([]float64, len(staticB))
 		}
+		mnaBuildDynamicMatrix(elementList, currentNodes, dynamicH, t, tStep, state, options)
+		system.H, _ = mnaSumMatricesAndVectors(staticH, staticB, dynamicH, make([]float64, len(staticB)))
+		system.tStep = tStep
+		system.LU, system.P = nil, nil
+		if !mnaHasNonlinear(elementList) {
+			system.LU, system.P = mnaLUFactorization(system.H, nil)
+		}
+	}
+
+	B := make([]float64, len(staticB))
+	mnaBuildDynamicVector(elementList, currentNodes, B, t, lastX, tStep, state, options)
+	for i := range B {
+		B[i] = staticB[i] + B[i]
+	}
+
+	if system.LU != nil {
+		return mnaLUSolve(system.LU, system.P, B), system.H, true
 	}
+	newX, linearH, _, _, converged := mnaNewton(elementList, currentNodes, system.H, B, lastX, t, lastX, tStep, options, options.Itl4)
+	return newX, linearH, converged
 }
 
 func mnaSumMatricesAndVectors(H1 [][]float64, B1 []float64, H2 [][]float64, B2 []float64) ([][]float64, []float64) {
@@ -544,3 +1279,16 @@ func mnaSumMatricesAndVectors(H1 [][]float64, B1 []float64, H2 [][]float64, B2 [
 
 	return H, B
 }
+
+func mnaCopyMatrixAndVector(H [][]float64, B []float64) ([][]float64, []float64) {
+	newH := make([][]float64, len(H))
+	for i := range H {
+		newH[i] = make([]float64, len(H[i]))
+		copy(newH[i], H[i])
+	}
+
+	newB := make([]float64, len(B))
+	copy(newB, B)
+
+	return newH, newB
+}
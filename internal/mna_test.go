@@ -0,0 +1,34 @@
+package internal
+
+import "testing"
+
+// mnaTestRC returns a source driving a capacitor through a resistor, the capacitor at node 2
+func mnaTestRC() (*Element, map[string]int) {
+	elementList := &Element{ElementType: ElementVoltageSource, Label: "v1", Nodes: []int{1, 0}, Value: 1.0}
+	elementListAppend(elementList, &Element{ElementType: ElementResistor, Label: "r1", Nodes: []int{1, 2}, Value: 1e3})
+	elementListAppend(elementList, &Element{ElementType: ElementCapacitor, Label: "c1", Nodes: []int{2, 0}, Value: 1e-6})
+	return elementList, map[string]int{"0": 0, "a": 1, "b": 2}
+}
+
+func TestSolveDynamicEndsAtStop(t *testing.T) {
+	for _, c := range []struct {
+		tStep  float64
+		tStop  float64
+		points int
+	}{
+		{1e-4, 1e-3, 11},
+		{0.1, 0.7, 8},
+		{3e-4, 1e-3, 5}, // the last step is shorter
+	} {
+		elementList, nodesMap := mnaTestRC()
+		T := make([]float64, 0)
+		last, _, _ := mnaSolveDynamic(elementList, nodesMap, c.tStep, c.tStop, mnaConditions{quiet: true},
+			optionsDefault(), func(t float64, X []float64, currentNodes map[string]int) {
+				T = append(T, t)
+			})
+		if len(T) != c.points || last != c.tStop || T[len(T)-1] != c.tStop {
+			t.Errorf("tstep %g tstop %g: %d timepoints ending at %g, want %d ending at %g", c.tStep, c.tStop,
+				len(T), last, c.points, c.tStop)
+		}
+	}
+}
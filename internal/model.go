@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+)
+
+type Model struct {
+	Name       string
+	ModelType  string
+	Params     map[string]float64
+	Tolerances map[string]tolerance // Monte Carlo variation of parameters, given by dev= and lot= after them
+}
+
+// modelDefaults are the parameters each type of model takes, with their values when a model does not give them
+var modelDefaults = map[string]map[string]float64{
+	"ltra": {"r": 0.0, "l": 0.0, "g": 0.0, "c": 0.0, "len": 0.0, "nseg": 20},
+	"njf":  modelJFETDefaults,
+	"pjf":  modelJFETDefaults,
+}
+
+var modelJFETDefaults = map[string]float64{"vto": -2.0, "beta": 1e-4, "lambda": 0.0, "is": 1e-14, "cgs": 0.0,
+	"cgd": 0.0, "pb": 1.0, "fc": 0.5, "eg": 1.11, "xti": 3.0, "kf": 0.0, "af": 1.0}
+
+// modelParam returns a parameter of the model, or its default value if the model does not give it.
+func modelParam(model *Model, key string) float64 {
+	value, exists := model.Params[key]
+	if !exists {
+		return modelDefaults[model.ModelType][key]
+	}
+	return value
+}
+
+// modelName returns the name of the model an element refers to, if it has one that is resolved by modelResolve.
+func modelName(e *Element) (string, bool) {
+	switch e.ElementType {
+	case ElementLossyLine:
+		return e.Extra.(*ltraDescriptor).model, true
+	case ElementJFET:
+		return e.Extra.(*jfetDescriptor).model, true
+	}
+	return "", false
+}
+
+// modelResolve binds every element that refers to a model to the parameters of that model.
+func modelResolve(elementList *Element, models map[string]*Model) bool {
+	for e := elementList; e != nil; e = e.Next {
+		name, hasModel := modelName(e)
+		if !hasModel {
+			continue
+		}
+		model, exists := models[name]
+		if !exists {
+			fmt.Fprintf(os.Stderr, "Model Error: Element %s refers to unknown model %s\n", e.Label, name)
+			return true
+		}
+		if modelResolveElement(e, model) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// modelResolveElement copies the parameters of the model into the descriptor of the element.
+func modelResolveElement(e *Element, model *Model) bool {
+	if e.ElementType == ElementLossyLine {
+		desc := e.Extra.(*ltraDescriptor)
+		if model.ModelType != "ltra" {
+			fmt.Fprintf(os.Stderr, "Model Error: Element %s needs a ltra model, %s is %s\n", e.Label, model.Name, model.ModelType)
+			return true
+		}
+
+		desc.r = modelParam(model, "r")
+		desc.l = modelParam(model, "l")
+		desc.g = modelParam(model, "g")
+		desc.c = modelParam(model, "c")
+		desc.length = modelParam(model, "len")
+		desc.segments = int(modelParam(model, "nseg"))
+
+		if desc.length <= 0.0 || desc.r < 0.0 || desc.l < 0.0 || desc.g < 0.0 || desc.c < 0.0 {
+			fmt.Fprintf(os.Stderr, "Model Error: Model %s needs a positive len and non-negative r, l, g, c\n", model.Name)
+			return true
+		}
+		if desc.segments < 2 {
+			desc.segments = 2
+		}
+	}
+
+	if e.ElementType == ElementJFET {
+		desc := e.Extra.(*jfetDescriptor)
+		switch model.ModelType {
+		case "njf":
+			desc.polarity = 1.0
+		case "pjf":
+			desc.polarity = -1.0
+		default:
+			fmt.Fprintf(os.Stderr, "Model Error: Element %s needs a njf or pjf model, %s is %s\n", e.Label, model.Name, model.ModelType)
+			return true
+		}
+
+		desc.vto = modelParam(model, "vto")
+		desc.beta = modelParam(model, "beta")
+		desc.lambda = modelParam(model, "lambda")
+		desc.is = modelParam(model, "is")
+		desc.cgs = modelParam(model, "cgs")
+		desc.cgd = modelParam(model, "cgd")
+		desc.pb = modelParam(model, "pb")
+		desc.fc = modelParam(model, "fc")
+		desc.eg = modelParam(model, "eg")
+		desc.xti = modelParam(model, "xti")
+		desc.kf = modelParam(model, "kf")
+		desc.af = modelParam(model, "af")
+
+		if desc.beta < 0.0 || desc.is <= 0.0 || desc.pb <= 0.0 || desc.fc < 0.0 || desc.fc >= 1.0 || desc.eg < 0.0 ||
+			desc.kf < 0.0 || desc.af <= 0.0 {
+			fmt.Fprintf(os.Stderr, "Model Error: Model %s has invalid parameters\n", model.Name)
+			return true
+		}
+	}
+
+	return false
+}
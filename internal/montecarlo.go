@@ -0,0 +1,300 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	monteCarloBins     = 10 // histogram bins
+	monteCarloBarWidth = 40 // characters of the longest histogram bar
+)
+
+// tolerance is the relative Monte Carlo variation of a value
+type tolerance struct {
+	dev float64 // independent for every device
+	lot float64 // shared by every element of a run, or by every device of a model
+}
+
+// monteCarlo is the .mc analysis: the analyses run once per run, with element values and model parameters
+// varied within their tolerances
+type monteCarlo struct {
+	runs  int
+	seed  int64
+	gauss bool // gaussian deviations with the tolerance at 3 sigma, uniform within the tolerance otherwise
+}
+
+// monteCarloRun holds the random draws of one run. A run always draws the same values, whatever the other
+// .step values are.
+type monteCarloRun struct {
+	mc   monteCarlo
+	rng  *rand.Rand
+	lots map[string]float64 // lot deviation of each model parameter ("<model>.<param>"), "" for elements
+}
+
+// monteCarloSample is one quantity of one run, grouped with the runs that share the other .step values
+type monteCarloSample struct {
+	group    string
+	quantity string
+	value    float64
+}
+
+func monteCarloNewRun(mc monteCarlo, run int) *monteCarloRun {
+	return &monteCarloRun{
+		mc:   mc,
+		rng:  rand.New(rand.NewSource(mc.seed + int64(run))),
+		lots: make(map[string]float64),
+	}
+}
+
+// monteCarloDeviation draws a deviation in [-1, 1], or a gaussian one with sigma 1/3.
+func monteCarloDeviation(r *monteCarloRun) float64 {
+	if r.mc.gauss {
+		return r.rng.NormFloat64() / 3.0
+	}
+	return 2.0*r.rng.Float64() - 1.0
+}
+
+func monteCarloLot(r *monteCarloRun, key string) float64 {
+	deviation, drawn := r.lots[key]
+	if !drawn {
+		deviation = monteCarloDeviation(r)
+		r.lots[key] = deviation
+	}
+	return deviation
+}
+
+// monteCarloVary applies a tolerance to a value, the lot deviation being the one of key.
+func monteCarloVary(r *monteCarloRun, value float64, t tolerance, key string) float64 {
+	factor := 1.0
+	if t.dev != 0.0 {
+		factor = factor + t.dev*monteCarloDeviation(r)
+	}
+	if t.lot != 0.0 {
+		factor = factor + t.lot*monteCarloLot(r, key)
+	}
+	return value * factor
+}
+
+// monteCarloFunctions are the random functions of expressions. Without a run they return the nominal value:
+// gauss(nom, relvar, sigma), agauss(nom, absvar, sigma), unif(nom, relvar) and aunif(nom, absvar).
+func monteCarloFunctions(r *monteCarloRun) map[string]exprFunction {
+	gaussian := func(relative bool) exprFunction {
+		return func(args []float64) (string, float64) {
+			if len(args) != 3 {
+				return "needs 3 arguments", 0.0
+			}
+			if args[2] <= 0.0 {
+				return "needs a positive sigma", 0.0
+			}
+			if r == nil {
+				return "", args[0]
+			}
+			variation := args[1]
+			if relative {
+				variation = variation * args[0]
+			}
+			return "", args[0] + variation/args[2]*r.rng.NormFloat64()
+		}
+	}
+	uniform := func(relative bool) exprFunction {
+		return func(args []float64) (string, float64) {
+			if len(args) != 2 {
+				return "needs 2 arguments", 0.0
+			}
+			if r == nil {
+				return "", args[0]
+			}
+			variation := args[1]
+			if relative {
+				variation = variation * args[0]
+			}
+			return "", args[0] + variation*(2.0*r.rng.Float64()-1.0)
+		}
+	}
+
+	return map[string]exprFunction{
+		"gauss":  gaussian(true),
+		"agauss": gaussian(false),
+		"unif":   uniform(true),
+		"aunif":  uniform(false),
+	}
+}
+
+// monteCarloNominals saves the value of every element with a tolerance, so each run varies the nominal value.
+func monteCarloNominals(elementList *Element) map[*Element]float64 {
+	nominals := make(map[*Element]float64)
+	for e := elementList; e != nil; e = e.Next {
+		if e.Tolerance != (tolerance{}) {
+			nominals[e] = e.Value
+		}
+	}
+	return nominals
+}
+
+// monteCarloApply varies the elements with a tolerance and resolves every model with varied parameters again.
+func monteCarloApply(elementList *Element, models map[string]*Model, r *monteCarloRun) bool {
+	for e := elementList; e != nil; e = e.Next {
+		if e.Tolerance != (tolerance{}) {
+			elementSetValue(e, monteCarloVary(r, e.Value, e.Tolerance, ""))
+		}
+
+		name, hasModel := modelName(e)
+		if !hasModel || len(models[name].Tolerances) == 0 {
+			continue
+		}
+		model := models[name]
+		varied := &Model{Name: model.Name, ModelType: model.ModelType, Params: make(map[string]float64)}
+		for key, value := range model.Params {
+			if t, given := model.Tolerances[key]; given {
+				value = monteCarloVary(r, value, t, model.Name+"."+key)
+			}
+			varied.Params[key] = value
+		}
+		if modelResolveElement(e, varied) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// monteCarloReport prints the statistics and histogram of every quantity, for each group of runs.
+func monteCarloReport(mc monteCarlo, samples []monteCarloSample, digits int) {
+	groups := make([]string, 0)
+	quantities := make(map[string][]string)
+	values := make(map[string]map[string][]float64)
+	for _, s := range samples {
+		if _, exists := values[s.group]; !exists {
+			groups = append(groups, s.group)
+			values[s.group] = make(map[string][]float64)
+		}
+		if _, exists := values[s.group][s.quantity]; !exists {
+			quantities[s.group] = append(quantities[s.group], s.quantity)
+		}
+		values[s.group][s.quantity] = append(values[s.group][s.quantity], s.value)
+	}
+
+	distribution := "uniform"
+	if mc.gauss {
+		distribution = "gaussian"
+	}
+	fmt.Printf("Monte Carlo Analysis: %d runs, seed %d, %s distribution\n", mc.runs, mc.seed, distribution)
+
+	for _, group := range groups {
+		if group != "" {
+			fmt.Printf("\n%s\n", group)
+		}
+		for _, quantity := range quantities[group] {
+			v := values[group][quantity]
+			mean, sigma, min, max, failed := monteCarloStatistics(v)
+			if failed == len(v) {
+				fmt.Printf("\n\t%s: every run failed\n", quantity)
+				continue
+			}
+			fmt.Printf("\n\t%s: mean %.*g, sigma %.*g, min %.*g, max %.*g", quantity, digits+1, mean, digits+1, sigma,
+				digits+1, min, digits+1, max)
+			if failed > 0 {
+				fmt.Printf(", %d failed run(s) left out", failed)
+			}
+			fmt.Printf("\n")
+
+			edges, counts := monteCarloHistogram(v, min, max)
+			largest := 0
+			for _, count := range counts {
+				if count > largest {
+					largest = count
+				}
+			}
+			for i, count := range counts {
+				bar := strings.Repeat("#", count*monteCarloBarWidth/largest)
+				fmt.Printf("\t%12.*g | %-*s %d\n", digits+1, edges[i], monteCarloBarWidth, bar, count)
+			}
+
+			if generateGraphs {
+				name := "histogram_" + graphFileName(quantity)
+				if group != "" {
+					name = name + "_" + graphFileName(group)
+				}
+				if err := graphRenderHistogram(name, quantity, edges, counts, digits); err != nil {
+					fmt.Fprintf(os.Stderr, "Error generating graphs: %s", err)
+					os.Exit(-1)
+				}
+			}
+		}
+	}
+}
+
+// monteCarloStatistics returns the mean, standard deviation, minimum and maximum of the values, and how many runs
+// failed. Those gave a non-finite value and are left out of the statistics; with all of them failed, nothing else
+// is meaningful.
+func monteCarloStatistics(values []float64) (float64, float64, float64, float64, int) {
+	sorted := make([]float64, 0, len(values))
+	for _, v := range values {
+		if !monteCarloFailed(v) {
+			sorted = append(sorted, v)
+		}
+	}
+	failed := len(values) - len(sorted)
+	if len(sorted) == 0 {
+		return 0.0, 0.0, 0.0, 0.0, failed
+	}
+	sort.Float64s(sorted)
+
+	mean := 0.0
+	for _, v := range sorted {
+		mean = mean + v
+	}
+	mean = mean / float64(len(sorted))
+
+	variance := 0.0
+	for _, v := range sorted {
+		variance = variance + (v-mean)*(v-mean)
+	}
+	if len(sorted) > 1 {
+		variance = variance / float64(len(sorted)-1)
+	}
+
+	return mean, math.Sqrt(variance), sorted[0], sorted[len(sorted)-1], failed
+}
+
+// monteCarloFailed tells whether a value comes from a run that diverged.
+func monteCarloFailed(v float64) bool {
+	return math.IsNaN(v) || math.IsInf(v, 0)
+}
+
+// monteCarloHistogram counts the values in equal bins from min to max, returning the lower edge of each bin.
+// Values of failed runs are not counted.
+func monteCarloHistogram(values []float64, min float64, max float64) ([]float64, []int) {
+	if max == min {
+		count := 0
+		for _, v := range values {
+			if !monteCarloFailed(v) {
+				count = count + 1
+			}
+		}
+		return []float64{min}, []int{count}
+	}
+
+	width := (max - min) / monteCarloBins
+	edges := make([]float64, monteCarloBins)
+	counts := make([]int, monteCarloBins)
+	for i := range edges {
+		edges[i] = min + float64(i)*width
+	}
+	for _, v := range values {
+		if monteCarloFailed(v) {
+			continue
+		}
+		bin := int((v - min) / width)
+		if bin >= monteCarloBins {
+			bin = monteCarloBins - 1
+		}
+		counts[bin] = counts[bin] + 1
+	}
+	return edges, counts
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// network is a .net line: the N-port whose ports are the given voltage sources, referred to one impedance
+type network struct {
+	ports  []string // voltage sources, port 1 first
+	z0     float64  // reference impedance
+	file   string   // Touchstone file written at every run, .sNp added if missing; none if empty
+	sweep  acSweep
+	tokens []Token // ports, for diagnostics
+}
+
+// netRun computes the parameters of every .net at each frequency of its sweep. With the independent sources
+// zeroed, each port is driven by a unit voltage while the others are shorted: the currents the ports drive into
+// the circuit are a column of the admittance matrix Y, so one factorization per frequency gives all of them.
+// S, Z and, for two-ports, H follow from Y.
+func netRun(nets []network, elementList *Element, nodesMap map[string]int, conditions mnaConditions,
+	options SimOptions, label string) {
+	conditions.quiet = true
+	staticH, Xop, currentNodes := acLinearize(elementList, nodesMap, conditions, options)
+
+	for _, n := range nets {
+		size := len(n.ports)
+		branches := make([]int, size)
+		for i, port := range n.ports {
+			branches[i] = currentNodes[port] - 1
+		}
+
+		frequencies := acFrequencies(n.sweep)
+		Y := make([][][]complex128, len(frequencies))
+		S := make([][][]complex128, len(frequencies))
+		Z := make([][][]complex128, len(frequencies))
+		Hp := make([][][]complex128, len(frequencies))
+		for k, f := range frequencies {
+			H, _ := acSystem(elementList, currentNodes, staticH, 2.0*math.Pi*f, Xop, options)
+			LU, P := acLUFactorization(H)
+
+			Y[k] = make([][]complex128, size)
+			for i := range Y[k] {
+				Y[k][i] = make([]complex128, size)
+			}
+			for j := range n.ports {
+				B := make([]complex128, len(H))
+				B[branches[j]] = 1.0
+				X := acLUSolve(LU, P, B)
+				for i := range n.ports {
+					// The branch current of a source flows into it at its positive node
+					Y[k][i][j] = -X[branches[i]]
+				}
+			}
+
+			// Normalized to z0, S = C(z0 Y) and z0^-1 Z = C(-S) with the Cayley transform C
+			S[k] = touchstoneCayley(touchstoneScale(Y[k], complex(n.z0, 0.0)))
+			if S[k] != nil {
+				Z[k] = touchstoneScale(touchstoneCayley(touchstoneScale(S[k], -1.0)), complex(n.z0, 0.0))
+			}
+			if size == 2 && Y[k][0][0] != 0.0 {
+				y := Y[k]
+				Hp[k] = [][]complex128{{1.0 / y[0][0], -y[0][1] / y[0][0]},
+					{y[1][0] / y[0][0], (y[0][0]*y[1][1] - y[0][1]*y[1][0]) / y[0][0]}}
+			}
+		}
+
+		fmt.Printf("Network Analysis: ports %s, z0=%g ohm\n\n", strings.Join(n.ports, ", "), n.z0)
+		netPrint("S", "dB", size, frequencies, S, options.NumDgt)
+		netPrint("Y", "S", size, frequencies, Y, options.NumDgt)
+		netPrint("Z", "ohm", size, frequencies, Z, options.NumDgt)
+		if size == 2 {
+			netPrint("H", "", size, frequencies, Hp, options.NumDgt)
+		}
+
+		if n.file != "" {
+			// The extension is added unless the name already has it, and the label of a step goes before it
+			path, extension := n.file, fmt.Sprintf(".s%dp", size)
+			if strings.HasSuffix(strings.ToLower(path), extension) {
+				path, extension = path[:len(path)-len(extension)], path[len(path)-len(extension):]
+			}
+			comment := "S-parameters of ports " + strings.Join(n.ports, " ")
+			if label != "" {
+				path = path + "_" + graphFileName(label)
+				comment = comment + ", " + label
+			}
+			path = path + extension
+			if touchstoneWrite(path, comment, frequencies, S, n.z0) {
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+// netPrint prints a set of network parameters as magnitude and phase, one row per frequency. The magnitude of
+// S-parameters is in dB. Parameters that do not exist at a frequency are shown as '-'.
+func netPrint(name string, unit string, size int, frequencies []float64, P [][][]complex128, digits int) {
+	if unit != "" {
+		fmt.Printf("\t%s-parameters (magnitude in %s, phase in degrees):\n\n", name, unit)
+	} else {
+		fmt.Printf("\t%s-parameters (magnitude, phase in degrees):\n\n", name)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(writer, "\tfrequency\t")
+	for i := 1; i <= size; i++ {
+		for j := 1; j <= size; j++ {
+			fmt.Fprintf(writer, "|%s%d%d|\t%s%d%d (deg)\t", name, i, j, name, i, j)
+		}
+	}
+	fmt.Fprintf(writer, "\n")
+	for k, f := range frequencies {
+		fmt.Fprintf(writer, "\t%.*g\t", digits+1, f)
+		for i := 0; i < size; i++ {
+			for j := 0; j < size; j++ {
+				if P[k] == nil {
+					fmt.Fprintf(writer, "-\t-\t")
+					continue
+				}
+				p := P[k][i][j]
+				if imag(p) == 0.0 {
+					// A negative zero would turn the phase of a negative value into -180 degrees
+					p = complex(real(p), 0.0)
+				}
+				magnitude := cmplx.Abs(p)
+				if name == "S" {
+					magnitude = 20.0 * math.Log10(magnitude)
+				}
+				fmt.Fprintf(writer, "%.*g\t%.*g\t", digits+1, magnitude, digits+1, cmplx.Phase(p)*180.0/math.Pi)
+			}
+		}
+		fmt.Fprintf(writer, "\n")
+	}
+	writer.Flush()
+	fmt.Printf("\n")
+}
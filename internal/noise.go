@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// noiseAnalysis is a .noise line: the noise at an output voltage, referred to the input source as well
+type noiseAnalysis struct {
+	output outputVariable
+	source string // V or I source the input noise is referred to
+	sweep  acSweep
+	token  Token // input source, for diagnostics
+}
+
+// noiseSource is a noise current between two nodes of an element. Its spectral density is white plus
+// flicker/f (A^2/Hz).
+type noiseSource struct {
+	element *Element
+	name    string // kind of noise: thermal, channel, flicker or shot of a junction
+	n1      int
+	n2      int
+	white   float64
+	flicker float64
+}
+
+// noisePlots collects the output and input noise densities of every run
+type noisePlots struct {
+	unit   string // of the input noise
+	output []graphValues
+	input  []graphValues
+}
+
+// noiseRun computes the noise of a run: each source is propagated to the output through the adjoint system, whose
+// solution z gives at once the transfer of a current injected at any node and the gain of the input source.
+// Returns the integrated output and input noise.
+func noiseRun(n noiseAnalysis, elementList *Element, nodesMap map[string]int, conditions mnaConditions,
+	options SimOptions, label string, plots *noisePlots) []outputScalar {
+	scalars := make([]outputScalar, 0)
+	staticH, Xop, currentNodes := acLinearize(elementList, nodesMap, conditions, options)
+	sources := noiseSources(elementList, Xop, options)
+	source := elementListFindByLabel(elementList, n.source)
+
+	frequencies := acFrequencies(n.sweep)
+	outputs := make([]float64, len(frequencies))     // output noise density (V^2/Hz)
+	inputs := make([]float64, len(frequencies))      // input noise density
+	contributions := make([][]float64, len(sources)) // output noise density of each source
+	for k := range contributions {
+		contributions[k] = make([]float64, len(frequencies))
+	}
+
+	for i, f := range frequencies {
+		H, _ := acSystem(elementList, currentNodes, staticH, 2.0*math.Pi*f, Xop, options)
+		E := make([]complex128, len(H))
+		if node := nodesMap[n.output.node]; node != 0 {
+			E[node-1] += 1.0
+		}
+		if ref := nodesMap[n.output.ref]; ref != 0 {
+			E[ref-1] -= 1.0
+		}
+		LU, P := acLUFactorization(noiseTranspose(H))
+		z := acLUSolve(LU, P, E)
+		transfer := func(n1 int, n2 int) complex128 {
+			t := complex(0.0, 0.0)
+			if n1 != 0 {
+				t = t + z[n1-1]
+			}
+			if n2 != 0 {
+				t = t - z[n2-1]
+			}
+			return t
+		}
+
+		for k, s := range sources {
+			t := cmplx.Abs(transfer(s.n1, s.n2))
+			contributions[k][i] = t * t * (s.white + s.flicker/f)
+			outputs[i] = outputs[i] + contributions[k][i]
+		}
+
+		// A source with a branch current is excited through it, a current source injects into its second node
+		gain := transfer(source.Nodes[1], source.Nodes[0])
+		if index, exists := currentNodes[source.Label]; exists {
+			gain = z[index-1]
+		}
+		inputs[i] = math.Inf(1)
+		if g := cmplx.Abs(gain); g != 0.0 {
+			inputs[i] = outputs[i] / (g * g)
+		}
+	}
+
+	unit := "V"
+	if source.ElementType == ElementCurrentSource {
+		unit = "A"
+	}
+	plots.unit = unit
+	fmt.Printf("Noise Analysis: %s, input %s\n\n", outputName(n.output), source.Label)
+	noisePrintDensities(frequencies, outputs, inputs, unit, options.NumDgt)
+
+	if len(frequencies) > 1 {
+		output := math.Sqrt(noiseIntegrate(frequencies, outputs))
+		input := math.Sqrt(noiseIntegrate(frequencies, inputs))
+		integrated := make([]float64, len(sources))
+		for k := range sources {
+			integrated[k] = noiseIntegrate(frequencies, contributions[k])
+		}
+		noisePrintContributions(frequencies, sources, integrated, output, input, unit, options.NumDgt)
+		scalars = append(scalars, outputScalar{"output noise of " + outputName(n.output), output},
+			outputScalar{"input noise of " + source.Label, input})
+	}
+
+	plots.output = append(plots.output, noiseCurve(label, frequencies, outputs, n.sweep))
+	plots.input = append(plots.input, noiseCurve(label, frequencies, inputs, n.sweep))
+	return scalars
+}
+
+// noiseSources lists the noise of every element around the operating point Xop: the thermal noise of resistors,
+// and the channel, flicker and gate junction shot noise of JFETs. Reactive elements, lines, Touchstone networks and
+// controlled sources are noiseless.
+func noiseSources(elementList *Element, Xop []float64, options SimOptions) []noiseSource {
+	sources := make([]noiseSource, 0)
+	for e := elementList; e != nil; e = e.Next {
+		switch e.ElementType {
+		case ElementResistor:
+			temp := options.Temp
+			if desc, given := e.Extra.(*resistorDescriptor); given {
+				temp = temperatureOf(desc.instanceTemperature, options)
+			}
+			kT := temperatureBoltzmann * (temp + temperatureZero)
+			sources = append(sources, noiseSource{element: e, name: "thermal", n1: e.Nodes[0], n2: e.Nodes[1],
+				white: 4.0 * kT / math.Abs(e.Value)})
+		case ElementJFET:
+			desc := e.Extra.(*jfetDescriptor)
+			d, g, s := e.Nodes[0], e.Nodes[1], e.Nodes[2]
+			vgs := desc.polarity * mnaVoltageAcross(Xop, g, s)
+			vgd := desc.polarity * mnaVoltageAcross(Xop, g, d)
+			id, gm, _ := jfetDrainCurrent(desc, vgs, vgs-vgd)
+			igs, _ := jfetJunctionCurrent(desc, vgs, 0.0)
+			igd, _ := jfetJunctionCurrent(desc, vgd, 0.0)
+			kT := temperatureBoltzmann * (temperatureOf(desc.instanceTemperature, options) + temperatureZero)
+
+			sources = append(sources,
+				noiseSource{element: e, name: "channel", n1: d, n2: s, white: 8.0 / 3.0 * kT * math.Abs(gm)},
+				noiseSource{element: e, name: "flicker", n1: d, n2: s, flicker: desc.kf * math.Pow(math.Abs(id), desc.af)},
+				noiseSource{element: e, name: "shot gs", n1: g, n2: s, white: 2.0 * temperatureCharge * math.Abs(igs)},
+				noiseSource{element: e, name: "shot gd", n1: g, n2: d, white: 2.0 * temperatureCharge * math.Abs(igd)})
+		}
+	}
+	return sources
+}
+
+// noiseTranspose returns the transpose of H, the matrix of the adjoint system.
+func noiseTranspose(H [][]complex128) [][]complex128 {
+	T := make([][]complex128, len(H))
+	for i := range T {
+		T[i] = make([]complex128, len(H))
+		for j := range T[i] {
+			T[i][j] = H[j][i]
+		}
+	}
+	return T
+}
+
+// noiseIntegrate integrates a spectral density over the swept frequencies with the trapezoidal rule.
+func noiseIntegrate(frequencies []float64, density []float64) float64 {
+	sum := 0.0
+	for i := 1; i < len(frequencies); i++ {
+		sum = sum + 0.5*(density[i]+density[i-1])*(frequencies[i]-frequencies[i-1])
+	}
+	return sum
+}
+
+// noisePrintDensities prints the output and input noise at every frequency, as root spectral densities.
+func noisePrintDensities(frequencies []float64, outputs []float64, inputs []float64, unit string, digits int) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(writer, "\tfrequency\tonoise (V/sqrt(Hz))\tinoise (%s/sqrt(Hz))\t\n", unit)
+	for i, f := range frequencies {
+		input := "-"
+		if !math.IsInf(inputs[i], 1) {
+			input = fmt.Sprintf("%.*g", digits+1, math.Sqrt(inputs[i]))
+		}
+		fmt.Fprintf(writer, "\t%.*g\t%.*g\t%s\t\n", digits+1, f, digits+1, math.Sqrt(outputs[i]), input)
+	}
+	writer.Flush()
+	fmt.Printf("\n")
+}
+
+// noisePrintContributions prints the noise integrated over the band and the share of every source in it, largest
+// first. The input noise is infinite when the input does not reach the output at some frequency.
+func noisePrintContributions(frequencies []float64, sources []noiseSource, integrated []float64, output float64,
+	input float64, unit string, digits int) {
+	order := make([]int, len(sources))
+	for k := range order {
+		order[k] = k
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return integrated[order[i]] > integrated[order[j]]
+	})
+
+	fmt.Printf("Integrated Noise from %g to %g Hz:\n\n", frequencies[0], frequencies[len(frequencies)-1])
+	fmt.Printf("\toutput: %.*g V rms\n", digits+1, output)
+	fmt.Printf("\tinput:  %.*g %s rms\n\n", digits+1, input, unit)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(writer, "\telement\tsource\toutput noise (V rms)\tshare\t\n")
+	for _, k := range order {
+		if integrated[k] == 0.0 {
+			continue
+		}
+		fmt.Fprintf(writer, "\t%s\t%s\t%.*g\t%.1f%%\t\n", sources[k].element.Label, sources[k].name, digits+1,
+			math.Sqrt(integrated[k]), 100.0*integrated[k]/(output*output))
+	}
+	writer.Flush()
+	fmt.Printf("\n")
+}
+
+// noiseCurve returns a noise density of a run in dB of its root spectral density, against the decade of the
+// frequency for logarithmic sweeps. Frequencies with infinite input noise are left out.
+func noiseCurve(label string, frequencies []float64, density []float64, sweep acSweep) graphValues {
+	curve := graphValues{name: label, t: make([]float64, 0, len(frequencies)), v: make([]float64, 0, len(frequencies))}
+	for i, f := range frequencies {
+		if math.IsInf(density[i], 1) {
+			continue
+		}
+		if sweep.sweepType != "lin" {
+			f = math.Log10(f)
+		}
+		curve.t = append(curve.t, f)
+		curve.v = append(curve.v, 10.0*math.Log10(density[i]))
+	}
+	return curve
+}
+
+// noisePlot draws the output and input noise, one curve per run.
+func noisePlot(plots noisePlots, sweep acSweep) error {
+	xName := "f"
+	if sweep.sweepType != "lin" {
+		xName = "log10(f)"
+	}
+	if err := graphRender("noise_output", xName, "dB(V/sqrt(Hz))", plots.output); err != nil {
+		return err
+	}
+	return graphRender("noise_input", xName, "dB("+plots.unit+"/sqrt(Hz))", plots.input)
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"strings"
+)
+
+// SimOptions are the simulator settings given by .options
+type SimOptions struct {
+	RelTol     float64 // relative convergence tolerance
+	AbsTol     float64 // absolute current convergence tolerance (A)
+	VNTol      float64 // absolute voltage convergence tolerance (V)
+	ChgTol     float64 // absolute charge tolerance (C), accepted for compatibility
+	Gmin       float64 // conductance across junctions and open capacitors
+	Itl1       int     // DC Newton-Raphson iteration limit
+	Itl4       int     // transient Newton-Raphson iteration limit per timepoint
+	Method     string  // integration method: euler (forward), be (backward Euler) or trap (trapezoidal)
+	Temp       float64 // circuit temperature (C)
+	Tnom       float64 // temperature the model parameters were measured at (C)
+	NumDgt     int     // digits printed after the decimal point
+	GminSteps  int     // gmin stepping steps, 0 disables it
+	SrcSteps   int     // source stepping steps, 0 disables it
+	PtranSteps int     // pseudo-transient steps, 0 disables it
+	NoOpIter   bool    // go straight to the convergence aids, skipping plain Newton-Raphson
+}
+
+func optionsDefault() SimOptions {
+	return SimOptions{
+		RelTol:     1e-3,
+		AbsTol:     1e-12,
+		VNTol:      1e-6,
+		ChgTol:     1e-14,
+		Gmin:       1e-12,
+		Itl1:       100,
+		Itl4:       100,
+		Method:     "euler",
+		Temp:       27.0,
+		Tnom:       27.0,
+		NumDgt:     3,
+		GminSteps:  10,
+		SrcSteps:   10,
+		PtranSteps: 200,
+		NoOpIter:   false,
+	}
+}
+
+// optionsIsFlag tells whether an option may be given without a value.
+func optionsIsFlag(key string) bool {
+	return key == "noopiter"
+}
+
+// optionsSet assigns the text value to the option named key. It returns true if the option does not exist
+// or the value is invalid for it.
+func optionsSet(options *SimOptions, key string, value string) bool {
+	if key == "method" {
+		switch value {
+		case "euler", "be", "trap":
+			options.Method = value
+		case "gear":
+			// First order Gear is backward Euler
+			options.Method = "be"
+		default:
+			return true
+		}
+		return false
+	}
+
+	err, number := parserParseNumber(value)
+	if err {
+		return true
+	}
+
+	switch key {
+	case "reltol":
+		options.RelTol = number
+	case "abstol":
+		options.AbsTol = number
+	case "vntol":
+		options.VNTol = number
+	case "chgtol":
+		options.ChgTol = number
+	case "gmin":
+		options.Gmin = number
+		return number <= 0
+	case "itl1":
+		options.Itl1 = int(number)
+	case "itl4":
+		options.Itl4 = int(number)
+	case "temp":
+		options.Temp = number
+		return number <= -273.15
+	case "tnom":
+		options.Tnom = number
+		return number <= -273.15
+	case "numdgt":
+		options.NumDgt = int(number)
+	case "gminsteps":
+		options.GminSteps = int(number)
+	case "srcsteps":
+		options.SrcSteps = int(number)
+	case "ptransteps":
+		options.PtranSteps = int(number)
+	case "noopiter":
+		options.NoOpIter = number != 0
+	default:
+		return true
+	}
+
+	if key == "itl1" || key == "itl4" {
+		return number < 1
+	}
+	return number < 0
+}
+
+// optionsOverride applies "<key>=<value> ..." settings, as given on the command line, over the options of the
+// netlist. It returns the first invalid setting, or an empty string.
+func optionsOverride(options *SimOptions, overrides string) string {
+	for _, setting := range strings.FieldsFunc(strings.ToLower(overrides), func(r rune) bool {
+		return r == ' ' || r == ','
+	}) {
+		key := setting
+		value := "1"
+		if separator := strings.IndexByte(setting, '='); separator >= 0 {
+			key = setting[:separator]
+			value = setting[separator+1:]
+		} else if !optionsIsFlag(key) {
+			return setting
+		}
+
+		if optionsSet(options, key, value) {
+			return setting
+		}
+	}
+
+	return ""
+}
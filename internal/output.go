@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"os"
+	"strings"
+)
+
+// outputVariable is a quantity of a solution: "v(<node>)", "v(<node>,<node>)" or "i(<element>)". Small-signal
+// quantities may take a part after the v or i, as in "vdb(<node>)".
+type outputVariable struct {
+	current bool
+	node    string // positive node, or the element of a current
+	ref     string // negative node, ground if empty
+	part    string // "m", "db", "p" (degrees), "r" or "i" of a phasor, empty for the magnitude
+	token   Token  // for diagnostics
+}
+
+// outputParts are the parts of a phasor an output variable may take
+var outputParts = map[string]bool{"": true, "m": true, "db": true, "p": true, "r": true, "i": true}
+
+// outputScalar is a single named result of an analysis run, such as a gain, a margin or a measurement
+type outputScalar struct {
+	name  string
+	value float64
+}
+
+func outputName(o outputVariable) string {
+	name := "V"
+	if o.current {
+		name = "I"
+	}
+	name = name + strings.ToUpper(o.part) + "(" + o.node
+	if o.ref != "" {
+		name = name + "," + o.ref
+	}
+	return name + ")"
+}
+
+// outputPart returns the part of a phasor the variable asks for.
+func outputPart(o outputVariable, phasor complex128) float64 {
+	switch o.part {
+	case "db":
+		return 20.0 * math.Log10(cmplx.Abs(phasor))
+	case "p":
+		return cmplx.Phase(phasor) * 180.0 / math.Pi
+	case "r":
+		return real(phasor)
+	case "i":
+		return imag(phasor)
+	}
+	return cmplx.Abs(phasor)
+}
+
+// outputCheck returns an error message if the variable refers to something that is not in the circuit.
+func outputCheck(o outputVariable, elementList *Element, nodesMap map[string]int) string {
+	if o.current {
+		e := elementListFindByLabel(elementList, o.node)
+		if e == nil {
+			return fmt.Sprintf("element '%s' is not part of the circuit", o.node)
+		}
+		return ""
+	}
+	for _, node := range []string{o.node, o.ref} {
+		if _, exists := nodesMap[node]; node != "" && !exists {
+			return fmt.Sprintf("node '%s' is not part of the circuit", node)
+		}
+	}
+	return ""
+}
+
+// outputValue evaluates the variable on a real solution. The current of a resistor is computed from its
+// voltage, other elements must carry a branch current.
+func outputValue(o outputVariable, elementList *Element, X []float64, nodesMap map[string]int, currentNodes map[string]int) float64 {
+	if !o.current {
+		return mnaVoltageAcross(X, nodesMap[o.node], nodesMap[o.ref])
+	}
+
+	if index, exists := currentNodes[o.node]; exists {
+		return X[index-1]
+	}
+	e := elementListFindByLabel(elementList, o.node)
+	if e.ElementType == ElementResistor {
+		return mnaVoltageAcross(X, e.Nodes[0], e.Nodes[1]) / e.Value
+	}
+
+	fmt.Fprintf(os.Stderr, "Output Error: Element %s does not carry a branch current\n", e.Label)
+	os.Exit(1)
+	return 0.0
+}
+
+// outputSolution returns every node voltage and branch current of a real solution, suffix appended to their names.
+func outputSolution(X []float64, nodesMap map[string]int, currentNodes map[string]int, suffix string) []outputScalar {
+	scalars := make([]outputScalar, 0)
+	for _, k := range acSortedKeys(nodesMap) {
+		if v := nodesMap[k]; v != 0 {
+			scalars = append(scalars, outputScalar{"V(" + k + ")" + suffix, X[v-1]})
+		}
+	}
+	for _, k := range acSortedKeys(currentNodes) {
+		if v := currentNodes[k]; v != 0 && !mnaIsInternal(k) {
+			scalars = append(scalars, outputScalar{"I(" + k + ")" + suffix, X[v-1]})
+		}
+	}
+	return scalars
+}
+
+// outputPhasor evaluates the variable on a complex (small-signal) solution.
+func outputPhasor(o outputVariable, elementList *Element, X []complex128, nodesMap map[string]int, currentNodes map[string]int) complex128 {
+	voltage := func(n int) complex128 {
+		if n == 0 {
+			return 0
+		}
+		return X[n-1]
+	}
+
+	if !o.current {
+		return voltage(nodesMap[o.node]) - voltage(nodesMap[o.ref])
+	}
+
+	if index, exists := currentNodes[o.node]; exists {
+		return X[index-1]
+	}
+	e := elementListFindByLabel(elementList, o.node)
+	if e.ElementType == ElementResistor {
+		return (voltage(e.Nodes[0]) - voltage(e.Nodes[1])) / complex(e.Value, 0.0)
+	}
+
+	fmt.Fprintf(os.Stderr, "Output Error: Element %s does not carry a branch current\n", e.Label)
+	os.Exit(1)
+	return 0.0
+}
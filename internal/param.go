@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+)
+
+// paramDefinition is a "<name>=<value>" of .param. The value may be an expression of the parameters defined
+// before it.
+type paramDefinition struct {
+	name       string
+	expression string
+	token      Token // value token, for diagnostics
+}
+
+// paramEvaluate evaluates the definitions in order. Parameters in overrides (stepped ones) keep the given
+// value instead of their definition. It returns an error message, empty on success.
+func paramEvaluate(definitions []paramDefinition, overrides map[string]float64,
+	functions map[string]exprFunction) (string, map[string]float64) {
+	values := make(map[string]float64)
+	for name, value := range overrides {
+		values[name] = value
+	}
+
+	for _, d := range definitions {
+		if _, stepped := overrides[d.name]; stepped {
+			continue
+		}
+		err, value := exprEvaluate(d.expression, exprScope{params: values, functions: functions})
+		if err != "" {
+			return fmt.Sprintf("parameter '%s': %s", d.name, err), values
+		}
+		values[d.name] = value
+	}
+
+	return "", values
+}
+
+// paramApply sets the value of every element given by an expression.
+func paramApply(elementList *Element, values map[string]float64, functions map[string]exprFunction) bool {
+	for e := elementList; e != nil; e = e.Next {
+		if e.Expression == "" {
+			continue
+		}
+		err, value := exprEvaluate(e.Expression, exprScope{params: values, functions: functions})
+		if err != "" {
+			fmt.Fprintf(os.Stderr, "Parameter Error: Element %s: %s\n", e.Label, err)
+			return true
+		}
+		elementSetValue(e, value)
+	}
+
+	return false
+}
@@ -3,99 +3,2061 @@ package internal
 import (
 	"fmt"
 	"math"
-	"os"
+	"math/cmplx"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 var (
-	generateGraphs bool
+	generateGraphs   bool
+	measurementsFile string // CSV file the .meas results are written to, none if empty
 )
 
-func ParserInit(netListPath string, genGraphs bool) {
+type Parser struct {
+	lexer         Lexer
+	token         Token // last token read
+	diagnostics   []Diagnostic
+	nodesMap      map[string]int
+	nodesQuantity int
+	nodeRefs      map[string][]Token // every reference of each node
+	expressions   []parserExpression // element values given as expressions
+	lib           library
+	section       *librarySection  // .lib section being defined, nil outside of one
+	libraryFiles  map[string]bool  // files loaded by .lib
+	labels        map[string]Token // first definition of each element label
+	controls      []Token          // control element references of CCCS and CCVS
+	modelUses     []Token          // model references of elements
+}
+
+// parserExpression is an element value given as "{...}", checked once every .param is known
+type parserExpression struct {
+	token   Token
+	element *Element
+}
+
+// parserNodeVoltage is a "v(<node>)=<value>" of .ic or .nodeset, resolved once every node is known
+type parserNodeVoltage struct {
+	node  Token
+	value float64
+}
+
+// ParserInit parses the netlist and runs its analyses. optionOverrides are "<key>=<value>" settings that take
+// precedence over the .options of the netlist. Returns true when the netlist has errors and nothing was simulated.
+func ParserInit(netListPath string, genGraphs bool, optionOverrides string, measFile string) bool {
 	var token Token
-	lexer := LexerInit(netListPath)
-	nodesMap := make(map[string]int)
-	nodesQuantity := 1
-	nodesMap["0"] = 0
+
+	parser := Parser{
+		lexer:         LexerInit(netListPath),
+		nodesMap:      make(map[string]int),
+		nodesQuantity: 1,
+		nodeRefs:      make(map[string][]Token),
+		labels:        make(map[string]Token),
+		lib:           library{sections: make(map[string]*librarySection)},
+		libraryFiles:  make(map[string]bool),
+	}
+	parser.nodesMap["0"] = 0
 	var elementList *Element = nil
-	opCommand := false
-	tranCommand := false
-	tStep := 0.0
-	tStop := 0.0
+	models := make(map[string]*Model)
+	modelTokens := make(map[string]Token)
+	var analyses stepAnalyses
+	uic := false
+	options := optionsDefault()
+	params := make([]paramDefinition, 0)
+	sweeps := make([]stepSweep, 0)
+	ics := make([]parserNodeVoltage, 0)
+	nodesets := make([]parserNodeVoltage, 0)
+	temperatures := make([]float64, 0)
 	generateGraphs = genGraphs
+	measurementsFile = measFile
+
+	for !parser.lexer.eof {
+		token = parserNextToken(&parser)
+		if parser.section != nil && token.TokenType != TokenLineBreak {
+			if parserParseSectionLine(&parser, token) {
+				parserRecover(&parser)
+			}
+			continue
+		}
+		switch token.TokenType {
+		case TokenLineBreak:
+			{
+
+			}
+		case TokenCommand:
+			{
+				err := false
+				if token.TokenValue == ".op" {
+					analyses.op = true
+					err = parserCheckLineEnd(&parser, parserNextToken(&parser), token.TokenValue)
+				} else if token.TokenValue == ".tran" {
+					analyses.tran = true
+					err, analyses.tStep, analyses.tStop, analyses.tStart, uic = parserParseTran(&parser)
+				} else if token.TokenValue == ".ac" {
+					analyses.ac = true
+					err, analyses.sweep = parserParseACSweep(&parser, token)
+				} else if token.TokenValue == ".noise" {
+					var n noiseAnalysis
+					err, n = parserParseNoise(&parser)
+					if !err {
+						if analyses.noise != nil {
+							parserWarning(&parser, token, "'.noise' replaces the one at line %d", analyses.noise.token.Line)
+						}
+						analyses.noise = &n
+					}
+				} else if token.TokenValue == ".param" || token.TokenValue == ".params" {
+					err, params = parserParseParams(&parser, params)
+				} else if token.TokenValue == ".tf" {
+					var tf transferFunction
+					err, tf = parserParseTransferFunction(&parser)
+					if !err {
+						analyses.tfs = append(analyses.tfs, tf)
+					}
+				} else if token.TokenValue == ".sens" {
+					var sens sensitivity
+					err, sens = parserParseSensitivity(&parser)
+					if !err {
+						analyses.sens = append(analyses.sens, sens)
+					}
+				} else if token.TokenValue == ".pz" {
+					var pz poleZero
+					err, pz = parserParsePoleZero(&parser)
+					if !err {
+						analyses.pzs = append(analyses.pzs, pz)
+					}
+				} else if token.TokenValue == ".stb" {
+					var s stability
+					err, s = parserParseStability(&parser)
+					if !err {
+						analyses.stbs = append(analyses.stbs, s)
+					}
+				} else if token.TokenValue == ".net" {
+					var n network
+					err, n = parserParseNetworkAnalysis(&parser)
+					if !err {
+						analyses.nets = append(analyses.nets, n)
+					}
+				} else if token.TokenValue == ".pss" {
+					var p periodicSteadyState
+					err, p = parserParsePeriodicSteadyState(&parser)
+					if !err {
+						analyses.psss = append(analyses.psss, p)
+					}
+				} else if token.TokenValue == ".hb" {
+					var h harmonicBalance
+					err, h = parserParseHarmonicBalance(&parser)
+					if !err {
+						analyses.hbs = append(analyses.hbs, h)
+					}
+				} else if token.TokenValue == ".wc" {
+					err, analyses.wc = parserParseRealOutputs(&parser, analyses.wc)
+				} else if token.TokenValue == ".save" {
+					err, analyses.saves = parserParseRealOutputs(&parser, analyses.saves)
+				} else if token.TokenValue == ".meas" || token.TokenValue == ".measure" {
+					var m measure
+					err, m = parserParseMeasure(&parser)
+					if !err {
+						analyses.measures = append(analyses.measures, m)
+					}
+				} else if token.TokenValue == ".four" {
+					var f fourier
+					err, f = parserParseFourier(&parser)
+					if !err {
+						analyses.fouriers = append(analyses.fouriers, f)
+					}
+				} else if token.TokenValue == ".lib" {
+					err = parserParseLibrary(&parser)
+				} else if token.TokenValue == ".endl" {
+					parserError(&parser, token, "'.endl' outside of a .lib section")
+					err = true
+				} else if token.TokenValue == ".mc" {
+					analyses.mc = new(monteCarlo)
+					err, *analyses.mc = parserParseMonteCarlo(&parser)
+				} else if token.TokenValue == ".step" {
+					var s stepSweep
+					err, s = parserParseStep(&parser)
+					if !err {
+						sweeps = append(sweeps, s)
+					}
+				} else if token.TokenValue == ".ic" {
+					err, ics = parserParseNodeVoltages(&parser, ics)
+				} else if token.TokenValue == ".nodeset" {
+					err, nodesets = parserParseNodeVoltages(&parser, nodesets)
+				} else if token.TokenValue == ".temp" {
+					err, temperatures = parserParseTemp(&parser, temperatures)
+				} else if token.TokenValue == ".options" || token.TokenValue == ".option" {
+					err = parserParseOptions(&parser, &options)
+				} else if token.TokenValue == ".model" {
+					var model *Model
+					err, model = parserParseModel(&parser)
+					if !err {
+						if first, exists := modelTokens[model.Name]; exists {
+							parserWarning(&parser, token, "model '%s' redefines the one at line %d", model.Name, first.Line)
+						}
+						models[model.Name] = model
+						modelTokens[model.Name] = token
+					}
+				} else {
+					parserError(&parser, token, "unknown command '%s'", token.TokenValue)
+					err = true
+				}
+
+				// Resume at the next line, so every problem of the netlist gets reported
+				if err {
+					parserRecover(&parser)
+				}
+			}
+		case TokenStr:
+			{
+				// Parse "Element" Line
+				err, e := parserParseElement(&parser, token)
+				if err {
+					parserRecover(&parser)
+				} else {
+					if elementList != nil {
+						elementListAppend(elementList, e)
+					} else {
+						elementList = e
+					}
+				}
+			}
+		}
+	}
+
+	parserCheckSection(&parser)
+	parserCheckNodes(&parser)
+	parserCheckReferences(&parser, models)
+	if invalid := optionsOverride(&options, optionOverrides); invalid != "" {
+		parserError(&parser, Token{File: netListPath}, "invalid option '%s' given on the command line", invalid)
+	}
+	analyses.conditions = mnaConditions{
+		ic:      parserResolveNodeVoltages(&parser, ics),
+		nodeset: parserResolveNodeVoltages(&parser, nodesets),
+		uic:     uic,
+	}
+
+	// The temperatures of .temp are an outermost temperature sweep
+	if len(temperatures) > 0 {
+		conflict := false
+		for _, s := range sweeps {
+			if s.kind == stepKindTemp {
+				parserError(&parser, s.token, "'.step temp' can not be used together with '.temp'")
+				conflict = true
+			}
+		}
+		if !conflict {
+			sweeps = append([]stepSweep{{kind: stepKindTemp, name: "temp", values: temperatures}}, sweeps...)
+		}
+	}
+	// The runs of .mc are the outermost sweep
+	if analyses.mc != nil {
+		runs := make([]float64, analyses.mc.runs)
+		for i := range runs {
+			runs[i] = float64(i + 1)
+		}
+		sweeps = append([]stepSweep{{kind: stepKindRun, name: "run", values: runs}}, sweeps...)
+	}
+	parserCheckSteps(&parser, elementList, params, sweeps)
+	parserCheckWorstCase(&parser, elementList, analyses)
+	parserCheckSaves(&parser, elementList, analyses)
+	parserCheckMeasures(&parser, elementList, params, analyses)
+	parserCheckFourier(&parser, elementList, analyses)
+	parserCheckNoise(&parser, elementList, analyses)
+	parserCheckTransferFunctions(&parser, elementList, analyses)
+	parserCheckSensitivities(&parser, elementList, analyses)
+	parserCheckPoleZeros(&parser, elementList, analyses)
+	parserCheckStabilities(&parser, elementList, analyses)
+	parserCheckNetworks(&parser, elementList, analyses)
+	parserCheckPeriodicSteadyStates(&parser, elementList, analyses)
+	parserCheckHarmonicBalances(&parser, elementList, analyses)
+
+	// Report every problem of the netlist before trying to simulate it
+	diagnosticSort(parser.diagnostics)
+	if diagnosticReport(parser.diagnostics) > 0 {
+		return true
+	}
+
+	if parser.lexer.Title != "" {
+		fmt.Printf("Circuit: %s\n\n", parser.lexer.Title)
+	}
+
+	analyses.title = parser.lexer.Title
+	stepRun(elementList, models, parser.lib, parser.nodesMap, params, sweeps, analyses, options)
+	return false
+}
+
+func parserNextToken(parser *Parser) Token {
+	parser.token = LexerNextToken(&parser.lexer)
+	return parser.token
+}
+
+// parserRecover skips the rest of the current line.
+func parserRecover(parser *Parser) {
+	for parser.token.TokenType != TokenLineBreak {
+		parserNextToken(parser)
+	}
+}
+
+func parserError(parser *Parser, token Token, format string, args ...interface{}) {
+	parser.diagnostics = append(parser.diagnostics, Diagnostic{
+		Severity: DiagnosticError,
+		File:     token.File,
+		Line:     token.Line,
+		Column:   token.Column,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func parserWarning(parser *Parser, token Token, format string, args ...interface{}) {
+	parser.diagnostics = append(parser.diagnostics, Diagnostic{
+		Severity: DiagnosticWarning,
+		File:     token.File,
+		Line:     token.Line,
+		Column:   token.Column,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// parserCheckLineEnd reports the given token unless it ends the line of the element or command.
+func parserCheckLineEnd(parser *Parser, token Token, owner string) bool {
+	if token.TokenType != TokenLineBreak {
+		parserError(parser, token, "unexpected token '%s' after '%s'", token.TokenValue, owner)
+		return true
+	}
+	return false
+}
+
+// parserCheckNodes warns about nodes that only one terminal is connected to.
+func parserCheckNodes(parser *Parser) {
+	for name, refs := range parser.nodeRefs {
+		if name != "0" && len(refs) == 1 {
+			parserWarning(parser, refs[0], "node '%s' is connected to a single terminal", name)
+		}
+	}
+}
+
+// parserCheckReferences reports control elements and models that are not defined. Models may come from the .lib
+// sections of the netlist and of the files it loads.
+func parserCheckReferences(parser *Parser, models map[string]*Model) {
+	for _, control := range parser.controls {
+		if _, exists := parser.labels[control.TokenValue]; !exists {
+			parserError(parser, control, "control element '%s' is not defined", control.TokenValue)
+		}
+	}
+
+	for _, use := range parser.modelUses {
+		defined := models[use.TokenValue] != nil
+		for _, section := range parser.lib.sections {
+			defined = defined || section.models[use.TokenValue] != nil
+		}
+		if !defined {
+			parserError(parser, use, "model '%s' is not defined", use.TokenValue)
+		}
+	}
+}
+
+// parserExpectNumber reads the next token as a number, reporting it as 'what' when missing or malformed.
+func parserExpectNumber(parser *Parser, what string) (bool, float64) {
+	token := parserNextToken(parser)
+	if token.TokenType == TokenLineBreak {
+		parserError(parser, token, "missing %s", what)
+		return true, 0.0
+	}
+
+	err, value := parserParseNumber(token.TokenValue)
+	if err {
+		parserError(parser, token, "invalid %s '%s'", what, token.TokenValue)
+	}
+	return err, value
+}
+
+// parserExpectValue reads the value of an element, a number or a "{...}" expression of .param parameters.
+func parserExpectValue(parser *Parser, e *Element) bool {
+	token := parserNextToken(parser)
+	if exprIsExpression(token.TokenValue) {
+		e.Expression = token.TokenValue
+		parser.expressions = append(parser.expressions, parserExpression{token: token, element: e})
+		return false
+	}
+	if token.TokenType == TokenLineBreak {
+		parserError(parser, token, "missing value")
+		return true
+	}
+
+	err := false
+	err, e.Value = parserParseNumber(token.TokenValue)
+	if err {
+		parserError(parser, token, "invalid value '%s'", token.TokenValue)
+	}
+	return err
+}
+
+// parserParseParams parses ".param <name>=<value> ...", values being numbers or expressions
+func parserParseParams(parser *Parser, params []paramDefinition) (bool, []paramDefinition) {
+	command := parser.token
+
+	token := parserNextToken(parser)
+	if token.TokenType == TokenLineBreak {
+		parserError(parser, token, "'%s' needs at least one '<name>=<value>'", command.TokenValue)
+		return true, params
+	}
+	for token.TokenType != TokenLineBreak {
+		name := token
+		if name.TokenType != TokenStr || !parserIsParamName(name.TokenValue) {
+			parserError(parser, name, "invalid parameter name '%s'", name.TokenValue)
+			return true, params
+		}
+		if parserNextToken(parser).TokenType != TokenEqual {
+			parserError(parser, parser.token, "expected '=' after parameter '%s'", name.TokenValue)
+			return true, params
+		}
+		value := parserNextToken(parser)
+		if value.TokenType != TokenStr {
+			parserError(parser, value, "missing value of '%s'", name.TokenValue)
+			return true, params
+		}
+		for _, p := range params {
+			if p.name == name.TokenValue {
+				parserWarning(parser, name, "parameter '%s' redefines the one at line %d", name.TokenValue, p.token.Line)
+			}
+		}
+
+		params = append(params, paramDefinition{name: name.TokenValue, expression: value.TokenValue, token: value})
+		token = parserNextToken(parser)
+	}
+
+	return false, params
+}
+
+// parserIsParamName tells whether name can be used in expressions.
+func parserIsParamName(name string) bool {
+	if name == "" || !exprIsNameByte(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !exprIsNameByte(name[i]) && !parserIsByteNumber(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// parserParseMonteCarlo parses ".mc <runs> [seed=<n>] [dist=unif|gauss]"
+func parserParseMonteCarlo(parser *Parser) (bool, monteCarlo) {
+	mc := monteCarlo{seed: 1}
+	command := parser.token
+
+	err, runs := parserExpectNumber(parser, "number of runs")
+	if err {
+		return true, mc
+	}
+	if runs < 1 || runs != math.Floor(runs) {
+		parserError(parser, parser.token, "'%s' needs a positive whole number of runs", command.TokenValue)
+		return true, mc
+	}
+	mc.runs = int(runs)
+
+	token := parserNextToken(parser)
+	for token.TokenType != TokenLineBreak {
+		key := token
+		if token.TokenType != TokenStr || parserNextToken(parser).TokenType != TokenEqual {
+			parserError(parser, key, "expected 'seed=<n>' or 'dist=unif|gauss', found '%s'", key.TokenValue)
+			return true, mc
+		}
+		value := parserNextToken(parser)
+		switch key.TokenValue {
+		case "seed":
+			err, seed := parserParseNumber(value.TokenValue)
+			if err || seed != math.Floor(seed) {
+				parserError(parser, value, "invalid seed '%s'", value.TokenValue)
+				return true, mc
+			}
+			mc.seed = int64(seed)
+		case "dist":
+			if value.TokenValue != "unif" && value.TokenValue != "gauss" {
+				parserError(parser, value, "distribution must be unif or gauss")
+				return true, mc
+			}
+			mc.gauss = value.TokenValue == "gauss"
+		default:
+			parserError(parser, key, "unknown '%s' setting '%s'", command.TokenValue, key.TokenValue)
+			return true, mc
+		}
+		token = parserNextToken(parser)
+	}
+
+	return false, mc
+}
+
+// parserParseRealOutputs parses ".wc <output> ...", the outputs whose worst case is computed, or ".save <output> ...",
+// the transient signals sent to the sinks and graphs
+func parserParseRealOutputs(parser *Parser, outputs []outputVariable) (bool, []outputVariable) {
+	command := parser.token
+
+	token := parserNextToken(parser)
+	if token.TokenType == TokenLineBreak {
+		parserError(parser, token, "'%s' needs at least one output", command.TokenValue)
+		return true, outputs
+	}
+	for token.TokenType != TokenLineBreak {
+		err, o := parserParseOutputVariable(parser, token)
+		if err {
+			return true, outputs
+		}
+		if o.part != "" {
+			parserError(parser, token, "'%s' only takes real outputs, 'v(...)' or 'i(...)'", command.TokenValue)
+			return true, outputs
+		}
+		outputs = append(outputs, o)
+		token = parserNextToken(parser)
+	}
+
+	return false, outputs
+}
+
+// parserCheckWorstCase checks the outputs of .wc once every node and element is known.
+func parserCheckWorstCase(parser *Parser, elementList *Element, analyses stepAnalyses) {
+	if len(analyses.wc) == 0 {
+		return
+	}
+	if analyses.mc != nil {
+		parserError(parser, analyses.wc[0].token, "'.wc' can not be used together with '.mc'")
+	}
+	for _, o := range analyses.wc {
+		if err := outputCheck(o, elementList, parser.nodesMap); err != "" {
+			parserError(parser, o.token, "%s", err)
+		}
+	}
+
+	for e := elementList; e != nil; e = e.Next {
+		if e.Tolerance != (tolerance{}) {
+			return
+		}
+	}
+	parserWarning(parser, analyses.wc[0].token, "no element has a tolerance, the worst case is the nominal one")
+}
+
+// parserCheckSaves checks the outputs of .save once every node and element is known.
+func parserCheckSaves(parser *Parser, elementList *Element, analyses stepAnalyses) {
+	if len(analyses.saves) == 0 {
+		return
+	}
+	if !analyses.tran {
+		parserWarning(parser, analyses.saves[0].token, "'.save' has no effect without a '.tran' analysis")
+	}
+	saved := make(map[string]Token)
+	for _, o := range analyses.saves {
+		if err := outputCheck(o, elementList, parser.nodesMap); err != "" {
+			parserError(parser, o.token, "%s", err)
+		} else if first, exists := saved[outputName(o)]; exists {
+			parserWarning(parser, o.token, "%s is already saved at line %d", outputName(o), first.Line)
+		} else {
+			saved[outputName(o)] = o.token
+		}
+	}
+}
+
+// parserParseOutputVariable parses "v(<node>)", "v(<node>,<node>)" or "i(<element>)" starting at the given token.
+// A part of the phasor may follow the v or i, as in "vdb(<node>)".
+func parserParseOutputVariable(parser *Parser, token Token) (bool, outputVariable) {
+	o := outputVariable{token: token}
+	if token.TokenType != TokenStr || (token.TokenValue[0] != 'v' && token.TokenValue[0] != 'i') ||
+		!outputParts[token.TokenValue[1:]] {
+		parserError(parser, token, "expected 'v(<node>)', 'v(<node>,<node>)' or 'i(<element>)', found '%s'", token.TokenValue)
+		return true, o
+	}
+	o.current = token.TokenValue[0] == 'i'
+	o.part = token.TokenValue[1:]
+	if parserNextToken(parser).TokenType != TokenOpenParen {
+		parserError(parser, parser.token, "expected '(' after '%s'", token.TokenValue)
+		return true, o
+	}
+
+	name := parserNextToken(parser)
+	if name.TokenType != TokenStr {
+		parserError(parser, name, "expected a node or element name")
+		return true, o
+	}
+	o.node = name.TokenValue
+
+	next := parserNextToken(parser)
+	if next.TokenType == TokenComma && !o.current {
+		name = parserNextToken(parser)
+		if name.TokenType != TokenStr {
+			parserError(parser, name, "expected a node name")
+			return true, o
+		}
+		o.ref = name.TokenValue
+		next = parserNextToken(parser)
+	}
+	if next.TokenType != TokenCloseParen {
+		parserError(parser, next, "expected ')' after '%s'", name.TokenValue)
+		return true, o
+	}
+
+	return false, o
+}
+
+// parserParseMeasure parses ".meas <tran|ac|dc> <name> <measurement>", the measurement being one of
+//
+//	trig <trigger> targ <trigger>
+//	find <output> when <crossing> | find <output> at=<x>
+//	when <crossing>
+//	deriv <output> when <crossing> | deriv <output> at=<x>
+//	avg|rms|min|max|pp|integ <output> [from=<x>] [to=<x>]
+//	param=<expression>
+//
+// where a trigger is "<output> val=<level> [rise|fall|cross=<n>|last] [td=<x>]" or "at=<x>", and a crossing is
+// "<output>=<level>|<output> [rise|fall|cross=<n>|last] [td=<x>]". Values may be "{...}" expressions of the
+// parameters and the measurements before.
+func parserParseMeasure(parser *Parser) (bool, measure) {
+	var m measure
+	command := parser.token
+
+	token := parserNextToken(parser)
+	if token.TokenValue != "tran" && token.TokenValue != "ac" && token.TokenValue != "dc" {
+		parserError(parser, token, "'%s' needs the analysis it measures, tran, ac or dc", command.TokenValue)
+		return true, m
+	}
+	m.analysis = token.TokenValue
+
+	token = parserNextToken(parser)
+	if token.TokenType != TokenStr || !parserIsParamName(token.TokenValue) {
+		parserError(parser, token, "invalid measurement name '%s'", token.TokenValue)
+		return true, m
+	}
+	m.name = token.TokenValue
+	m.token = token
+
+	keyword := parserNextToken(parser)
+	err := false
+	switch keyword.TokenValue {
+	case "trig":
+		m.kind = measureTrigTarg
+		parserNextToken(parser)
+		if parserParseMeasureTrigger(parser, &m, &m.trig, keyword) {
+			return true, m
+		}
+		if parser.token.TokenValue != "targ" {
+			parserError(parser, parser.token, "expected 'targ' after the trig condition")
+			return true, m
+		}
+		targ := parser.token
+		parserNextToken(parser)
+		err = parserParseMeasureTrigger(parser, &m, &m.targ, targ)
+	case "when":
+		m.kind = measureWhen
+		parserNextToken(parser)
+		err = parserParseMeasureCrossing(parser, &m, &m.trig)
+	case "find", "deriv":
+		m.kind = measureFind
+		if keyword.TokenValue == "deriv" {
+			m.kind = measureDeriv
+		}
+		err, m.output = parserParseOutputVariable(parser, parserNextToken(parser))
+		if err {
+			return true, m
+		}
+		condition := parserNextToken(parser)
+		if condition.TokenValue == "when" {
+			parserNextToken(parser)
+			err = parserParseMeasureCrossing(parser, &m, &m.trig)
+		} else if condition.TokenValue == "at" {
+			err = parserParseMeasureSettings(parser, &m, &m.trig, map[string]bool{"at": true})
+		} else {
+			parserError(parser, condition, "expected 'when <crossing>' or 'at=<x>' after '%s'", keyword.TokenValue)
+			return true, m
+		}
+	case "param":
+		m.kind = measureParam
+		if parserNextToken(parser).TokenType != TokenEqual {
+			parserError(parser, parser.token, "expected '=' after 'param'")
+			return true, m
+		}
+		err, m.expression = parserParseMeasureValue(parser, "expression")
+		parserNextToken(parser)
+	default:
+		kind, aggregate := measureAggregates[keyword.TokenValue]
+		if !aggregate {
+			parserError(parser, keyword, "unknown measurement '%s'", keyword.TokenValue)
+			return true, m
+		}
+		m.kind = kind
+		err, m.output = parserParseOutputVariable(parser, parserNextToken(parser))
+		if err {
+			return true, m
+		}
+		parserNextToken(parser)
+		err = parserParseMeasureSettings(parser, &m, nil, map[string]bool{"from": true, "to": true})
+	}
+	if err {
+		return true, m
+	}
+
+	return parserCheckLineEnd(parser, parser.token, command.TokenValue), m
+}
+
+// parserParseMeasureTrigger parses "<output> val=<level> [rise|fall|cross=<n>|last] [td=<x>]" or "at=<x>" starting
+// at the current token. The token after it is left in parser.token.
+func parserParseMeasureTrigger(parser *Parser, m *measure, c *measureCondition, keyword Token) bool {
+	c.count = 1
+	if parser.token.TokenValue == "at" {
+		return parserParseMeasureSettings(parser, m, c, map[string]bool{"at": true})
+	}
+
+	err := false
+	err, c.output = parserParseOutputVariable(parser, parser.token)
+	if err {
+		return true
+	}
+	parserNextToken(parser)
+	if parserParseMeasureSettings(parser, m, c, map[string]bool{"val": true, "rise": true, "fall": true, "cross": true, "td": true}) {
+		return true
+	}
+	if c.level == "" {
+		parserError(parser, keyword, "'%s' needs 'val=<level>' or 'at=<x>'", keyword.TokenValue)
+		return true
+	}
+	return false
+}
+
+// parserParseMeasureCrossing parses "<output>=<level>|<output> [rise|fall|cross=<n>|last] [td=<x>]" starting at the
+// current token. The token after it is left in parser.token.
+func parserParseMeasureCrossing(parser *Parser, m *measure, c *measureCondition) bool {
+	c.count = 1
+	err := false
+	err, c.output = parserParseOutputVariable(parser, parser.token)
+	if err {
+		return true
+	}
+	if parserNextToken(parser).TokenType != TokenEqual {
+		parserError(parser, parser.token, "expected '=' after '%s'", outputName(c.output))
+		return true
+	}
+
+	level := parserNextToken(parser)
+	if level.TokenType == TokenLineBreak {
+		parserError(parser, level, "missing level after '%s='", outputName(c.output))
+		return true
+	}
+	if err, _ := parserParseNumber(level.TokenValue); exprIsExpression(level.TokenValue) || !err {
+		c.level = level.TokenValue
+	} else {
+		var against outputVariable
+		err, against = parserParseOutputVariable(parser, level)
+		if err {
+			return true
+		}
+		c.against = &against
+	}
+
+	parserNextToken(parser)
+	return parserParseMeasureSettings(parser, m, c, map[string]bool{"rise": true, "fall": true, "cross": true, "td": true})
+}
+
+// parserParseMeasureSettings parses the "<key>=<value>" of a measurement with one of the given keys, starting at the
+// current token. The token after them is left in parser.token.
+func parserParseMeasureSettings(parser *Parser, m *measure, c *measureCondition, keys map[string]bool) bool {
+	for parser.token.TokenType == TokenStr && keys[parser.token.TokenValue] {
+		key := parser.token
+		if parserNextToken(parser).TokenType != TokenEqual {
+			parserError(parser, parser.token, "expected '=' after '%s'", key.TokenValue)
+			return true
+		}
+
+		if key.TokenValue == "rise" || key.TokenValue == "fall" || key.TokenValue == "cross" {
+			c.edge = map[string]measureEdge{"rise": measureRise, "fall": measureFall, "cross": measureCross}[key.TokenValue]
+			count := parserNextToken(parser)
+			err, n := parserParseNumber(count.TokenValue)
+			if count.TokenValue == "last" {
+				c.count = 0
+			} else if err || n < 1 || n != math.Floor(n) {
+				parserError(parser, count, "'%s' needs a positive whole number or 'last'", key.TokenValue)
+				return true
+			} else {
+				c.count = int(n)
+			}
+			parserNextToken(parser)
+			continue
+		}
+
+		err, value := parserParseMeasureValue(parser, "value of '"+key.TokenValue+"'")
+		if err {
+			return true
+		}
+		switch key.TokenValue {
+		case "val":
+			c.level = value
+		case "at":
+			c.at = value
+		case "td":
+			c.delay = value
+		case "from":
+			m.from = value
+		case "to":
+			m.to = value
+		}
+		parserNextToken(parser)
+	}
+	return false
+}
+
+// parserParseMeasureValue reads the next token as a number or a "{...}" expression.
+func parserParseMeasureValue(parser *Parser, what string) (bool, string) {
+	token := parserNextToken(parser)
+	if token.TokenType == TokenLineBreak {
+		parserError(parser, token, "missing %s", what)
+		return true, ""
+	}
+	if err, _ := parserParseNumber(token.TokenValue); err && !exprIsExpression(token.TokenValue) {
+		parserError(parser, token, "invalid %s '%s'", what, token.TokenValue)
+		return true, ""
+	}
+	return false, token.TokenValue
+}
+
+// parserCheckMeasures checks that measurements have their analysis, outputs that are part of the circuit and
+// expressions of known names: parameters and the measurements before them.
+func parserCheckMeasures(parser *Parser, elementList *Element, params []paramDefinition, analyses stepAnalyses) {
+	defined := make(map[string]bool)
+	for _, p := range params {
+		defined[p.name] = true
+	}
+	for _, section := range parser.lib.sections {
+		for _, p := range section.params {
+			defined[p.name] = true
+		}
+	}
+	measured := make(map[string]Token)
+	before := map[string][]string{}
+
+	ran := map[string]bool{"tran": analyses.tran, "ac": analyses.ac, "dc": analyses.op}
+	command := map[string]string{"tran": ".tran", "ac": ".ac", "dc": ".op"}
+	for _, m := range analyses.measures {
+		if !ran[m.analysis] {
+			parserError(parser, m.token, "measurement '%s' needs a '%s' analysis", m.name, command[m.analysis])
+		}
+		if first, exists := measured[m.name]; exists {
+			parserError(parser, m.token, "measurement '%s' is already defined at line %d", m.name, first.Line)
+		}
+		measured[m.name] = m.token
+
+		outputs := []outputVariable{m.trig.output, m.targ.output, m.output}
+		if m.trig.against != nil {
+			outputs = append(outputs, *m.trig.against)
+		}
+		for _, o := range outputs {
+			if o.node == "" {
+				continue
+			}
+			if err := outputCheck(o, elementList, parser.nodesMap); err != "" {
+				parserError(parser, o.token, "%s", err)
+			} else if o.part != "" && m.analysis != "ac" {
+				parserError(parser, o.token, "'%s' is only defined for ac measurements", o.token.TokenValue)
+			}
+		}
+
+		// Only the names matter, measurements see the ones of their analysis
+		names := make(map[string]float64)
+		for name := range defined {
+			names[name] = 1.0
+		}
+		for _, name := range before[m.analysis] {
+			names[name] = 1.0
+		}
+		scope := exprScope{params: names}
+		for _, expression := range []string{m.expression, m.from, m.to, m.trig.at, m.trig.level, m.trig.delay,
+			m.targ.at, m.targ.level, m.targ.delay} {
+			if err, _ := exprEvaluate(expression, scope); expression != "" && strings.HasSuffix(err, "is not defined") {
+				parserError(parser, m.token, "measurement '%s': %s", m.name, err)
+			}
+		}
+		before[m.analysis] = append(before[m.analysis], m.name)
+	}
+}
+
+// parserParseFourier parses ".four <frequency> [<harmonics>] <output> ... [periods=<n>] [fft=rect|hann|blackman]
+// [points=<n>]", fft asking for the spectrum of the whole transient.
+func parserParseFourier(parser *Parser) (bool, fourier) {
+	f := fourier{harmonics: fourierHarmonics, periods: 1, token: parser.token}
+	command := parser.token
+
+	err, frequency := parserExpectNumber(parser, "fundamental frequency")
+	if err {
+		return true, f
+	}
+	if frequency <= 0.0 {
+		parserError(parser, parser.token, "the fundamental frequency must be positive")
+		return true, f
+	}
+	f.frequency = frequency
+
+	token := parserNextToken(parser)
+	if err, harmonics := parserParseNumber(token.TokenValue); !err {
+		if harmonics < 1 || harmonics != math.Floor(harmonics) {
+			parserError(parser, token, "the number of harmonics must be a positive whole number")
+			return true, f
+		}
+		f.harmonics = int(harmonics)
+		token = parserNextToken(parser)
+	}
+
+	settings := map[string]bool{"periods": true, "fft": true, "points": true}
+	for token.TokenType != TokenLineBreak && !settings[token.TokenValue] {
+		err, o := parserParseOutputVariable(parser, token)
+		if err {
+			return true, f
+		}
+		if o.part != "" {
+			parserError(parser, token, "'%s' only takes real outputs, 'v(...)' or 'i(...)'", command.TokenValue)
+			return true, f
+		}
+		f.outputs = append(f.outputs, o)
+		token = parserNextToken(parser)
+	}
+	if len(f.outputs) == 0 {
+		parserError(parser, token, "'%s' needs at least one output", command.TokenValue)
+		return true, f
+	}
+
+	for token.TokenType != TokenLineBreak {
+		key := token
+		if !settings[key.TokenValue] || parserNextToken(parser).TokenType != TokenEqual {
+			parserError(parser, key, "expected 'periods=<n>', 'fft=rect|hann|blackman' or 'points=<n>', found '%s'", key.TokenValue)
+			return true, f
+		}
+		value := parserNextToken(parser)
+		if key.TokenValue == "fft" {
+			if value.TokenValue != "rect" && value.TokenValue != "hann" && value.TokenValue != "blackman" {
+				parserError(parser, value, "window must be rect, hann or blackman")
+				return true, f
+			}
+			f.window = value.TokenValue
+			token = parserNextToken(parser)
+			continue
+		}
+
+		err, n := parserParseNumber(value.TokenValue)
+		if err || n < 1 || n != math.Floor(n) {
+			parserError(parser, value, "'%s' needs a positive whole number", key.TokenValue)
+			return true, f
+		}
+		if key.TokenValue == "periods" {
+			f.periods = int(n)
+		} else if int(n)&(int(n)-1) != 0 {
+			parserError(parser, value, "the number of points must be a power of 2")
+			return true, f
+		} else {
+			f.points = int(n)
+		}
+		token = parserNextToken(parser)
+	}
+
+	return false, f
+}
+
+// parserCheckFourier checks that every .four has outputs that are part of the circuit and a transient long and fine
+// enough for its periods and harmonics.
+func parserCheckFourier(parser *Parser, elementList *Element, analyses stepAnalyses) {
+	for _, f := range analyses.fouriers {
+		for _, o := range f.outputs {
+			if err := outputCheck(o, elementList, parser.nodesMap); err != "" {
+				parserError(parser, o.token, "%s", err)
+			}
+		}
+
+		if !analyses.tran {
+			parserError(parser, f.token, "'.four' needs a '.tran' analysis")
+			continue
+		}
+		if duration := float64(f.periods) / f.frequency; duration > analyses.tStop {
+			parserError(parser, f.token, "%d period(s) of %g Hz last longer than the transient (%g s)", f.periods,
+				f.frequency, analyses.tStop)
+		}
+		if analyses.tStep > 0.5/(float64(f.harmonics)*f.frequency) {
+			parserWarning(parser, f.token, "time step %.6g is too coarse for %d harmonics of %g Hz", analyses.tStep,
+				f.harmonics, f.frequency)
+		}
+		if f.window != "" && !generateGraphs {
+			parserWarning(parser, f.token, "the spectrum of 'fft=' is only plotted with -graphs")
+		}
+	}
+}
+
+// parserParseNoise parses ".noise v(<node>[,<node>]) <source> dec|oct|lin <points> <fstart> <fstop>".
+func parserParseNoise(parser *Parser) (bool, noiseAnalysis) {
+	var n noiseAnalysis
+	command := parser.token
+
+	token := parserNextToken(parser)
+	if token.TokenType == TokenLineBreak {
+		parserError(parser, token, "'%s' needs an output voltage, an input source and a sweep", command.TokenValue)
+		return true, n
+	}
+	err, o := parserParseOutputVariable(parser, token)
+	if err {
+		return true, n
+	}
+	if o.current || o.part != "" {
+		parserError(parser, token, "'%s' only takes an output voltage, 'v(...)'", command.TokenValue)
+		return true, n
+	}
+	n.output = o
+
+	source := parserNextToken(parser)
+	if source.TokenType != TokenStr {
+		parserError(parser, source, "'%s' needs an input source after the output", command.TokenValue)
+		return true, n
+	}
+	n.source = source.TokenValue
+	n.token = source
+
+	err, n.sweep = parserParseACSweep(parser, command)
+	return err, n
+}
+
+// parserCheckNoise checks that the output of .noise is part of the circuit and its input is a source.
+func parserCheckNoise(parser *Parser, elementList *Element, analyses stepAnalyses) {
+	n := analyses.noise
+	if n == nil {
+		return
+	}
+	if err := outputCheck(n.output, elementList, parser.nodesMap); err != "" {
+		parserError(parser, n.output.token, "%s", err)
+	}
+	source := elementListFindByLabel(elementList, n.source)
+	if source == nil || (source.ElementType != ElementVoltageSource && source.ElementType != ElementCurrentSource) {
+		parserError(parser, n.token, "input '%s' of '.noise' is not an independent voltage or current source", n.source)
+	}
+}
+
+// parserParseTransferFunction parses ".tf v(<node>[,<node>])|i(<source>) <source>".
+func parserParseTransferFunction(parser *Parser) (bool, transferFunction) {
+	var tf transferFunction
+	command := parser.token
+
+	token := parserNextToken(parser)
+	if token.TokenType == TokenLineBreak {
+		parserError(parser, token, "'%s' needs an output and an input source", command.TokenValue)
+		return true, tf
+	}
+	err, o := parserParseOutputVariable(parser, token)
+	if err {
+		return true, tf
+	}
+	if o.part != "" {
+		parserError(parser, token, "'%s' only takes real outputs, 'v(...)' or 'i(...)'", command.TokenValue)
+		return true, tf
+	}
+	tf.output = o
+
+	source := parserNextToken(parser)
+	if source.TokenType != TokenStr {
+		parserError(parser, source, "'%s' needs an input source after the output", command.TokenValue)
+		return true, tf
+	}
+	tf.source = source.TokenValue
+	tf.token = source
+
+	return parserCheckLineEnd(parser, parserNextToken(parser), command.TokenValue), tf
+}
+
+// parserCheckTransferFunctions checks that the input of every .tf is a source, and its output a voltage of the
+// circuit or the current of a voltage source.
+func parserCheckTransferFunctions(parser *Parser, elementList *Element, analyses stepAnalyses) {
+	for _, tf := range analyses.tfs {
+		if err := outputCheck(tf.output, elementList, parser.nodesMap); err != "" {
+			parserError(parser, tf.output.token, "%s", err)
+		} else if tf.output.current && elementListFindByLabel(elementList, tf.output.node).ElementType != ElementVoltageSource {
+			parserError(parser, tf.output.token, "the output current of '.tf' must flow through a voltage source")
+		}
+		source := elementListFindByLabel(elementList, tf.source)
+		if source == nil || (source.ElementType != ElementVoltageSource && source.ElementType != ElementCurrentSource) {
+			parserError(parser, tf.token, "input '%s' of '.tf' is not an independent voltage or current source", tf.source)
+		}
+	}
+}
+
+// parserParseSensitivity parses ".sens <output> [ac dec|oct|lin <points> <fstart> <fstop>]".
+func parserParseSensitivity(parser *Parser) (bool, sensitivity) {
+	var sens sensitivity
+	command := parser.token
+
+	token := parserNextToken(parser)
+	if token.TokenType == TokenLineBreak {
+		parserError(parser, token, "'%s' needs an output", command.TokenValue)
+		return true, sens
+	}
+	err, o := parserParseOutputVariable(parser, token)
+	if err {
+		return true, sens
+	}
+	sens.output = o
+	sens.token = token
+
+	next := parserNextToken(parser)
+	if next.TokenValue == "ac" {
+		sens.ac = true
+		err, sens.sweep = parserParseACSweep(parser, command)
+		return err, sens
+	}
+	if o.part != "" {
+		parserError(parser, token, "the output of a DC '%s' must be real, 'v(...)' or 'i(...)'", command.TokenValue)
+		return true, sens
+	}
+	return parserCheckLineEnd(parser, next, command.TokenValue), sens
+}
+
+// parserCheckSensitivities checks the outputs of .sens once every node and element is known.
+func parserCheckSensitivities(parser *Parser, elementList *Element, analyses stepAnalyses) {
+	if len(analyses.sens) > 0 && analyses.mc != nil {
+		parserError(parser, analyses.sens[0].token, "'.sens' can not be used together with '.mc'")
+	}
+	for _, sens := range analyses.sens {
+		if err := outputCheck(sens.output, elementList, parser.nodesMap); err != "" {
+			parserError(parser, sens.output.token, "%s", err)
+		}
+	}
+}
+
+// parserParsePoleZero parses ".pz <in+> <in-> <out+> <out-> vol|cur pol|zer|pz".
+func parserParsePoleZero(parser *Parser) (bool, poleZero) {
+	var pz poleZero
+	command := parser.token
+
+	for i := range pz.tokens {
+		node := parserNextToken(parser)
+		if node.TokenType != TokenStr {
+			parserError(parser, node, "'%s' needs the input and output nodes, '<in+> <in-> <out+> <out->'", command.TokenValue)
+			return true, pz
+		}
+		pz.tokens[i] = node
+	}
+	pz.inputs = [2]string{pz.tokens[0].TokenValue, pz.tokens[1].TokenValue}
+	pz.outputs = [2]string{pz.tokens[2].TokenValue, pz.tokens[3].TokenValue}
+
+	input := parserNextToken(parser)
+	if input.TokenValue != "vol" && input.TokenValue != "cur" {
+		parserError(parser, input, "expected 'vol' or 'cur' input, found '%s'", input.TokenValue)
+		return true, pz
+	}
+	pz.current = input.TokenValue == "cur"
+
+	roots := parserNextToken(parser)
+	switch roots.TokenValue {
+	case "pol":
+		pz.poles = true
+	case "zer":
+		pz.zeros = true
+	case "pz":
+		pz.poles, pz.zeros = true, true
+	default:
+		parserError(parser, roots, "expected 'pol', 'zer' or 'pz', found '%s'", roots.TokenValue)
+		return true, pz
+	}
+
+	return parserCheckLineEnd(parser, parserNextToken(parser), command.TokenValue), pz
+}
+
+// parserCheckPoleZeros checks the nodes of every .pz, and that the circuit has a rational transfer function.
+func parserCheckPoleZeros(parser *Parser, elementList *Element, analyses stepAnalyses) {
+	for _, pz := range analyses.pzs {
+		for _, node := range pz.tokens {
+			if _, exists := parser.nodesMap[node.TokenValue]; !exists {
+				parserError(parser, node, "node '%s' is not part of the circuit", node.TokenValue)
+			}
+		}
+		if pz.inputs[0] == pz.inputs[1] {
+			parserError(parser, pz.tokens[1], "the input nodes of '.pz' must be different")
+		}
+		if pz.outputs[0] == pz.outputs[1] {
+			parserError(parser, pz.tokens[3], "the output nodes of '.pz' must be different")
+		}
+	}
+
+	if len(analyses.pzs) == 0 {
+		return
+	}
+	for e := elementList; e != nil; e = e.Next {
+		if e.ElementType == ElementTLine || e.ElementType == ElementLossyLine || e.ElementType == ElementNetwork {
+			parserError(parser, analyses.pzs[0].tokens[0],
+				"'.pz' does not support transmission lines or Touchstone networks such as %s", e.Label)
+			return
+		}
+	}
+}
+
+// parserParseStability parses ".stb <probe> dec|oct|lin <points> <fstart> <fstop>".
+func parserParseStability(parser *Parser) (bool, stability) {
+	var s stability
+	command := parser.token
+
+	probe := parserNextToken(parser)
+	if probe.TokenType != TokenStr {
+		parserError(parser, probe, "'%s' needs a probe and a sweep", command.TokenValue)
+		return true, s
+	}
+	s.probe = probe.TokenValue
+	s.token = probe
+
+	var err bool
+	err, s.sweep = parserParseACSweep(parser, command)
+	return err, s
+}
+
+// parserCheckStabilities checks that every .stb breaks its loop at a probe away from ground, and that no probe is
+// analysed twice.
+func parserCheckStabilities(parser *Parser, elementList *Element, analyses stepAnalyses) {
+	seen := make(map[string]Token)
+	for _, s := range analyses.stbs {
+		probe := elementListFindByLabel(elementList, s.probe)
+		if probe == nil || probe.ElementType != ElementProbe {
+			parserError(parser, s.token, "'%s' of '.stb' is not a probe", s.probe)
+			continue
+		}
+		if probe.Nodes[0] == 0 || probe.Nodes[1] == 0 {
+			parserError(parser, s.token, "probe '%s' of '.stb' must not be connected to ground", s.probe)
+		}
+		if first, exists := seen[s.probe]; exists {
+			parserError(parser, s.token, "probe '%s' is already analysed by the '.stb' at line %d", s.probe, first.Line)
+		}
+		seen[s.probe] = s.token
+	}
+}
+
+// parserParseNetworkAnalysis parses ".net <source> [<source> ...] dec|oct|lin <points> <fstart> <fstop> [z0=<ohms>]
+// [file=<name>]", the voltage sources being the ports in order. The reference impedance is 50 ohm by default.
+func parserParseNetworkAnalysis(parser *Parser) (bool, network) {
+	n := network{z0: 50.0}
+	command := parser.token
+
+	token := parserNextToken(parser)
+	for token.TokenType == TokenStr && token.TokenValue != "dec" && token.TokenValue != "oct" && token.TokenValue != "lin" {
+		n.ports = append(n.ports, token.TokenValue)
+		n.tokens = append(n.tokens, token)
+		token = parserNextToken(parser)
+	}
+	if len(n.ports) == 0 {
+		parserError(parser, token, "'%s' needs the sources of its ports and a sweep", command.TokenValue)
+		return true, n
+	}
+
+	err, sweep := parserParseSweepRange(parser, token)
+	if err {
+		return true, n
+	}
+	n.sweep = sweep
+
+	token = parserNextToken(parser)
+	for token.TokenType != TokenLineBreak {
+		key := token
+		if (key.TokenValue != "z0" && key.TokenValue != "file") || parserNextToken(parser).TokenType != TokenEqual {
+			parserError(parser, key, "expected 'z0=<ohms>' or 'file=<name>', found '%s'", key.TokenValue)
+			return true, n
+		}
+		value := parserNextToken(parser)
+		if key.TokenValue == "file" {
+			if value.TokenType != TokenStr {
+				parserError(parser, value, "expected a file name, found '%s'", value.TokenValue)
+				return true, n
+			}
+			n.file = strings.Trim(lexerLexeme(&parser.lexer, value), "'\"")
+		} else if err, z0 := parserParseNumber(value.TokenValue); err || z0 <= 0.0 {
+			parserError(parser, value, "the reference impedance must be positive")
+			return true, n
+		} else {
+			n.z0 = z0
+		}
+		token = parserNextToken(parser)
+	}
+	return false, n
+}
+
+// parserCheckNetworks checks that the ports of every .net are distinct independent voltage sources.
+func parserCheckNetworks(parser *Parser, elementList *Element, analyses stepAnalyses) {
+	for _, n := range analyses.nets {
+		seen := make(map[string]bool)
+		for i, port := range n.ports {
+			source := elementListFindByLabel(elementList, port)
+			if source == nil || source.ElementType != ElementVoltageSource {
+				parserError(parser, n.tokens[i], "port '%s' of '.net' is not an independent voltage source", port)
+			} else if seen[port] {
+				parserError(parser, n.tokens[i], "source '%s' is already a port of this '.net'", port)
+			}
+			seen[port] = true
+		}
+	}
+}
 
-	for !lexer.eof {
-		token = LexerNextToken(&lexer)
-		switch token.TokenType {
-		case TokenLineBreak:
-			{
+// parserParsePeriodicSteadyState parses ".pss <frequency> <output> ... [points=<n>] [periods=<n>] [osc=<node>]",
+// osc making the frequency the first guess of an oscillator.
+func parserParsePeriodicSteadyState(parser *Parser) (bool, periodicSteadyState) {
+	p := periodicSteadyState{points: pssPoints, token: parser.token}
+	command := parser.token
+
+	err, frequency := parserExpectNumber(parser, "fundamental frequency")
+	if err {
+		return true, p
+	}
+	if frequency <= 0.0 {
+		parserError(parser, parser.token, "the fundamental frequency must be positive")
+		return true, p
+	}
+	p.frequency = frequency
+
+	settings := map[string]bool{"points": true, "periods": true, "osc": true}
+	token := parserNextToken(parser)
+	for token.TokenType != TokenLineBreak && !settings[token.TokenValue] {
+		err, o := parserParseOutputVariable(parser, token)
+		if err {
+			return true, p
+		}
+		if o.part != "" {
+			parserError(parser, token, "'%s' only takes real outputs, 'v(...)' or 'i(...)'", command.TokenValue)
+			return true, p
+		}
+		p.outputs = append(p.outputs, o)
+		token = parserNextToken(parser)
+	}
+	if len(p.outputs) == 0 {
+		parserError(parser, token, "'%s' needs at least one output", command.TokenValue)
+		return true, p
+	}
 
+	for token.TokenType != TokenLineBreak {
+		key := token
+		if !settings[key.TokenValue] || parserNextToken(parser).TokenType != TokenEqual {
+			parserError(parser, key, "expected 'points=<n>', 'periods=<n>' or 'osc=<node>', found '%s'", key.TokenValue)
+			return true, p
+		}
+		value := parserNextToken(parser)
+		if key.TokenValue == "osc" {
+			if value.TokenType != TokenStr {
+				parserError(parser, value, "'osc' needs the node of the oscillator")
+				return true, p
 			}
-		case TokenCommand:
-			{
-				if token.TokenValue == ".op" {
-					opCommand = true
-				} else if token.TokenValue == ".tran" {
-					tranCommand = true
-					// Get Value
-					nodeToken := LexerNextToken(&lexer)
-					err, step := parserParseNumber(nodeToken.TokenValue)
-
-					if err {
-						fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", lexer.lineNumber)
-						return
-					}
+			p.osc = value.TokenValue
+			token = parserNextToken(parser)
+			continue
+		}
+
+		err, n := parserParseNumber(value.TokenValue)
+		if err || n < 1 || n != math.Floor(n) {
+			parserError(parser, value, "'%s' needs a positive whole number", key.TokenValue)
+			return true, p
+		}
+		if key.TokenValue == "points" {
+			p.points = int(n)
+		} else {
+			p.periods = int(n)
+		}
+		token = parserNextToken(parser)
+	}
 
-					nodeToken = LexerNextToken(&lexer)
-					err, stop := parserParseNumber(nodeToken.TokenValue)
+	if p.periods == 0 {
+		p.periods = pssDrivenPeriods
+		if p.osc != "" {
+			p.periods = pssOscillatorPeriods
+		}
+	}
+	return false, p
+}
 
-					if err {
-						fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", lexer.lineNumber)
-						return
-					}
+// parserCheckPeriodicSteadyStates checks the outputs and the node of every .pss, and that the circuit can have the
+// steady state asked for: the sources of a driven circuit repeat over the fundamental, an oscillator runs without
+// time varying sources. Ideal transmission lines, which remember more than a time step, are not supported.
+func parserCheckPeriodicSteadyStates(parser *Parser, elementList *Element, analyses stepAnalyses) {
+	for _, p := range analyses.psss {
+		for _, o := range p.outputs {
+			if err := outputCheck(o, elementList, parser.nodesMap); err != "" {
+				parserError(parser, o.token, "%s", err)
+			}
+		}
+		if index, exists := parser.nodesMap[p.osc]; p.osc != "" && (!exists || index == 0) {
+			parserError(parser, p.token, "oscillator node '%s' of '.pss' is not a node of the circuit", p.osc)
+		}
 
-					tStep = step
-					tStop = stop
+		for e := elementList; e != nil; e = e.Next {
+			if e.ElementType == ElementTLine {
+				parserError(parser, p.token, "'.pss' does not support ideal transmission lines such as %s", e.Label)
+				break
+			}
+			if e.ElementType != ElementVoltageSource && e.ElementType != ElementCurrentSource {
+				continue
+			}
+			switch source := e.Extra.(type) {
+			case sinDescriptor:
+				harmonic := source.freq / p.frequency
+				if p.osc != "" && source.va != 0.0 {
+					parserError(parser, p.token, "the oscillator of '.pss' can not be driven by source '%s'", e.Label)
+				} else if p.osc == "" && math.Abs(harmonic-math.Round(harmonic)) > 1e-9*harmonic {
+					parserError(parser, p.token, "source '%s' of %g Hz does not repeat over the %g Hz of '.pss'", e.Label,
+						source.freq, p.frequency)
+				}
+			case []pwlDescriptor:
+				if len(source) > 1 {
+					parserError(parser, p.token, "'.pss' needs periodic sources, PWL source '%s' is not", e.Label)
 				}
 			}
-		case TokenStr:
-			{
-				// Parse "Element" Line
-				var (
-					err bool
-					e   *Element
-				)
+		}
+	}
+}
 
-				err, e = parserParseElement(&lexer, token.TokenValue, nodesMap, &nodesQuantity)
-				if err {
-					return
-				} else {
-					if elementList != nil {
-						elementListAppend(elementList, e)
-					} else {
-						elementList = e
+// parserParseHarmonicBalance parses ".hb <f1> [<f2> ...] [<output> ...] [harmonics=<n>]". Without outputs every
+// node voltage is reported.
+func parserParseHarmonicBalance(parser *Parser) (bool, harmonicBalance) {
+	h := harmonicBalance{harmonics: hbHarmonics, token: parser.token}
+	command := parser.token
+
+	err, tone := parserExpectNumber(parser, "tone frequency")
+	if err {
+		return true, h
+	}
+	token := parser.token
+	for !err {
+		if tone <= 0.0 {
+			parserError(parser, token, "the frequency of a tone must be positive")
+			return true, h
+		}
+		h.tones = append(h.tones, tone)
+		token = parserNextToken(parser)
+		err, tone = parserParseNumber(token.TokenValue)
+	}
+	if len(h.tones) > hbTones {
+		parserError(parser, command, "'%s' takes at most %d tones", command.TokenValue, hbTones)
+		return true, h
+	}
+
+	for token.TokenType != TokenLineBreak && token.TokenValue != "harmonics" {
+		err, o := parserParseOutputVariable(parser, token)
+		if err {
+			return true, h
+		}
+		if o.part != "" {
+			parserError(parser, token, "'%s' only takes real outputs, 'v(...)' or 'i(...)'", command.TokenValue)
+			return true, h
+		}
+		h.outputs = append(h.outputs, o)
+		token = parserNextToken(parser)
+	}
+
+	if token.TokenType != TokenLineBreak {
+		if parserNextToken(parser).TokenType != TokenEqual {
+			parserError(parser, token, "expected 'harmonics=<n>', found '%s'", token.TokenValue)
+			return true, h
+		}
+		value := parserNextToken(parser)
+		err, n := parserParseNumber(value.TokenValue)
+		if err || n < 1 || n != math.Floor(n) {
+			parserError(parser, value, "'harmonics' needs a positive whole number")
+			return true, h
+		}
+		h.harmonics = int(n)
+		if parserCheckLineEnd(parser, parserNextToken(parser), command.TokenValue) {
+			return true, h
+		}
+	}
+	return false, h
+}
+
+// parserCheckHarmonicBalances checks the outputs of every .hb, and that its sources sit at its mixing products:
+// each sine source at the frequency of one of them, no PWL waveform. Tones that are harmonics of each other within
+// the order kept make two products meet at the same frequency, which harmonic balance can not tell apart.
+func parserCheckHarmonicBalances(parser *Parser, elementList *Element, analyses stepAnalyses) {
+	for _, h := range analyses.hbs {
+		for _, o := range h.outputs {
+			if err := outputCheck(o, elementList, parser.nodesMap); err != "" {
+				parserError(parser, o.token, "%s", err)
+			}
+		}
+
+		products := hbProducts(h.tones, h.harmonics)
+		if p := hbCoincident(products); p >= 0 {
+			parserError(parser, h.token, "mixing products %s and %s of '.hb' are both at %g Hz", hbProductName(products[p]),
+				hbProductName(products[p+1]), products[p].frequency)
+			continue
+		}
+		for e := elementList; e != nil; e = e.Next {
+			if e.ElementType != ElementVoltageSource && e.ElementType != ElementCurrentSource {
+				continue
+			}
+			switch source := e.Extra.(type) {
+			case sinDescriptor:
+				if hbProductAt(products, source.freq) < 0 {
+					parserError(parser, h.token, "source '%s' of %g Hz is not at a mixing product of the tones of '.hb'",
+						e.Label, source.freq)
+				}
+			case []pwlDescriptor:
+				if len(source) > 1 {
+					parserError(parser, h.token, "'.hb' needs periodic sources, PWL source '%s' is not", e.Label)
+				}
+			}
+		}
+	}
+}
+
+// parserParseLibrary parses ".lib <name>", which starts the definition of a section, and ".lib <file> <section>",
+// which loads the sections of a file and uses one of them. File names are relative to the file that loads them.
+func parserParseLibrary(parser *Parser) bool {
+	command := parser.token
+
+	name := parserNextToken(parser)
+	if name.TokenType != TokenStr {
+		parserError(parser, name, "'%s' needs a section name, or a file and a section", command.TokenValue)
+		return true
+	}
+	path := strings.Trim(lexerLexeme(&parser.lexer, name), "'\"")
+
+	section := parserNextToken(parser)
+	if section.TokenType == TokenLineBreak {
+		if first, exists := parser.lib.sections[name.TokenValue]; exists {
+			parserError(parser, name, "section '%s' is already defined at %s:%d", name.TokenValue, first.token.File, first.token.Line)
+			// Keep parsing the section so its lines are not taken as part of the circuit
+		}
+		parser.section = &librarySection{models: make(map[string]*Model), token: name}
+		if _, exists := parser.lib.sections[name.TokenValue]; !exists {
+			parser.lib.sections[name.TokenValue] = parser.section
+		}
+		return false
+	}
+	if section.TokenType != TokenStr {
+		parserError(parser, section, "invalid section name '%s'", section.TokenValue)
+		return true
+	}
+	if parserCheckLineEnd(parser, parserNextToken(parser), command.TokenValue) {
+		return true
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(command.File), path)
+	}
+	if parserLoadLibrary(parser, name, path) {
+		return true
+	}
+	if _, exists := parser.lib.sections[section.TokenValue]; !exists {
+		parserError(parser, section, "library '%s' has no section '%s'", name.TokenValue, section.TokenValue)
+		return true
+	}
+	for _, selected := range parser.lib.selected {
+		if selected == section.TokenValue {
+			parserWarning(parser, section, "section '%s' is already in use", section.TokenValue)
+			return false
+		}
+	}
+	parser.lib.selected = append(parser.lib.selected, section.TokenValue)
+	return false
+}
+
+// parserLoadLibrary parses the sections of a library file, once however many times it is loaded.
+func parserLoadLibrary(parser *Parser, file Token, path string) bool {
+	if parser.libraryFiles[path] {
+		return false
+	}
+	err, lexer := lexerInitLibrary(path)
+	if err {
+		parserError(parser, file, "can not read library '%s'", path)
+		return true
+	}
+	parser.libraryFiles[path] = true
+
+	// Parse the file with its own lexer, then resume the netlist
+	netlist, netlistToken := parser.lexer, parser.token
+	parser.lexer = lexer
+	for !parser.lexer.eof {
+		token := parserNextToken(parser)
+		err := false
+		if token.TokenType == TokenLineBreak {
+			continue
+		} else if parser.section != nil {
+			err = parserParseSectionLine(parser, token)
+		} else if token.TokenType == TokenCommand && token.TokenValue == ".lib" {
+			err = parserParseLibrary(parser)
+		} else {
+			parserError(parser, token, "only .lib sections can be in a library, found '%s'", token.TokenValue)
+			err = true
+		}
+		if err {
+			parserRecover(parser)
+		}
+	}
+	parserCheckSection(parser)
+	parser.lexer, parser.token = netlist, netlistToken
+
+	return false
+}
+
+// parserParseSectionLine parses a line inside a .lib section, which only holds .model, .param and its .endl.
+func parserParseSectionLine(parser *Parser, token Token) bool {
+	section := parser.section
+	if token.TokenType != TokenCommand {
+		parserError(parser, token, "only .model and .param can be in .lib section '%s'", section.token.TokenValue)
+		return true
+	}
+
+	err := false
+	switch token.TokenValue {
+	case ".endl":
+		// The section name may be repeated after .endl
+		next := parserNextToken(parser)
+		if next.TokenType == TokenStr && next.TokenValue != section.token.TokenValue {
+			parserError(parser, next, "'.endl %s' ends section '%s'", next.TokenValue, section.token.TokenValue)
+			err = true
+		} else if next.TokenType == TokenStr {
+			err = parserCheckLineEnd(parser, parserNextToken(parser), token.TokenValue)
+		} else {
+			err = parserCheckLineEnd(parser, next, token.TokenValue)
+		}
+		parser.section = nil
+	case ".model":
+		var model *Model
+		err, model = parserParseModel(parser)
+		if !err {
+			if _, exists := section.models[model.Name]; exists {
+				parserWarning(parser, token, "model '%s' is defined twice in section '%s'", model.Name, section.token.TokenValue)
+			}
+			section.models[model.Name] = model
+		}
+	case ".param", ".params":
+		err, section.params = parserParseParams(parser, section.params)
+	default:
+		parserError(parser, token, "only .model and .param can be in .lib section '%s'", section.token.TokenValue)
+		err = true
+	}
+	return err
+}
+
+// parserCheckSection reports a .lib section left open at the end of a file.
+func parserCheckSection(parser *Parser) {
+	if parser.section != nil {
+		parserError(parser, parser.section.token, "section '%s' has no '.endl'", parser.section.token.TokenValue)
+		parser.section = nil
+	}
+}
+
+// parserParseStep parses ".step [lin|dec|oct] <what> <start> <stop> <increment|points>",
+// ".step <what> list <value> ..." and ".step lib list <section> ...", where <what> is "param <name>", "temp" or the
+// label of an element or source.
+func parserParseStep(parser *Parser) (bool, stepSweep) {
+	var s stepSweep
+	command := parser.token
+
+	sweepType := "lin"
+	token := parserNextToken(parser)
+	if token.TokenValue == "lin" || token.TokenValue == "dec" || token.TokenValue == "oct" {
+		sweepType = token.TokenValue
+		token = parserNextToken(parser)
+	}
+
+	// Get What Is Swept
+	if token.TokenType != TokenStr {
+		parserError(parser, token, "'%s' needs 'param <name>', 'temp' or an element", command.TokenValue)
+		return true, s
+	}
+	switch token.TokenValue {
+	case "param":
+		s.kind = stepKindParam
+		token = parserNextToken(parser)
+		if token.TokenType != TokenStr || !parserIsParamName(token.TokenValue) {
+			parserError(parser, token, "invalid parameter name '%s'", token.TokenValue)
+			return true, s
+		}
+	case "temp":
+		s.kind = stepKindTemp
+	case "lib":
+		s.kind = stepKindLib
+	default:
+		s.kind = stepKindElement
+	}
+	s.name = token.TokenValue
+	s.token = token
+
+	// Get Values
+	token = parserNextToken(parser)
+	if s.kind == stepKindLib {
+		if sweepType != "lin" || token.TokenValue != "list" {
+			parserError(parser, token, "'%s lib' needs 'list <section> ...'", command.TokenValue)
+			return true, s
+		}
+		for {
+			token = parserNextToken(parser)
+			if token.TokenType != TokenStr {
+				break
+			}
+			s.values = append(s.values, float64(len(s.names)))
+			s.names = append(s.names, token.TokenValue)
+		}
+		if len(s.names) == 0 {
+			parserError(parser, token, "'%s' list needs at least one section", command.TokenValue)
+			return true, s
+		}
+		return parserCheckLineEnd(parser, token, command.TokenValue), s
+	}
+	if token.TokenValue == "list" {
+		for {
+			token = parserNextToken(parser)
+			if token.TokenType == TokenLineBreak {
+				break
+			}
+			err, value := parserParseNumber(token.TokenValue)
+			if err {
+				parserError(parser, token, "invalid step value '%s'", token.TokenValue)
+				return true, s
+			}
+			s.values = append(s.values, value)
+		}
+		if len(s.values) == 0 {
+			parserError(parser, token, "'%s' list needs at least one value", command.TokenValue)
+			return true, s
+		}
+		return false, s
+	}
+
+	numbers := make([]float64, 3)
+	startToken := token
+	for i, what := range []string{"start value", "stop value", "increment"} {
+		if i > 0 {
+			token = parserNextToken(parser)
+		}
+		if sweepType != "lin" && i == 2 {
+			what = "number of points"
+		}
+		if token.TokenType == TokenLineBreak {
+			parserError(parser, token, "missing %s", what)
+			return true, s
+		}
+		err := false
+		err, numbers[i] = parserParseNumber(token.TokenValue)
+		if err {
+			parserError(parser, token, "invalid %s '%s'", what, token.TokenValue)
+			return true, s
+		}
+	}
+	start, stop, increment := numbers[0], numbers[1], numbers[2]
+
+	if sweepType == "lin" && (increment == 0.0 || (stop-start)/increment < 0.0) {
+		parserError(parser, startToken, "the increment does not lead from %g to %g", start, stop)
+		return true, s
+	}
+	if sweepType != "lin" && (start <= 0.0 || stop < start || increment < 1) {
+		parserError(parser, startToken, "'%s %s' needs 0 < start <= stop and at least one point", command.TokenValue, sweepType)
+		return true, s
+	}
+
+	s.values = stepValues(sweepType, start, stop, increment)
+	return parserCheckLineEnd(parser, parserNextToken(parser), command.TokenValue), s
+}
+
+// parserCheckSteps checks that swept elements and sections exist and every expression can be evaluated with the
+// .param values and the first value of the stepped parameters and sections.
+func parserCheckSteps(parser *Parser, elementList *Element, params []paramDefinition, sweeps []stepSweep) {
+	overrides := make(map[string]float64)
+	swept := make(map[string]bool)
+	for _, s := range sweeps {
+		key := s.name
+		if s.kind == stepKindParam {
+			key = "param " + s.name
+			overrides[s.name] = s.values[0]
+		}
+		if swept[key] {
+			parserError(parser, s.token, "'%s' is stepped twice", s.name)
+		}
+		swept[key] = true
+
+		switch s.kind {
+		case stepKindElement:
+			e := elementListFindByLabel(elementList, s.name)
+			if e == nil {
+				parserError(parser, s.token, "element '%s' is not part of the circuit", s.name)
+			} else if !elementHasValue(e) {
+				parserError(parser, s.token, "element '%s' has no value to step", s.name)
+			} else if e.ElementType == ElementResistor {
+				for _, value := range s.values {
+					if value <= 0.0 {
+						parserError(parser, s.token, "resistor '%s' can not be stepped to %g", s.name, value)
+						break
 					}
 				}
 			}
+		case stepKindTemp:
+			for _, value := range s.values {
+				if value <= -temperatureZero {
+					parserError(parser, s.token, "temperature %g C is below absolute zero", value)
+					break
+				}
+			}
+		case stepKindLib:
+			for _, name := range s.names {
+				if _, exists := parser.lib.sections[name]; !exists {
+					parserError(parser, s.token, "section '%s' is not defined", name)
+					return
+				}
+			}
+		}
+	}
+
+	// The parameters of the first point, .lib sections included
+	point := make([]float64, len(sweeps))
+	for i, s := range sweeps {
+		point[i] = s.values[0]
+	}
+	params = libraryParams(params, librarySections(parser.lib, sweeps, point))
+
+	// Report every definition that can not be evaluated, going on with the others
+	values := make(map[string]float64)
+	for name, value := range overrides {
+		values[name] = value
+	}
+	for _, p := range params {
+		if _, stepped := overrides[p.name]; stepped {
+			continue
+		}
+		err, value := exprEvaluate(p.expression, exprScope{params: values, functions: monteCarloFunctions(nil)})
+		if err != "" {
+			parserError(parser, p.token, "%s", err)
+			continue
+		}
+		values[p.name] = value
+	}
+	for _, x := range parser.expressions {
+		if err, _ := exprEvaluate(x.token.TokenValue, exprScope{params: values, functions: monteCarloFunctions(nil)}); err != "" {
+			parserError(parser, x.token, "%s", err)
+		}
+	}
+}
+
+// parserParseTran parses ".tran <step> <stop> [<start>] [uic]", nothing being saved before the start time
+func parserParseTran(parser *Parser) (bool, float64, float64, float64, bool) {
+	command := parser.token
+
+	// Get Step and Stop Times
+	err, step := parserExpectNumber(parser, "time step")
+	if err {
+		return true, 0.0, 0.0, 0.0, false
+	}
+	stepToken := parser.token
+
+	err, stop := parserExpectNumber(parser, "stop time")
+	if err {
+		return true, 0.0, 0.0, 0.0, false
+	}
+
+	if step <= 0.0 || stop <= 0.0 {
+		parserError(parser, stepToken, "'.tran' needs positive step and stop times")
+		return true, 0.0, 0.0, 0.0, false
+	}
+	if step > stop {
+		parserWarning(parser, stepToken, "time step %g is larger than stop time %g", step, stop)
+	}
+
+	// Get Optional Start Time
+	start := 0.0
+	token := parserNextToken(parser)
+	if token.TokenType != TokenLineBreak && token.TokenValue != "uic" {
+		err, start = parserParseNumber(token.TokenValue)
+		if err {
+			parserError(parser, token, "invalid start time '%s'", token.TokenValue)
+			return true, 0.0, 0.0, 0.0, false
+		}
+		if start < 0.0 || start >= stop {
+			parserError(parser, token, "start time %g must be at least 0 and below the stop time %g", start, stop)
+			return true, 0.0, 0.0, 0.0, false
+		}
+		token = parserNextToken(parser)
+	}
+
+	// Get Optional "Use Initial Conditions"
+	uic := false
+	if token.TokenValue == "uic" {
+		uic = true
+		token = parserNextToken(parser)
+	}
+
+	return parserCheckLineEnd(parser, token, command.TokenValue), step, stop, start, uic
+}
+
+// parserParseTemp parses ".temp <temperature> ...", temperatures in C
+func parserParseTemp(parser *Parser, temperatures []float64) (bool, []float64) {
+	command := parser.token
+
+	for {
+		token := parserNextToken(parser)
+		if token.TokenType == TokenLineBreak {
+			if len(temperatures) == 0 {
+				parserError(parser, token, "'%s' needs at least one temperature", command.TokenValue)
+				return true, temperatures
+			}
+			return false, temperatures
+		}
+
+		err, temp := parserParseNumber(token.TokenValue)
+		if err {
+			parserError(parser, token, "invalid temperature '%s'", token.TokenValue)
+			return true, temperatures
+		}
+		if temp <= -temperatureZero {
+			parserError(parser, token, "temperature %g C is below absolute zero", temp)
+			return true, temperatures
+		}
+		temperatures = append(temperatures, temp)
+	}
+}
+
+// parserParseOptions parses ".options <key>[=<value>] ..."
+func parserParseOptions(parser *Parser, options *SimOptions) bool {
+	key := parserNextToken(parser)
+	for key.TokenType != TokenLineBreak {
+		if key.TokenType != TokenStr {
+			parserError(parser, key, "expected '<option>=<value>', found '%s'", key.TokenValue)
+			return true
+		}
+
+		// Flags may be given alone
+		value := "1"
+		valueToken := key
+		token := parserNextToken(parser)
+		if token.TokenType == TokenEqual {
+			valueToken = parserNextToken(parser)
+			if valueToken.TokenType != TokenStr {
+				parserError(parser, valueToken, "missing value of '%s'", key.TokenValue)
+				return true
+			}
+			value = valueToken.TokenValue
+			token = parserNextToken(parser)
+		} else if !optionsIsFlag(key.TokenValue) {
+			parserError(parser, token, "expected '=' after option '%s'", key.TokenValue)
+			return true
+		}
+
+		if optionsSet(options, key.TokenValue, value) {
+			parserError(parser, valueToken, "unknown option '%s' or invalid value '%s'", key.TokenValue, value)
+			return true
+		}
+		key = token
+	}
+
+	return false
+}
+
+// parserParseNodeVoltages parses the "v(<node>)=<value> ..." list of .ic and .nodeset
+func parserParseNodeVoltages(parser *Parser, voltages []parserNodeVoltage) (bool, []parserNodeVoltage) {
+	command := parser.token
+
+	for {
+		token := parserNextToken(parser)
+		if token.TokenType == TokenLineBreak {
+			if len(voltages) == 0 {
+				parserError(parser, token, "'%s' needs at least one 'v(<node>)=<value>'", command.TokenValue)
+				return true, voltages
+			}
+			return false, voltages
+		}
+
+		if token.TokenValue != "v" {
+			parserError(parser, token, "expected 'v(<node>)=<value>', found '%s'", token.TokenValue)
+			return true, voltages
+		}
+		if parserNextToken(parser).TokenType != TokenOpenParen {
+			parserError(parser, parser.token, "expected '(' after 'v'")
+			return true, voltages
+		}
+		node := parserNextToken(parser)
+		if node.TokenType != TokenStr {
+			parserError(parser, node, "expected a node name")
+			return true, voltages
+		}
+		if parserNextToken(parser).TokenType != TokenCloseParen {
+			parserError(parser, parser.token, "expected ')' after node '%s'", node.TokenValue)
+			return true, voltages
 		}
+		if parserNextToken(parser).TokenType != TokenEqual {
+			parserError(parser, parser.token, "expected '=' after 'v(%s)'", node.TokenValue)
+			return true, voltages
+		}
+		err, value := parserExpectNumber(parser, "voltage")
+		if err {
+			return true, voltages
+		}
+
+		voltages = append(voltages, parserNodeVoltage{node: node, value: value})
+	}
+}
+
+// parserResolveNodeVoltages maps the voltages of .ic or .nodeset to node numbers.
+func parserResolveNodeVoltages(parser *Parser, voltages []parserNodeVoltage) map[int]float64 {
+	resolved := make(map[int]float64)
+	for _, v := range voltages {
+		node, exists := parser.nodesMap[v.node.TokenValue]
+		if !exists {
+			parserError(parser, v.node, "node '%s' is not part of the circuit", v.node.TokenValue)
+		} else if node == 0 {
+			parserError(parser, v.node, "the ground node can not be given a voltage")
+		} else {
+			resolved[node] = v.value
+		}
+	}
+	return resolved
+}
+
+// parserParseACSweep parses "dec|oct|lin <points> <fstart> <fstop>", the end of the .ac, .noise, .sens or .stb
+// command.
+func parserParseACSweep(parser *Parser, command Token) (bool, acSweep) {
+	err, sweep := parserParseSweepRange(parser, parserNextToken(parser))
+	if err {
+		return true, sweep
+	}
+	return parserCheckLineEnd(parser, parserNextToken(parser), command.TokenValue), sweep
+}
+
+// parserParseSweepRange parses "dec|oct|lin <points> <fstart> <fstop>" starting at the given sweep type token.
+func parserParseSweepRange(parser *Parser, token Token) (bool, acSweep) {
+	var sweep acSweep
+
+	// Get Sweep Type
+	sweep.sweepType = token.TokenValue
+	if sweep.sweepType != "dec" && sweep.sweepType != "oct" && sweep.sweepType != "lin" {
+		parserError(parser, token, "AC sweep type must be dec, oct or lin")
+		return true, sweep
 	}
 
-	if opCommand {
-		mnaSolveLinear(elementList, nodesMap)
+	// Get Number of Points
+	err, points := parserExpectNumber(parser, "number of points")
+	if err {
+		return true, sweep
 	}
-	if tranCommand {
-		mnaSolveDynamic(elementList, nodesMap, tStep, tStop)
+	if points < 1 {
+		parserError(parser, parser.token, "AC sweep needs at least one point")
+		return true, sweep
 	}
+
+	// Get Start and Stop Frequencies
+	err, fStart := parserExpectNumber(parser, "start frequency")
+	if err {
+		return true, sweep
+	}
+	startToken := parser.token
+
+	err, fStop := parserExpectNumber(parser, "stop frequency")
+	if err {
+		return true, sweep
+	}
+
+	if fStop < fStart || (sweep.sweepType != "lin" && fStart <= 0) {
+		parserError(parser, startToken, "invalid AC frequency range")
+		return true, sweep
+	}
+
+	sweep.points = int(points)
+	sweep.fStart = fStart
+	sweep.fStop = fStop
+	return false, sweep
 }
 
-func parserParseElement(lexer *Lexer, elementArray string,
-	nodesMap map[string]int, nodesQuantity *int) (bool, *Element) {
+func parserParseElement(parser *Parser, label Token) (bool, *Element) {
 	var e = new(Element)
 	var err bool
-	var nodeToken Token
-	currentLine := lexer.lineNumber
+	var token Token
 
-	switch elementArray[0] {
+	switch label.TokenValue[0] {
 	case 'r':
 		e.ElementType = ElementResistor
 	case 'c':
@@ -120,518 +2082,594 @@ func parserParseElement(lexer *Lexer, elementArray string,
 		e.ElementType = ElementBJT
 	case 'm':
 		e.ElementType = ElementMOSFET
+	case 't':
+		e.ElementType = ElementTLine
+	case 'o':
+		e.ElementType = ElementLossyLine
+	case 'j':
+		e.ElementType = ElementJFET
+	case 'p':
+		e.ElementType = ElementProbe
+	case 'n':
+		e.ElementType = ElementNetwork
+	default:
+		parserError(parser, label, "unknown element type '%c' in '%s'", label.TokenValue[0], label.TokenValue)
+		return true, e
 	}
 
-	e.Label = elementArray
+	e.Label = label.TokenValue
 	e.Next = nil
 	e.PreserveCurrent = false
 
-	if e.ElementType == ElementResistor || e.ElementType == ElementCapacitor ||
-		e.ElementType == ElementInductor || e.ElementType == ElementDiode {
-		e.Nodes = make([]int, 2)
-
-		// Get First Node
-		nodeToken = LexerNextToken(lexer)
-		if lexer.eof || nodeToken.TokenType != TokenStr {
-			fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-			return true, e
-		}
-
-		nodeName := nodeToken.TokenValue
-		nodeNumber, exists := nodesMap[nodeName]
-
-		if exists {
-			e.Nodes[0] = nodeNumber
-		} else {
-			e.Nodes[0] = *nodesQuantity
-			nodesMap[nodeName] = *nodesQuantity
-			*nodesQuantity = *nodesQuantity + 1
-		}
+	if first, exists := parser.labels[e.Label]; exists {
+		parserError(parser, label, "duplicate element label '%s', first defined at line %d", e.Label, first.Line)
+	} else {
+		parser.labels[e.Label] = label
+	}
 
-		// Get Second Node
-		nodeToken = LexerNextToken(lexer)
-		if lexer.eof || nodeToken.TokenType != TokenStr {
-			fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
+	// Get Nodes
+	switch e.ElementType {
+	case ElementVCVS, ElementVCCS, ElementTLine, ElementLossyLine:
+		e.Nodes = make([]int, 4)
+	case ElementBJT, ElementMOSFET, ElementJFET:
+		e.Nodes = make([]int, 3)
+	case ElementNetwork:
+		// Two for each port, as many as the ports of its file
+		e.Nodes = make([]int, 0)
+	default:
+		e.Nodes = make([]int, 2)
+	}
+	for i := range e.Nodes {
+		err, e.Nodes[i] = parserParseNode(parser, e)
+		if err {
 			return true, e
 		}
+	}
 
-		nodeName = nodeToken.TokenValue
-		nodeNumber, exists = nodesMap[nodeName]
-
-		if exists {
-			e.Nodes[1] = nodeNumber
-		} else {
-			e.Nodes[1] = *nodesQuantity
-			nodesMap[nodeName] = *nodesQuantity
-			*nodesQuantity = *nodesQuantity + 1
+	switch e.ElementType {
+	case ElementResistor, ElementCapacitor, ElementInductor, ElementVoltageSource, ElementCurrentSource, ElementDiode,
+		ElementProbe:
+		if e.Nodes[0] == e.Nodes[1] {
+			parserError(parser, parser.token, "element '%s' has both terminals connected to node '%s'", e.Label,
+				parser.token.TokenValue)
 		}
+	}
 
+	switch e.ElementType {
+	case ElementResistor:
 		// Get Value
-		nodeToken = LexerNextToken(lexer)
-		err, e.Value = parserParseNumber(nodeToken.TokenValue)
-
-		if err {
-			fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
+		if parserExpectValue(parser, e) {
 			return true, e
 		}
+		if e.Expression == "" && e.Value <= 0.0 {
+			parserError(parser, parser.token, "resistor '%s' must have a positive value", e.Label)
+		}
 
-		// If the element is a capactor or an inductor, there is an optional parameter
-		if e.ElementType == ElementCapacitor ||
-			e.ElementType == ElementInductor {
-			// Get Value
-			nodeToken = LexerNextToken(lexer)
-			if nodeToken.TokenType != TokenLineBreak {
-				err, e.Extra = parserParseIC(nodeToken.TokenValue)
+		// Get Optional Temperature Parameters and Tolerances
+		token = parserNextToken(parser)
+		if token.TokenType != TokenLineBreak {
+			desc := &resistorDescriptor{nominal: e.Value}
+			e.Extra = desc
+			for token.TokenType != TokenLineBreak {
+				err, key, value := parserParseParameter(parser, token)
 				if err {
-					fmt.Fprintf(os.Stderr, "Parser Error: IC format error at line %d\n", currentLine)
 					return true, e
 				}
-			} else {
-				e.Extra = 0.0
+				switch key {
+				case "tc1":
+					desc.tc1 = value
+				case "tc2":
+					desc.tc2 = value
+				case "tce":
+					desc.tce = value
+				case "tol":
+					e.Tolerance.dev = value
+				case "lot":
+					e.Tolerance.lot = value
+				default:
+					if parserSetTemperature(parser, token, &desc.instanceTemperature, key, value) {
+						return true, e
+					}
+				}
+				token = parserNextToken(parser)
 			}
 		}
-	}
 
-	if e.ElementType == ElementVCCS || e.ElementType == ElementVCVS {
-		e.Nodes = make([]int, 4)
-
-		// Get First Node
-		nodeToken := LexerNextToken(lexer)
-		if lexer.eof || nodeToken.TokenType != TokenStr {
-			fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
+	case ElementVCVS, ElementVCCS:
+		// Get Value
+		if parserExpectValue(parser, e) {
 			return true, e
 		}
+		token = parserNextToken(parser)
 
-		nodeName := nodeToken.TokenValue
-		nodeNumber, exists := nodesMap[nodeName]
+	case ElementCapacitor, ElementInductor:
+		// Get Value
+		if parserExpectValue(parser, e) {
+			return true, e
+		}
 
-		if exists {
-			e.Nodes[0] = nodeNumber
-		} else {
-			e.Nodes[0] = *nodesQuantity
-			nodesMap[nodeName] = *nodesQuantity
-			*nodesQuantity = *nodesQuantity + 1
+		// Get Optional Initial Condition and Tolerances
+		e.Extra = nil
+		token = parserNextToken(parser)
+		for token.TokenType != TokenLineBreak {
+			err, key, value := parserParseParameter(parser, token)
+			if err {
+				return true, e
+			}
+			switch key {
+			case "ic":
+				e.Extra = value
+			case "tol":
+				e.Tolerance.dev = value
+			case "lot":
+				e.Tolerance.lot = value
+			default:
+				parserError(parser, token, "unknown parameter '%s'", key)
+				return true, e
+			}
+			token = parserNextToken(parser)
 		}
 
-		// Get Second Node
-		nodeToken = LexerNextToken(lexer)
-		if lexer.eof || nodeToken.TokenType != TokenStr {
-			fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
+	case ElementVoltageSource, ElementCurrentSource:
+		if parserParseSource(parser, e) {
 			return true, e
 		}
+		token = parser.token
 
-		nodeName = nodeToken.TokenValue
-		nodeNumber, exists = nodesMap[nodeName]
-
-		if exists {
-			e.Nodes[1] = nodeNumber
-		} else {
-			e.Nodes[1] = *nodesQuantity
-			nodesMap[nodeName] = *nodesQuantity
-			*nodesQuantity = *nodesQuantity + 1
+	case ElementCCVS, ElementCCCS:
+		// Get Control Element
+		token = parserNextToken(parser)
+		if token.TokenType != TokenStr {
+			parserError(parser, token, "element '%s' is missing its control element", e.Label)
+			return true, e
 		}
+		e.Extra = token.TokenValue
+		parser.controls = append(parser.controls, token)
 
-		// Get Third Node
-		nodeToken = LexerNextToken(lexer)
-		if lexer.eof || nodeToken.TokenType != TokenStr {
-			fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
+		// Get Value
+		if parserExpectValue(parser, e) {
 			return true, e
 		}
+		token = parserNextToken(parser)
 
-		nodeName = nodeToken.TokenValue
-		nodeNumber, exists = nodesMap[nodeName]
+	case ElementDiode, ElementBJT, ElementMOSFET:
+		// Get Model
+		token = parserNextToken(parser)
+		if token.TokenType != TokenStr {
+			parserError(parser, token, "element '%s' is missing its model", e.Label)
+			return true, e
+		}
+		e.Extra = token.TokenValue
+		parser.modelUses = append(parser.modelUses, token)
+		token = parserNextToken(parser)
 
-		if exists {
-			e.Nodes[2] = nodeNumber
-		} else {
-			e.Nodes[2] = *nodesQuantity
-			nodesMap[nodeName] = *nodesQuantity
-			*nodesQuantity = *nodesQuantity + 1
+	case ElementTLine:
+		if parserParseTLine(parser, e) {
+			return true, e
 		}
+		token = parser.token
 
-		// Get Fourth Node
-		nodeToken = LexerNextToken(lexer)
-		if lexer.eof || nodeToken.TokenType != TokenStr {
-			fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
+	case ElementLossyLine:
+		// Get Model
+		token = parserNextToken(parser)
+		if token.TokenType != TokenStr {
+			parserError(parser, token, "element '%s' is missing its model", e.Label)
 			return true, e
 		}
+		e.Extra = &ltraDescriptor{model: token.TokenValue}
+		parser.modelUses = append(parser.modelUses, token)
+		token = parserNextToken(parser)
 
-		nodeName = nodeToken.TokenValue
-		nodeNumber, exists = nodesMap[nodeName]
+	case ElementJFET:
+		// Get Model
+		token = parserNextToken(parser)
+		if token.TokenType != TokenStr {
+			parserError(parser, token, "element '%s' is missing its model", e.Label)
+			return true, e
+		}
+		desc := &jfetDescriptor{model: token.TokenValue, area: 1.0}
+		parser.modelUses = append(parser.modelUses, token)
+		e.Extra = desc
+
+		// Get Optional Area
+		token = parserNextToken(parser)
+		if token.TokenType != TokenLineBreak && token.TokenValue != "temp" && token.TokenValue != "dtemp" {
+			err, desc.area = parserParseNumber(token.TokenValue)
+			if err || desc.area <= 0.0 {
+				parserError(parser, token, "invalid area '%s'", token.TokenValue)
+				return true, e
+			}
+			token = parserNextToken(parser)
+		}
 
-		if exists {
-			e.Nodes[3] = nodeNumber
-		} else {
-			e.Nodes[3] = *nodesQuantity
-			nodesMap[nodeName] = *nodesQuantity
-			*nodesQuantity = *nodesQuantity + 1
+		// Get Optional Temperature
+		for token.TokenType != TokenLineBreak {
+			err, key, value := parserParseParameter(parser, token)
+			if err || parserSetTemperature(parser, token, &desc.instanceTemperature, key, value) {
+				return true, e
+			}
+			token = parserNextToken(parser)
 		}
 
-		// Get Value
-		nodeToken = LexerNextToken(lexer)
-		err, e.Value = parserParseNumber(nodeToken.TokenValue)
+	case ElementProbe:
+		// A probe has no value, it is a short circuit where a loop is broken by .stb
+		token = parserNextToken(parser)
 
-		if err {
-			fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
+	case ElementNetwork:
+		if parserParseNetwork(parser, e) {
 			return true, e
 		}
+		token = parser.token
 	}
 
-	if e.ElementType == ElementVoltageSource ||
-		e.ElementType == ElementCurrentSource {
-		e.Nodes = make([]int, 2)
-
-		// Get First Node
-		nodeToken = LexerNextToken(lexer)
-		if lexer.eof || nodeToken.TokenType != TokenStr {
-			fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-			return true, e
-		}
+	return parserCheckLineEnd(parser, token, e.Label), e
+}
 
-		nodeName := nodeToken.TokenValue
-		nodeNumber, exists := nodesMap[nodeName]
+// parserParseSource parses "[dc] <value> | sin(...) | pwl(...)" followed by an optional "ac <mag> [<phase>]".
+// The token after the source specification is left in parser.token.
+func parserParseSource(parser *Parser, e *Element) bool {
+	token := parserNextToken(parser)
 
-		if exists {
-			e.Nodes[0] = nodeNumber
-		} else {
-			e.Nodes[0] = *nodesQuantity
-			nodesMap[nodeName] = *nodesQuantity
-			*nodesQuantity = *nodesQuantity + 1
-		}
+	// The "dc" keyword is optional before a constant value
+	if token.TokenValue == "dc" {
+		token = parserNextToken(parser)
+	}
 
-		// Get Second Node
-		nodeToken = LexerNextToken(lexer)
-		if lexer.eof || nodeToken.TokenType != TokenStr {
-			fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-			return true, e
-		}
+	if token.TokenType == TokenLineBreak {
+		parserError(parser, token, "source '%s' is missing its value", e.Label)
+		return true
+	}
 
-		nodeName = nodeToken.TokenValue
-		nodeNumber, exists = nodesMap[nodeName]
+	// Small-signal only source
+	if token.TokenValue == "ac" {
+		e.Extra = nil
+		e.Value = 0.0
+		return parserParseAC(parser, e)
+	}
 
-		if exists {
-			e.Nodes[1] = nodeNumber
+	if token.TokenValue == "sin" {
+		err, values := parserParseWaveform(parser, token)
+		if err {
+			return true
+		}
+		if len(values) != 4 {
+			parserError(parser, token, "sin waveform needs 4 values (v0 va freq td), found %d", len(values))
+			return true
+		}
+		e.Extra = sinDescriptor{v0: values[0], va: values[1], freq: values[2], td: values[3]}
+	} else if token.TokenValue == "pwl" {
+		err, values := parserParseWaveform(parser, token)
+		if err {
+			return true
+		}
+		if len(values) == 0 || len(values)%2 != 0 {
+			parserError(parser, token, "pwl waveform needs time/value pairs")
+			return true
+		}
+		ar := make([]pwlDescriptor, 0)
+		for i := 0; i < len(values); i += 2 {
+			ar = append(ar, pwlDescriptor{t: values[i], x: values[i+1]})
+		}
+		e.Extra = ar
+	} else {
+		var err bool
+		e.Extra = nil
+		if exprIsExpression(token.TokenValue) {
+			e.Expression = token.TokenValue
+			parser.expressions = append(parser.expressions, parserExpression{token: token, element: e})
 		} else {
-			e.Nodes[1] = *nodesQuantity
-			nodesMap[nodeName] = *nodesQuantity
-			*nodesQuantity = *nodesQuantity + 1
+			err, e.Value = parserParseNumber(token.TokenValue)
+			if err {
+				parserError(parser, token, "invalid value '%s'", token.TokenValue)
+				return true
+			}
 		}
+	}
 
-		// Get Value
-		nodeToken = LexerNextToken(lexer)
+	// Optional small-signal specification after the large-signal value
+	token = parserNextToken(parser)
+	if token.TokenValue == "ac" {
+		return parserParseAC(parser, e)
+	}
+	return false
+}
 
-		switch nodeToken.TokenValue[0] {
-		case 's':
-			desc := sinDescriptor{}
-			if nodeToken.TokenValue[:3] != "sin" {
-				fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-				return true, e
-			}
-			if len(nodeToken.TokenValue) > 3 {
-				if nodeToken.TokenValue[3] != '(' {
-					fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-					return true, e
-				}
-				if len(nodeToken.TokenValue) > 4 {
-					err, desc.v0 = parserParseNumber(nodeToken.TokenValue[4:])
-					if err {
-						fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-						return true, e
-					}
-				} else {
-					nodeToken = LexerNextToken(lexer)
-					err, desc.v0 = parserParseNumber(nodeToken.TokenValue)
-					if err {
-						fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-						return true, e
-					}
-				}
-			} else {
-				nodeToken = LexerNextToken(lexer)
-				if nodeToken.TokenValue[0] != '(' {
-					fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-					return true, e
-				}
-				if len(nodeToken.TokenValue) > 1 {
-					err, desc.v0 = parserParseNumber(nodeToken.TokenValue[1:])
-					if err {
-						fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-						return true, e
-					}
-				} else {
-					nodeToken = LexerNextToken(lexer)
-					err, desc.v0 = parserParseNumber(nodeToken.TokenValue)
-					if err {
-						fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-						return true, e
-					}
-				}
-			}
+// parserParseWaveform collects the numbers of "sin(...)" or "pwl(...)", optionally separated by commas.
+func parserParseWaveform(parser *Parser, function Token) (bool, []float64) {
+	values := make([]float64, 0)
 
-			nodeToken = LexerNextToken(lexer)
-			err, desc.va = parserParseNumber(nodeToken.TokenValue)
-			if err {
-				fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-				return true, e
-			}
+	token := parserNextToken(parser)
+	if token.TokenType != TokenOpenParen {
+		parserError(parser, token, "expected '(' after '%s'", function.TokenValue)
+		return true, values
+	}
 
-			nodeToken = LexerNextToken(lexer)
-			err, desc.freq = parserParseNumber(nodeToken.TokenValue)
+	for {
+		token = parserNextToken(parser)
+		switch token.TokenType {
+		case TokenCloseParen:
+			return false, values
+		case TokenComma:
+			continue
+		case TokenStr:
+			err, value := parserParseNumber(token.TokenValue)
 			if err {
-				fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-				return true, e
+				parserError(parser, token, "invalid waveform value '%s'", token.TokenValue)
+				return true, values
 			}
+			values = append(values, value)
+		default:
+			parserError(parser, function, "missing ')' in waveform of '%s'", function.TokenValue)
+			return true, values
+		}
+	}
+}
 
-			nodeToken = LexerNextToken(lexer)
-			if nodeToken.TokenValue[len(nodeToken.TokenValue)-1] != ')' {
-				err, desc.td = parserParseNumber(nodeToken.TokenValue)
-				if err {
-					fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-					return true, e
-				}
+// parserParseTLine parses "z0=<impedance>" and either "td=<delay>" or "f=<frequency> [nl=<length>]".
+// The line break after the parameters is left in parser.token.
+func parserParseTLine(parser *Parser, e *Element) bool {
+	desc := &tlineDescriptor{}
+	freq := 0.0
+	nl := 0.25
+	for {
+		token := parserNextToken(parser)
+		if token.TokenType == TokenLineBreak {
+			break
+		}
 
-				nodeToken = LexerNextToken(lexer)
-				if nodeToken.TokenValue != ")" {
-					fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-					return true, e
-				}
-			} else {
-				err, desc.td = parserParseNumber(nodeToken.TokenValue[:len(nodeToken.TokenValue)-1])
-				if err {
-					fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-					return true, e
-				}
-			}
-			e.Extra = desc
-		case 'p':
-			ar := make([]pwlDescriptor, 0)
-			desc := pwlDescriptor{}
-			if nodeToken.TokenValue[:3] != "pwl" {
-				fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-				return true, e
-			}
-			if len(nodeToken.TokenValue) > 3 {
-				if nodeToken.TokenValue[3] != '(' {
-					fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-					return true, e
-				}
-				if len(nodeToken.TokenValue) > 4 {
-					err, desc.t = parserParseNumber(nodeToken.TokenValue[4:])
-					if err {
-						fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-						return true, e
-					}
-				} else {
-					nodeToken = LexerNextToken(lexer)
-					err, desc.t = parserParseNumber(nodeToken.TokenValue)
-					if err {
-						fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-						return true, e
-					}
-				}
-			} else {
-				nodeToken = LexerNextToken(lexer)
-				if nodeToken.TokenValue[0] != '(' {
-					fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-					return true, e
-				}
-				if len(nodeToken.TokenValue) > 1 {
-					err, desc.t = parserParseNumber(nodeToken.TokenValue[1:])
-					if err {
-						fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-						return true, e
-					}
-				} else {
-					nodeToken = LexerNextToken(lexer)
-					err, desc.t = parserParseNumber(nodeToken.TokenValue)
-					if err {
-						fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-						return true, e
-					}
-				}
-			}
+		err, key, value := parserParseParameter(parser, token)
+		if err {
+			return true
+		}
 
-			nodeToken = LexerNextToken(lexer)
-			if nodeToken.TokenValue[len(nodeToken.TokenValue)-1] != ')' {
-				err, desc.x = parserParseNumber(nodeToken.TokenValue)
-				if err {
-					fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-					return true, e
-				}
-				ar = append(ar, desc)
+		switch key {
+		case "z0", "zo":
+			desc.z0 = value
+		case "td":
+			desc.td = value
+		case "f":
+			freq = value
+		case "nl":
+			nl = value
+		default:
+			parserError(parser, token, "unknown transmission line parameter '%s'", key)
+			return true
+		}
+	}
 
-				for {
-					nodeToken = LexerNextToken(lexer)
-					if nodeToken.TokenValue == ")" {
-						break
-					}
-					err, desc.t = parserParseNumber(nodeToken.TokenValue)
-					if err {
-						fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-						return true, e
-					}
+	if desc.td == 0.0 && freq > 0.0 {
+		desc.td = nl / freq
+	}
 
-					nodeToken = LexerNextToken(lexer)
-					if nodeToken.TokenValue[len(nodeToken.TokenValue)-1] != ')' {
-						err, desc.x = parserParseNumber(nodeToken.TokenValue)
-						if err {
-							fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-							return true, e
-						}
-						ar = append(ar, desc)
-					} else {
-						err, desc.x = parserParseNumber(nodeToken.TokenValue[:len(nodeToken.TokenValue)-1])
-						if err {
-							fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-							return true, e
-						}
-						ar = append(ar, desc)
-						break
-					}
-				}
-			} else {
-				err, desc.x = parserParseNumber(nodeToken.TokenValue[:len(nodeToken.TokenValue)-1])
-				if err {
-					fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-					return true, e
-				}
-				ar = append(ar, desc)
-			}
+	if desc.z0 <= 0.0 || desc.td <= 0.0 {
+		parserError(parser, parser.token, "transmission line '%s' needs positive z0 and td (or f)", e.Label)
+		return true
+	}
 
-			e.Extra = ar
-		default:
-			e.Extra = nil
-			err, e.Value = parserParseNumber(nodeToken.TokenValue)
+	e.Extra = desc
+	return false
+}
 
-			if err {
-				fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-				return true, e
-			}
-		}
+// parserParseNetwork parses "<p1+> <p1-> ... <pN+> <pN-> file=<touchstone file>" of an N-port, two nodes for each
+// port of the file. File names are relative to the netlist. The token after the file is left in parser.token.
+func parserParseNetwork(parser *Parser, e *Element) bool {
+	token := parserNextToken(parser)
+	nodes := make([]Token, 0)
+	for token.TokenType == TokenStr && token.TokenValue != "file" {
+		nodes = append(nodes, token)
+		token = parserNextToken(parser)
+	}
+	if token.TokenValue != "file" || parserNextToken(parser).TokenType != TokenEqual {
+		parserError(parser, token, "element '%s' needs its ports and 'file=<touchstone file>'", e.Label)
+		return true
+	}
+	file := parserNextToken(parser)
+	if file.TokenType != TokenStr {
+		parserError(parser, file, "expected a Touchstone file name, found '%s'", file.TokenValue)
+		return true
+	}
+	path := strings.Trim(lexerLexeme(&parser.lexer, file), "'\"")
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(file.File), path)
 	}
 
-	if e.ElementType == ElementCCVS || e.ElementType == ElementCCCS {
-		e.Nodes = make([]int, 2)
+	err, data := touchstoneRead(path)
+	if err != "" {
+		parserError(parser, file, "Touchstone file '%s': %s", path, err)
+		return true
+	}
+	if len(nodes) != 2*data.ports {
+		parserError(parser, file, "element '%s' has %d nodes, but '%s' describes a %d-port", e.Label, len(nodes), path,
+			data.ports)
+		return true
+	}
+	for _, node := range nodes {
+		e.Nodes = append(e.Nodes, parserAddNode(parser, node))
+	}
+	e.Extra = &touchstoneDescriptor{path: path, data: data}
 
-		// Get First Node
-		nodeToken := LexerNextToken(lexer)
-		if lexer.eof || nodeToken.TokenType != TokenStr {
-			fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-			return true, e
-		}
+	parserNextToken(parser)
+	return false
+}
 
-		nodeName := nodeToken.TokenValue
-		nodeNumber, exists := nodesMap[nodeName]
+// parserParseModel parses ".model <name> <type> [(] <key>=<value> ... [)]"
+func parserParseModel(parser *Parser) (bool, *Model) {
+	model := &Model{Params: make(map[string]float64), Tolerances: make(map[string]tolerance)}
 
-		if exists {
-			e.Nodes[0] = nodeNumber
-		} else {
-			e.Nodes[0] = *nodesQuantity
-			nodesMap[nodeName] = *nodesQuantity
-			*nodesQuantity = *nodesQuantity + 1
-		}
+	// Get Name
+	token := parserNextToken(parser)
+	if token.TokenType != TokenStr {
+		parserError(parser, token, "'.model' needs a name and a type")
+		return true, model
+	}
+	model.Name = token.TokenValue
 
-		// Get Second Node
-		nodeToken = LexerNextToken(lexer)
-		if lexer.eof || nodeToken.TokenType != TokenStr {
-			fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-			return true, e
-		}
+	// Get Type
+	token = parserNextToken(parser)
+	if token.TokenType != TokenStr {
+		parserError(parser, token, "'.model' needs a name and a type")
+		return true, model
+	}
+	model.ModelType = token.TokenValue
 
-		nodeName = nodeToken.TokenValue
-		nodeNumber, exists = nodesMap[nodeName]
+	// Get Parameters, optionally enclosed in parentheses
+	last := ""
+	for {
+		token = parserNextToken(parser)
+		switch token.TokenType {
+		case TokenLineBreak:
+			return false, model
+		case TokenOpenParen, TokenCloseParen, TokenComma:
+			continue
+		}
 
-		if exists {
-			e.Nodes[1] = nodeNumber
-		} else {
-			e.Nodes[1] = *nodesQuantity
-			nodesMap[nodeName] = *nodesQuantity
-			*nodesQuantity = *nodesQuantity + 1
+		err, key, value := parserParseParameter(parser, token)
+		if err {
+			return true, model
 		}
 
-		// Get Control Element
-		nodeToken = LexerNextToken(lexer)
-		if lexer.eof || nodeToken.TokenType != TokenStr {
-			fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-			return true, e
+		// "dev=" and "lot=" give the tolerance of the parameter before them
+		if key == "dev" || key == "lot" {
+			if last == "" {
+				parserError(parser, token, "'%s' must follow the parameter it applies to", key)
+				return true, model
+			}
+			t := model.Tolerances[last]
+			if key == "dev" {
+				t.dev = value
+			} else {
+				t.lot = value
+			}
+			model.Tolerances[last] = t
+			continue
 		}
+		if key == "tol" {
+			parserError(parser, token, "model parameters take 'dev' and 'lot' tolerances")
+			return true, model
+		}
+		model.Params[key] = value
+		last = key
+	}
+}
 
-		nodeName = nodeToken.TokenValue
-		e.Extra = nodeName
+func parserParseNode(parser *Parser, e *Element) (bool, int) {
+	token := parserNextToken(parser)
+	if token.TokenType != TokenStr {
+		parserError(parser, token, "element '%s' needs %d nodes", e.Label, len(e.Nodes))
+		return true, 0
+	}
+	return false, parserAddNode(parser, token)
+}
 
-		// Get Value
-		nodeToken = LexerNextToken(lexer)
-		err, e.Value = parserParseNumber(nodeToken.TokenValue)
+// parserAddNode returns the number of the node named by token, numbering it when it is new.
+func parserAddNode(parser *Parser, token Token) int {
+	nodeName := token.TokenValue
+	nodeNumber, exists := parser.nodesMap[nodeName]
 
-		if err {
-			fmt.Fprintf(os.Stderr, "Parser Error: Number format error at line %d\n", currentLine)
-			return true, e
-		}
+	if !exists {
+		nodeNumber = parser.nodesQuantity
+		parser.nodesMap[nodeName] = parser.nodesQuantity
+		parser.nodesQuantity = parser.nodesQuantity + 1
 	}
+	parser.nodeRefs[nodeName] = append(parser.nodeRefs[nodeName], token)
 
-	if e.ElementType == ElementBJT || e.ElementType == ElementMOSFET {
-		e.Nodes = make([]int, 3)
+	return nodeNumber
+}
 
-		// Get First Node
-		nodeToken := LexerNextToken(lexer)
-		if lexer.eof || nodeToken.TokenType != TokenStr {
-			fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-			return true, e
-		}
+// parserParseParameter parses "<key> = <value>" starting at the given key token. Tolerances (tol, dev and lot)
+// may be given in percent.
+func parserParseParameter(parser *Parser, key Token) (bool, string, float64) {
+	if key.TokenType != TokenStr {
+		parserError(parser, key, "expected '<parameter>=<value>', found '%s'", key.TokenValue)
+		return true, "", 0.0
+	}
 
-		nodeName := nodeToken.TokenValue
-		nodeNumber, exists := nodesMap[nodeName]
+	token := parserNextToken(parser)
+	if token.TokenType != TokenEqual {
+		parserError(parser, token, "expected '=' after parameter '%s'", key.TokenValue)
+		return true, "", 0.0
+	}
 
-		if exists {
-			e.Nodes[0] = nodeNumber
-		} else {
-			e.Nodes[0] = *nodesQuantity
-			nodesMap[nodeName] = *nodesQuantity
-			*nodesQuantity = *nodesQuantity + 1
+	if parserIsTolerance(key.TokenValue) {
+		token = parserNextToken(parser)
+		err, value := parserParseTolerance(token.TokenValue)
+		if err {
+			parserError(parser, token, "invalid tolerance '%s'", token.TokenValue)
 		}
+		return err, key.TokenValue, value
+	}
 
-		// Get Second Node
-		nodeToken = LexerNextToken(lexer)
-		if lexer.eof || nodeToken.TokenType != TokenStr {
-			fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-			return true, e
-		}
+	err, value := parserExpectNumber(parser, "value of '"+key.TokenValue+"'")
+	return err, key.TokenValue, value
+}
 
-		nodeName = nodeToken.TokenValue
-		nodeNumber, exists = nodesMap[nodeName]
+func parserIsTolerance(key string) bool {
+	return key == "tol" || key == "dev" || key == "lot"
+}
 
-		if exists {
-			e.Nodes[1] = nodeNumber
-		} else {
-			e.Nodes[1] = *nodesQuantity
-			nodesMap[nodeName] = *nodesQuantity
-			*nodesQuantity = *nodesQuantity + 1
-		}
+// parserParseTolerance parses a relative tolerance, "5%" or "0.05".
+func parserParseTolerance(value string) (bool, float64) {
+	scale := 1.0
+	if strings.HasSuffix(value, "%") {
+		value = strings.TrimSuffix(value, "%")
+		scale = 0.01
+	}
+	err, tolerance := parserParseNumber(value)
+	if err || tolerance < 0.0 {
+		return true, 0.0
+	}
+	return false, tolerance * scale
+}
 
-		// Get Third Node
-		nodeToken = LexerNextToken(lexer)
-		if lexer.eof || nodeToken.TokenType != TokenStr {
-			fmt.Fprintf(os.Stderr, "Parser Error: Element format error at line %d\n", currentLine)
-			return true, e
+// parserSetTemperature assigns a "temp" or "dtemp" instance parameter, reporting any other key.
+func parserSetTemperature(parser *Parser, token Token, instance *instanceTemperature, key string, value float64) bool {
+	switch key {
+	case "temp":
+		if value <= -temperatureZero {
+			parserError(parser, token, "temperature %g C is below absolute zero", value)
+			return true
 		}
+		instance.temp = value
+		instance.tempGiven = true
+	case "dtemp":
+		instance.dtemp = value
+	default:
+		parserError(parser, token, "unknown parameter '%s'", key)
+		return true
+	}
+	return false
+}
 
-		nodeName = nodeToken.TokenValue
-		nodeNumber, exists = nodesMap[nodeName]
+// parserParseAC parses "<mag> [<phase>]" after the "ac" keyword of a source.
+// The token after the specification is left in parser.token.
+func parserParseAC(parser *Parser, e *Element) bool {
+	var err bool
+	magnitude := 1.0
+	phase := 0.0
 
-		if exists {
-			e.Nodes[2] = nodeNumber
-		} else {
-			e.Nodes[2] = *nodesQuantity
-			nodesMap[nodeName] = *nodesQuantity
-			*nodesQuantity = *nodesQuantity + 1
+	// Get Magnitude
+	token := parserNextToken(parser)
+	if token.TokenType != TokenLineBreak {
+		err, magnitude = parserParseNumber(token.TokenValue)
+		if err {
+			parserError(parser, token, "invalid ac magnitude '%s'", token.TokenValue)
+			return true
 		}
 
-		// Get Model
-		nodeToken = LexerNextToken(lexer)
-		e.Extra = nodeToken.TokenValue
+		// Get Phase (degrees)
+		token = parserNextToken(parser)
+		if token.TokenType != TokenLineBreak {
+			err, phase = parserParseNumber(token.TokenValue)
+			if err {
+				parserError(parser, token, "invalid ac phase '%s'", token.TokenValue)
+				return true
+			}
+			parserNextToken(parser)
+		}
 	}
 
-	return false, e
+	e.AC = cmplx.Rect(magnitude, phase*math.Pi/180.0)
+	return false
 }
 
 func parserParseNumber(numberValue string) (bool, float64) {
@@ -847,11 +2885,3 @@ func parserPrintNodesMap(nodesMap map[string]int) {
 		fmt.Printf("\t%s -> %d\n", k, v)
 	}
 }
-
-func parserParseIC(icString string) (bool, float64) {
-	if icString[:3] != "ic=" {
-		return true, 0.0
-	}
-
-	return parserParseNumber(icString[3:])
-}
@@ -0,0 +1,446 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"text/tabwriter"
+)
+
+const (
+	pssPoints            = 100  // time steps of a period when not given
+	pssDrivenPeriods     = 1    // periods of transient before shooting a driven circuit, when not given
+	pssOscillatorPeriods = 50   // periods of transient before shooting an oscillator, long enough for it to start
+	pssIterations        = 50   // shooting iterations before giving up
+	pssDelta             = 1e-6 // relative change of the time step when differentiating the stamps
+)
+
+// periodicSteadyState is a .pss line: the steady state of a circuit driven at a fundamental frequency, or of an
+// oscillator whose frequency is only guessed
+type periodicSteadyState struct {
+	frequency float64 // fundamental, or first guess for an oscillator
+	outputs   []outputVariable
+	points    int    // time steps of a period
+	periods   int    // periods of transient before shooting
+	osc       string // node of an oscillator, whose voltage fixes the phase of the waveform; empty when driven
+	token     Token
+}
+
+// pssIteration is one shooting iteration: how far the solution is from coming back to itself after a period
+type pssIteration struct {
+	period  float64
+	newton  bool    // reached by a Newton-Raphson step, rather than by a period of transient
+	voltage float64 // largest mismatch of a node voltage
+	current float64 // largest mismatch of a branch current
+}
+
+// pssWaveforms collects the steady-state waveforms of every run, one plot for each output of each .pss
+type pssWaveforms struct {
+	names  []string
+	curves map[string][]graphValues
+}
+
+// pssRun finds the periodic steady state of every .pss with the shooting method. After a few periods of transient,
+// Newton-Raphson adjusts the solution x at the start of a period until one period of transient brings it back:
+// x(T) - x = 0. Its Jacobian M - I needs the monodromy matrix M = dx(T)/dx, the product over the time steps of
+// J^-1 D, where J is the linearized system of a step and D tells how the right-hand side of the step depends on the
+// solution of the step before. For an oscillator the period is unknown as well: the voltage of its node is held at
+// the start of the period, and its equation is traded for the period. Returns the frequency found for each
+// oscillator.
+func pssRun(psss []periodicSteadyState, elementList *Element, nodesMap map[string]int, conditions mnaConditions,
+	options SimOptions, label string, plots *pssWaveforms) []outputScalar {
+	conditions.quiet = true
+	scalars := make([]outputScalar, 0)
+	for _, p := range psss {
+		mnaIdentifyGroups(elementList)
+		currentNodes := assignIndicesToCurrentNodes(elementList, nodesMap)
+		size := len(nodesMap) + len(currentNodes) - 1
+		staticH := make([][]float64, size)
+		for i := range staticH {
+			staticH[i] = make([]float64, size)
+		}
+		staticB := make([]float64, size)
+		mnaBuildStaticMatrices(elementList, currentNodes, staticH, staticB)
+
+		// Settle with a plain transient, driven circuits starting a period where it ends
+		period := 1.0 / p.frequency
+		tStep := period / float64(p.points)
+		X0, state := mnaTransientStart(elementList, currentNodes, size, conditions, options)
+		T, X := []float64{0.0}, [][]float64{X0}
+		var system mnaTransientSystem
+		for k := 1; k <= p.periods*p.points; k++ {
+			t := float64(k) * tStep
+			newX, _, converged := mnaTransientStep(elementList, currentNodes, staticH, staticB, t, X[len(X)-1], tStep,
+				state, options, &system)
+			if !converged {
+				fmt.Fprintf(os.Stderr, "PSS Error: Settling transient did not converge at t = %g\n", t)
+				os.Exit(1)
+			}
+			T, X = append(T, t), append(X, newX)
+			mnaUpdateHistory(elementList, currentNodes, t, newX)
+		}
+		X0 = append([]float64(nil), X[len(X)-1]...)
+
+		node := -1
+		if p.osc != "" {
+			node = nodesMap[p.osc] - 1
+			var oscillates bool
+			oscillates, period, X0 = pssOscillation(T, X, node, options)
+			if !oscillates {
+				fmt.Fprintf(os.Stderr, "PSS Error: v(%s) does not oscillate after %d period(s) of %g Hz\n", p.osc,
+					p.periods, p.frequency)
+				os.Exit(1)
+			}
+		}
+
+		// Newton-Raphson, falling back on a period of transient from the solution a step was taken from when the step
+		// makes the error, relative to the tolerances, grow
+		iterations := make([]pssIteration, 0)
+		var orbit, M [][]float64
+		var dT, lastXT []float64
+		lastPeriod, lastError, newton := period, math.Inf(1), false
+		fallBack := func() {
+			X0 = append([]float64(nil), lastXT...)
+			period, lastError, newton = lastPeriod, math.Inf(1), false
+		}
+		for {
+			converged := false
+			orbit, M, dT, converged = pssShoot(elementList, currentNodes, staticH, staticB, X0, period, p.points,
+				node >= 0, state, options)
+			if !converged && newton {
+				fallBack()
+				continue
+			}
+			if !converged {
+				fmt.Fprintf(os.Stderr, "PSS Error: Transient of shooting iteration %d did not converge\n",
+					len(iterations)+1)
+				os.Exit(1)
+			}
+
+			// The equations x(T) - x = 0, with the tolerances of Newton-Raphson relative to the peak over the period
+			XT := orbit[len(orbit)-1]
+			peak := make([]float64, size)
+			for _, x := range orbit {
+				for i := range peak {
+					peak[i] = math.Max(peak[i], math.Abs(x[i]))
+				}
+			}
+			R := make([]float64, size)
+			iteration := pssIteration{period: period, newton: newton}
+			worst, sum := 0.0, 0.0
+			for i := range R {
+				R[i] = XT[i] - X0[i]
+				absTol := options.VNTol
+				if i >= size-len(currentNodes) {
+					absTol = options.AbsTol
+					iteration.current = math.Max(iteration.current, math.Abs(R[i]))
+				} else {
+					iteration.voltage = math.Max(iteration.voltage, math.Abs(R[i]))
+				}
+				r := math.Abs(R[i]) / (options.RelTol*peak[i] + absTol)
+				worst = math.Max(worst, r)
+				sum = sum + r*r
+			}
+			iterations = append(iterations, iteration)
+			if worst <= 1.0 {
+				break
+			}
+			if len(iterations) == pssIterations {
+				fmt.Fprintf(os.Stderr, "PSS Error: Shooting did not converge after %d iterations\n", pssIterations)
+				os.Exit(1)
+			}
+			if sum > lastError {
+				fallBack()
+				continue
+			}
+			lastXT, lastPeriod, lastError, newton = append([]float64(nil), XT...), period, sum, true
+
+			// (M - I) dx = -(x(T) - x), the column of the held node taken by the period of an oscillator
+			for i := range M {
+				M[i][i] -= 1.0
+				R[i] = -R[i]
+				if node >= 0 {
+					M[i][node] = dT[i]
+				}
+			}
+			delta := mnaSolveSystem(M, R)
+			for i := range delta {
+				if math.IsNaN(delta[i]) || math.IsInf(delta[i], 0) {
+					fmt.Fprintf(os.Stderr, "PSS Error: Singular shooting Jacobian at iteration %d\n", len(iterations))
+					os.Exit(1)
+				}
+				if i == node {
+					period = period + delta[i]
+				} else {
+					X0[i] = X0[i] + delta[i]
+				}
+			}
+			if period <= 0.0 {
+				fallBack()
+			}
+		}
+
+		times := make([]float64, len(orbit))
+		for k := range times {
+			times[k] = float64(k) * period / float64(p.points)
+		}
+		values := make([][]float64, len(p.outputs))
+		for i, o := range p.outputs {
+			values[i] = make([]float64, len(orbit))
+			for k := range orbit {
+				values[i][k] = outputValue(o, elementList, orbit[k], nodesMap, currentNodes)
+			}
+		}
+		pssPrint(p, period, p.periods*p.points, iterations, times, values, options.NumDgt)
+
+		if node >= 0 {
+			scalars = append(scalars, outputScalar{"frequency of v(" + p.osc + ")", 1.0 / period})
+		}
+		if plots.curves == nil {
+			plots.curves = make(map[string][]graphValues)
+		}
+		for i, o := range p.outputs {
+			name := "pss_" + graphFileName(outputName(o))
+			if _, exists := plots.curves[name]; !exists {
+				plots.names = append(plots.names, name)
+			}
+			plots.curves[name] = append(plots.curves[name], graphValues{name: label, t: times, v: values[i]})
+		}
+	}
+	return scalars
+}
+
+// pssOscillation measures the period of an oscillation from the upward crossings of node through the middle of its
+// swing, over the last half of the transient. A swing within the tolerance of Newton-Raphson is no oscillation. It
+// returns the period of the last cycle and the solution at its last crossing, interpolated so the node is exactly at
+// the middle of its swing.
+func pssOscillation(T []float64, X [][]float64, node int, options SimOptions) (bool, float64, []float64) {
+	from := len(T) / 2
+	low, high := math.Inf(1), math.Inf(-1)
+	for k := from; k < len(T); k++ {
+		low, high = math.Min(low, X[k][node]), math.Max(high, X[k][node])
+	}
+	if high-low <= options.RelTol*math.Max(math.Abs(low), math.Abs(high))+options.VNTol {
+		return false, 0.0, nil
+	}
+	level := (low + high) / 2.0
+
+	crossings := make([]float64, 0)
+	var start []float64
+	for k := from + 1; k < len(T); k++ {
+		if X[k-1][node] < level && X[k][node] >= level {
+			r := (level - X[k-1][node]) / (X[k][node] - X[k-1][node])
+			crossings = append(crossings, T[k-1]+r*(T[k]-T[k-1]))
+			start = make([]float64, len(X[k]))
+			for i := range start {
+				start[i] = X[k-1][i] + r*(X[k][i]-X[k-1][i])
+			}
+			start[node] = level
+		}
+	}
+	if len(crossings) < 2 {
+		return false, 0.0, nil
+	}
+	return true, crossings[len(crossings)-1] - crossings[len(crossings)-2], start
+}
+
+// pssShoot runs one period of transient in steps from X0 and returns the solution at every step with the monodromy
+// matrix. With period, it also returns the derivative of the solution at the end of the period with respect to the
+// period, the number of steps being kept.
+func pssShoot(elementList *Element, currentNodes map[string]int, staticH [][]float64, staticB []float64,
+	X0 []float64, period float64, steps int, withPeriod bool, state mnaInitialState,
+	options SimOptions) ([][]float64, [][]float64, []float64, bool) {
+	size := len(X0)
+	tStep := period / float64(steps)
+	history := pssHistoryMatrix(elementList, currentNodes, size, tStep, options)
+
+	// Sensitivities start from the identity and zero
+	S := make([][]float64, size)
+	for i := range S {
+		S[i] = make([]float64, size)
+		S[i][i] = 1.0
+	}
+	dT := make([]float64, size)
+
+	mnaUpdateHistory(elementList, currentNodes, 0, X0)
+	orbit := [][]float64{X0}
+	var system mnaTransientSystem
+	for k := 1; k <= steps; k++ {
+		t := float64(k) * tStep
+		lastX := orbit[len(orbit)-1]
+		X, J, converged := mnaTransientStep(elementList, currentNodes, staticH, staticB, t, lastX, tStep, state,
+			options, &system)
+		if !converged {
+			return orbit, nil, nil, false
+		}
+
+		// J dx(k) = D dx(k-1), the junction charges of the step before adding to the companion models
+		D, _ := mnaCopyMatrixAndVector(history, nil)
+		for e := elementList; e != nil; e = e.Next {
+			if e.ElementType == ElementJFET {
+				desc := e.Extra.(*jfetDescriptor)
+				d, g, s := e.Nodes[0], e.Nodes[1], e.Nodes[2]
+				_, cgs := jfetJunctionCharge(desc, desc.cgs, desc.polarity*mnaVoltageAcross(lastX, g, s))
+				_, cgd := jfetJunctionCharge(desc, desc.cgd, desc.polarity*mnaVoltageAcross(lastX, g, d))
+				mnaStampConductance(D, g, s, cgs/tStep)
+				mnaStampConductance(D, g, d, cgd/tStep)
+			}
+		}
+		LU, P := mnaLUFactorization(J, nil)
+		next := make([][]float64, size)
+		for i := range next {
+			next[i] = make([]float64, size)
+		}
+		column := make([]float64, size)
+		for j := 0; j < size; j++ {
+			for i := range column {
+				column[i] = 0.0
+				for l := range D[i] {
+					column[i] = column[i] + D[i][l]*S[l][j]
+				}
+			}
+			column = mnaLUSolve(LU, P, column)
+			for i := range column {
+				next[i][j] = column[i]
+			}
+		}
+		S = next
+
+		// The time step, and the time points with it, grow with the period: J dx(k) = D dx(k-1) - dF/dT
+		if withPeriod {
+			h := tStep * (1.0 + pssDelta)
+			before := pssResidual(elementList, currentNodes, staticH, staticB, X, t, lastX, tStep, state, options)
+			after := pssResidual(elementList, currentNodes, staticH, staticB, X, float64(k)*h, lastX, h, state, options)
+			rhs := make([]float64, size)
+			for i := range rhs {
+				for l := range D[i] {
+					rhs[i] = rhs[i] + D[i][l]*dT[l]
+				}
+				rhs[i] = rhs[i] - (after[i]-before[i])/(h-tStep)/float64(steps)
+			}
+			dT = mnaLUSolve(LU, P, rhs)
+		}
+
+		orbit = append(orbit, X)
+		mnaUpdateHistory(elementList, currentNodes, t, X)
+	}
+	return orbit, S, dT, true
+}
+
+// pssHistoryMatrix returns D, how the right-hand side of a time step depends on the solution of the step before.
+// The companion models of capacitors, inductors and lossy lines are linear in it, so each column is the change of
+// the right-hand side for a unit solution.
+func pssHistoryMatrix(elementList *Element, currentNodes map[string]int, size int, tStep float64,
+	options SimOptions) [][]float64 {
+	rhs := func(X []float64) []float64 {
+		B := make([]float64, size)
+		mnaBuildDynamicVector(elementList, currentNodes, B, tStep, X, tStep, mnaStateTransient, options)
+		return B
+	}
+
+	base := rhs(make([]float64, size))
+	D := make([][]float64, size)
+	for i := range D {
+		D[i] = make([]float64, size)
+	}
+	for j := 0; j < size; j++ {
+		unit := make([]float64, size)
+		unit[j] = 1.0
+		B := rhs(unit)
+		for i := range B {
+			D[i][j] = B[i] - base[i]
+		}
+	}
+	return D
+}
+
+// pssResidual returns the residual H X - B of the equations of the time step at t from lastX. The nonlinear
+// elements are linearized exactly at X, so the residual is that of the nonlinear equations.
+func pssResidual(elementList *Element, currentNodes map[string]int, staticH [][]float64, staticB []float64,
+	X []float64, t float64, lastX []float64, tStep float64, state mnaInitialState, options SimOptions) []float64 {
+	size := len(X)
+	dynamicH := make([][]float64, size)
+	for i := range dynamicH {
+		dynamicH[i] = make([]float64, size)
+	}
+	dynamicB := make([]float64, size)
+	mnaBuildDynamicMatrices(elementList, currentNodes, dynamicH, dynamicB, t, lastX, tStep, state, options)
+	H, B := mnaSumMatricesAndVectors(staticH, staticB, dynamicH, dynamicB)
+
+	for e := elementList; e != nil; e = e.Next {
+		if e.ElementType == ElementJFET {
+			desc := e.Extra.(*jfetDescriptor)
+			desc.vgsLast = desc.polarity * mnaVoltageAcross(X, e.Nodes[1], e.Nodes[2])
+			desc.vgdLast = desc.polarity * mnaVoltageAcross(X, e.Nodes[1], e.Nodes[0])
+		}
+	}
+	mnaBuildNonlinearMatrices(elementList, currentNodes, H, B, X, t, lastX, tStep, options)
+
+	F := make([]float64, size)
+	for i := range H {
+		F[i] = -B[i]
+		for j := range H[i] {
+			F[i] = F[i] + H[i][j]*X[j]
+		}
+	}
+	return F
+}
+
+// pssPrint prints how the shooting converged, then the outputs over one period of the steady state.
+func pssPrint(p periodicSteadyState, period float64, settling int, iterations []pssIteration, times []float64,
+	values [][]float64, digits int) {
+	if p.osc != "" {
+		fmt.Printf("Periodic Steady State: oscillator at v(%s), frequency %.*g Hz (period %.*g s)\n\n", p.osc,
+			digits+1, 1.0/period, digits+1, period)
+	} else {
+		fmt.Printf("Periodic Steady State: fundamental %g Hz (period %.*g s)\n\n", p.frequency, digits+1, period)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(writer, "\titeration\t")
+	if p.osc != "" {
+		fmt.Fprintf(writer, "period\t")
+	}
+	fmt.Fprintf(writer, "reached by\tvoltage error (V)\tcurrent error (A)\t\n")
+	for k, it := range iterations {
+		fmt.Fprintf(writer, "\t%d\t", k+1)
+		if p.osc != "" {
+			fmt.Fprintf(writer, "%.*g\t", digits+1, it.period)
+		}
+		if it.newton {
+			fmt.Fprintf(writer, "Newton-Raphson\t")
+		} else {
+			fmt.Fprintf(writer, "transient\t")
+		}
+		fmt.Fprintf(writer, "%.*g\t%.*g\t\n", digits+1, it.voltage, digits+1, it.current)
+	}
+	writer.Flush()
+	fmt.Printf("\n\tconverged in %d iteration(s) after %d settling step(s), %d step(s) per period\n\n",
+		len(iterations), settling, p.points)
+
+	writer = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(writer, "\ttime\t")
+	for _, o := range p.outputs {
+		fmt.Fprintf(writer, "%s\t", outputName(o))
+	}
+	fmt.Fprintf(writer, "\n")
+	for k, t := range times {
+		fmt.Fprintf(writer, "\t%.*g\t", digits+1, t)
+		for i := range p.outputs {
+			fmt.Fprintf(writer, "%.*g\t", digits+1, values[i][k])
+		}
+		fmt.Fprintf(writer, "\n")
+	}
+	writer.Flush()
+	fmt.Printf("\n")
+}
+
+// pssPlot draws the steady-state waveform of every output, one curve per run.
+func pssPlot(plots pssWaveforms) error {
+	for _, name := range plots.names {
+		if err := graphRender(name, "t", "value", plots.curves[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,433 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+const (
+	pzMatch      = 1e-4  // relative distance within which the roots of both shifts are the same root
+	pzIterations = 30    // QR iterations allowed for each eigenvalue
+	pzEpsilon    = 1e-15 // relative size of a subdiagonal element taken as zero
+	pzZero       = 1e-9  // size of a root, relative to the scale of the circuit, taken as zero
+)
+
+// poleZero is a .pz line: the poles and zeros of the transfer function from an input port to an output port
+type poleZero struct {
+	inputs  [2]string // positive and negative node
+	outputs [2]string
+	current bool // the input is a current, otherwise a voltage
+	poles   bool
+	zeros   bool
+	tokens  [4]Token // nodes, for diagnostics
+}
+
+// pzPlots collects the roots of every run, one map for each .pz
+type pzPlots struct {
+	names  []string
+	curves map[string][]graphValues
+}
+
+// pzRun linearizes the circuit at its operating point as G + sC, the conductance and susceptance parts of the
+// small-signal system, with the other independent sources zeroed. The poles are the roots of det(G + sC) with
+// the input source in place; the zeros are the roots of the same system bordered by the input excitation and
+// the output selector.
+func pzRun(pzs []poleZero, elementList *Element, nodesMap map[string]int, conditions mnaConditions,
+	options SimOptions, label string, plots *pzPlots) {
+	conditions.quiet = true
+	staticH, Xop, currentNodes := acLinearize(elementList, nodesMap, conditions, options)
+	H, _ := acSystem(elementList, currentNodes, staticH, 1.0, Xop, options)
+
+	for _, pz := range pzs {
+		G, C, b := pzSystem(pz, elementList, nodesMap, currentNodes, H)
+		c := make([]float64, len(G))
+		if n := nodesMap[pz.outputs[0]]; n != 0 {
+			c[n-1] += 1.0
+		}
+		if n := nodesMap[pz.outputs[1]]; n != 0 {
+			c[n-1] -= 1.0
+		}
+
+		// The zeros make the bordered system [G+sC b; c 0] singular
+		size := len(G)
+		Gz := make([][]float64, size+1)
+		Cz := make([][]float64, size+1)
+		for i := range Gz {
+			Gz[i] = make([]float64, size+1)
+			Cz[i] = make([]float64, size+1)
+		}
+		for i := 0; i < size; i++ {
+			copy(Gz[i], G[i])
+			copy(Cz[i], C[i])
+			Gz[i][size] = b[i]
+			Gz[size][i] = c[i]
+		}
+
+		var poles, zeros []complex128
+		if pz.poles {
+			poles = pzRoots(G, C)
+		}
+		if pz.zeros {
+			zeros = pzRoots(Gz, Cz)
+		}
+		name := pzName(pz)
+		pzPrint(pz, name, poles, zeros, options.NumDgt)
+
+		if plots.curves == nil {
+			plots.curves = make(map[string][]graphValues)
+		}
+		file := "pz_" + graphFileName(name)
+		if _, exists := plots.curves[file]; !exists {
+			plots.names = append(plots.names, file)
+		}
+		for _, roots := range []struct {
+			name   string
+			values []complex128
+		}{{"poles", poles}, {"zeros", zeros}} {
+			if len(roots.values) == 0 {
+				continue
+			}
+			curve := graphValues{name: roots.name}
+			if label != "" {
+				curve.name = roots.name + " " + label
+			}
+			for _, r := range roots.values {
+				curve.t = append(curve.t, real(r))
+				curve.v = append(curve.v, imag(r))
+			}
+			plots.curves[file] = append(plots.curves[file], curve)
+		}
+	}
+}
+
+// pzSystem splits the small-signal matrix H at w = 1 into G and C, and returns them with the excitation of the
+// input. A voltage input uses the source across the input nodes, or adds one if there is none.
+func pzSystem(pz poleZero, elementList *Element, nodesMap map[string]int, currentNodes map[string]int,
+	H [][]complex128) ([][]float64, [][]float64, []float64) {
+	inPlus, inMinus := nodesMap[pz.inputs[0]], nodesMap[pz.inputs[1]]
+	size := len(H)
+	branch := -1
+	if !pz.current {
+		for e := elementList; e != nil; e = e.Next {
+			if e.ElementType == ElementVoltageSource && ((e.Nodes[0] == inPlus && e.Nodes[1] == inMinus) ||
+				(e.Nodes[0] == inMinus && e.Nodes[1] == inPlus)) {
+				branch = currentNodes[e.Label] - 1
+				break
+			}
+		}
+		if branch < 0 {
+			branch = size
+			size = size + 1
+		}
+	}
+
+	G := make([][]float64, size)
+	C := make([][]float64, size)
+	for i := range G {
+		G[i] = make([]float64, size)
+		C[i] = make([]float64, size)
+		if i < len(H) {
+			for j := range H[i] {
+				G[i][j] = real(H[i][j])
+				C[i][j] = imag(H[i][j])
+			}
+		}
+	}
+
+	b := make([]float64, size)
+	if pz.current {
+		mnaStampCurrent(b, inMinus, inPlus, 1.0)
+		return G, C, b
+	}
+	if branch == len(H) {
+		mnaStampCurrentBranch(G, inPlus, inMinus, branch+1)
+		if inPlus != 0 {
+			G[branch][inPlus-1] += 1.0
+		}
+		if inMinus != 0 {
+			G[branch][inMinus-1] -= 1.0
+		}
+	}
+	b[branch] = 1.0
+	return G, C, b
+}
+
+// pzRoots returns the finite roots of det(G + sC). With a shift s0, they are s = s0 - 1/mu for the nonzero
+// eigenvalues mu of (G + s0 C)^-1 C. Rounding turns the eigenvalues at zero, the roots at infinity, into small
+// ones; solving for two shifts and keeping the roots both agree on leaves those out.
+func pzRoots(G [][]float64, C [][]float64) []complex128 {
+	scaleG, scaleC := 0.0, 0.0
+	for i := range G {
+		for j := range G[i] {
+			scaleG = math.Max(scaleG, math.Abs(G[i][j]))
+			scaleC = math.Max(scaleC, math.Abs(C[i][j]))
+		}
+	}
+	if scaleC == 0.0 {
+		return nil
+	}
+	scale := scaleG / scaleC
+
+	shifts := []complex128{complex(0.31*scale, 0.23*scale), complex(-0.47*scale, 0.61*scale)}
+	candidates := make([][]complex128, len(shifts))
+	for k, s0 := range shifts {
+		M := make([][]complex128, len(G))
+		for i := range M {
+			M[i] = make([]complex128, len(G))
+			for j := range M[i] {
+				M[i][j] = complex(G[i][j], 0.0) + s0*complex(C[i][j], 0.0)
+			}
+		}
+		LU, P := acLUFactorization(M)
+
+		// A = M^-1 C, column by column
+		A := make([][]complex128, len(G))
+		for i := range A {
+			A[i] = make([]complex128, len(G))
+		}
+		for j := range G {
+			column := make([]complex128, len(G))
+			for i := range column {
+				column[i] = complex(C[i][j], 0.0)
+			}
+			column = acLUSolve(LU, P, column)
+			for i := range column {
+				A[i][j] = column[i]
+			}
+		}
+
+		for _, mu := range pzEigenvalues(A) {
+			if mu != 0.0 && !cmplx.IsNaN(mu) {
+				candidates[k] = append(candidates[k], s0-1.0/mu)
+			}
+		}
+	}
+
+	roots := make([]complex128, 0)
+	used := make([]bool, len(candidates[1]))
+	for _, r := range candidates[0] {
+		for i, other := range candidates[1] {
+			if !used[i] && cmplx.Abs(r-other) <= pzMatch*(cmplx.Abs(r)+cmplx.Abs(other))+pzZero*scale {
+				used[i] = true
+				// Real and imaginary roots come out with a tiny other part, roots at the origin as tiny ones
+				if math.Abs(imag(r)) <= pzMatch*cmplx.Abs(r) {
+					r = complex(real(r), 0.0)
+				}
+				if math.Abs(real(r)) <= pzMatch*cmplx.Abs(r) {
+					r = complex(0.0, imag(r))
+				}
+				if cmplx.Abs(r) <= pzZero*scale {
+					r = 0.0
+				}
+				roots = append(roots, r)
+				break
+			}
+		}
+	}
+	sort.SliceStable(roots, func(i, j int) bool {
+		if cmplx.Abs(roots[i]) != cmplx.Abs(roots[j]) {
+			return cmplx.Abs(roots[i]) < cmplx.Abs(roots[j])
+		}
+		return imag(roots[i]) < imag(roots[j])
+	})
+	return roots
+}
+
+// pzEigenvalues returns the eigenvalues of A, which it overwrites: A is reduced to Hessenberg form by Householder
+// reflections, then to triangular form by shifted QR iterations with Givens rotations.
+func pzEigenvalues(A [][]complex128) []complex128 {
+	n := len(A)
+	norm := 0.0
+	for i := range A {
+		for j := range A[i] {
+			norm = math.Max(norm, cmplx.Abs(A[i][j]))
+		}
+	}
+
+	// Hessenberg form: A = Q^H A Q, column by column
+	for k := 0; k < n-2; k++ {
+		length := 0.0
+		for i := k + 1; i < n; i++ {
+			length = math.Hypot(length, cmplx.Abs(A[i][k]))
+		}
+		if length == 0.0 {
+			continue
+		}
+		v := make([]complex128, n-k-1)
+		for i := range v {
+			v[i] = A[k+1+i][k]
+		}
+		phase := complex(1.0, 0.0)
+		if v[0] != 0.0 {
+			phase = v[0] / complex(cmplx.Abs(v[0]), 0.0)
+		}
+		v[0] = v[0] + phase*complex(length, 0.0)
+		vv := 0.0
+		for _, x := range v {
+			vv = vv + real(x)*real(x) + imag(x)*imag(x)
+		}
+
+		for j := 0; j < n; j++ {
+			sum := complex(0.0, 0.0)
+			for i, x := range v {
+				sum = sum + cmplx.Conj(x)*A[k+1+i][j]
+			}
+			f := 2.0 * sum / complex(vv, 0.0)
+			for i, x := range v {
+				A[k+1+i][j] = A[k+1+i][j] - f*x
+			}
+		}
+		for i := 0; i < n; i++ {
+			sum := complex(0.0, 0.0)
+			for j, x := range v {
+				sum = sum + A[i][k+1+j]*x
+			}
+			f := 2.0 * sum / complex(vv, 0.0)
+			for j, x := range v {
+				A[i][k+1+j] = A[i][k+1+j] - f*cmplx.Conj(x)
+			}
+		}
+	}
+
+	eigenvalues := make([]complex128, 0, n)
+	hi := n - 1
+	iterations := 0
+	for hi >= 0 {
+		// The active block starts after the last negligible subdiagonal element
+		lo := hi
+		for lo > 0 {
+			small := pzEpsilon * (cmplx.Abs(A[lo][lo]) + cmplx.Abs(A[lo-1][lo-1]))
+			if small == 0.0 {
+				small = pzEpsilon * norm
+			}
+			if cmplx.Abs(A[lo][lo-1]) <= small {
+				A[lo][lo-1] = 0.0
+				break
+			}
+			lo--
+		}
+		if lo == hi {
+			eigenvalues = append(eigenvalues, A[hi][hi])
+			hi--
+			iterations = 0
+			continue
+		}
+		iterations++
+		if iterations > pzIterations*n {
+			// No convergence, the rest of the diagonal is the best estimate there is
+			for ; hi >= 0; hi-- {
+				eigenvalues = append(eigenvalues, A[hi][hi])
+			}
+			break
+		}
+
+		// Wilkinson shift: the eigenvalue of the trailing 2x2 block closer to its last element, or an exceptional
+		// shift now and then to break cycles
+		a, b, c, d := A[hi-1][hi-1], A[hi-1][hi], A[hi][hi-1], A[hi][hi]
+		half := (a + d) / 2.0
+		root := cmplx.Sqrt(half*half - (a*d - b*c))
+		shift := half + root
+		if cmplx.Abs(half-root-d) < cmplx.Abs(shift-d) {
+			shift = half - root
+		}
+		if iterations%10 == 0 {
+			shift = d + complex(cmplx.Abs(c), 0.0)
+		}
+
+		for i := lo; i <= hi; i++ {
+			A[i][i] = A[i][i] - shift
+		}
+		cs := make([]complex128, hi-lo)
+		sn := make([]complex128, hi-lo)
+		for k := lo; k < hi; k++ {
+			x, y := A[k][k], A[k+1][k]
+			r := math.Hypot(cmplx.Abs(x), cmplx.Abs(y))
+			cs[k-lo], sn[k-lo] = 1.0, 0.0
+			if r != 0.0 {
+				cs[k-lo], sn[k-lo] = x/complex(r, 0.0), y/complex(r, 0.0)
+			}
+			for j := k; j <= hi; j++ {
+				t1, t2 := A[k][j], A[k+1][j]
+				A[k][j] = cmplx.Conj(cs[k-lo])*t1 + cmplx.Conj(sn[k-lo])*t2
+				A[k+1][j] = -sn[k-lo]*t1 + cs[k-lo]*t2
+			}
+		}
+		for k := lo; k < hi; k++ {
+			last := k + 2
+			if last > hi {
+				last = hi
+			}
+			for i := lo; i <= last; i++ {
+				t1, t2 := A[i][k], A[i][k+1]
+				A[i][k] = t1*cs[k-lo] + t2*sn[k-lo]
+				A[i][k+1] = -t1*cmplx.Conj(sn[k-lo]) + t2*cmplx.Conj(cs[k-lo])
+			}
+		}
+		for i := lo; i <= hi; i++ {
+			A[i][i] = A[i][i] + shift
+		}
+	}
+	return eigenvalues
+}
+
+// pzName names the transfer function of a .pz, as "V(out)/V(in)".
+func pzName(pz poleZero) string {
+	port := func(kind string, nodes [2]string) string {
+		if nodes[1] == "0" {
+			return kind + "(" + nodes[0] + ")"
+		}
+		return kind + "(" + nodes[0] + "," + nodes[1] + ")"
+	}
+	input := port("V", pz.inputs)
+	if pz.current {
+		input = port("I", pz.inputs)
+	}
+	return port("V", pz.outputs) + "/" + input
+}
+
+// pzPrint prints the roots of a .pz with their natural frequency and damping ratio.
+func pzPrint(pz poleZero, name string, poles []complex128, zeros []complex128, digits int) {
+	fmt.Printf("Pole-Zero Analysis: %s\n\n", name)
+	for _, roots := range []struct {
+		name   string
+		wanted bool
+		values []complex128
+	}{{"Poles", pz.poles, poles}, {"Zeros", pz.zeros, zeros}} {
+		if !roots.wanted {
+			continue
+		}
+		if len(roots.values) == 0 {
+			fmt.Printf("\t%s: none\n\n", roots.name)
+			continue
+		}
+		fmt.Printf("\t%s:\n\n", roots.name)
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintf(writer, "\treal (rad/s)\timaginary (rad/s)\tfrequency (Hz)\tdamping ratio\t\n")
+		for _, r := range roots.values {
+			damping := "-"
+			if r != 0.0 && real(r) != 0.0 {
+				damping = fmt.Sprintf("%.*g", digits+1, -real(r)/cmplx.Abs(r))
+			} else if r != 0.0 {
+				damping = "0"
+			}
+			fmt.Fprintf(writer, "\t%.*g\t%.*g\t%.*g\t%s\t\n", digits+1, real(r), digits+1, imag(r), digits+1,
+				cmplx.Abs(r)/(2.0*math.Pi), damping)
+		}
+		writer.Flush()
+		fmt.Printf("\n")
+	}
+}
+
+// pzPlot draws the pole-zero map of every .pz, the roots of each run as points.
+func pzPlot(plots pzPlots) error {
+	for _, name := range plots.names {
+		if err := graphRenderPoints(name, "real (rad/s)", "imaginary (rad/s)", plots.curves[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+const sensDelta = 1e-6 // relative change of a parameter when differentiating the stamps
+
+// sensitivity is a .sens line: the derivatives of an output with respect to every element value and model
+// parameter, at the operating point or at the frequencies of an AC sweep
+type sensitivity struct {
+	output outputVariable
+	ac     bool
+	sweep  acSweep
+	token  Token
+}
+
+// sensParameter is a value the circuit depends on: the value of an element or a parameter of a model
+type sensParameter struct {
+	name    string // element label, or <model>:<parameter>
+	value   float64
+	set     func(float64)
+	restore func()
+}
+
+// sensResult is the derivative of an output with respect to a parameter
+type sensResult struct {
+	parameter  sensParameter
+	derivative float64
+}
+
+// sensRun computes the sensitivities of a run with the adjoint method: with z solving J^T z = c, where J is the
+// linearized system and c picks the output out of the solution, the derivative of the output y = c x with
+// respect to a parameter p is dy/dp = dc/dp x - z dF/dp. dF/dp, the change of the residual of the equations
+// at the solution, is a difference of the stamps, so the circuit is solved once whatever the number of
+// parameters.
+func sensRun(sens []sensitivity, elementList *Element, models map[string]*Model, nodesMap map[string]int,
+	conditions mnaConditions, options SimOptions) {
+	conditions.quiet = true
+	parameters := sensParameters(elementList, models, options)
+
+	for _, s := range sens {
+		if s.ac {
+			sensAC(s, parameters, elementList, nodesMap, conditions, options)
+			continue
+		}
+
+		X, _, _, currentNodes := mnaSolveLinear(elementList, nodesMap, conditions, options)
+		J, _ := sensResidual(elementList, currentNodes, X, options)
+		c := make([]float64, len(X))
+		for i := range c {
+			unit := make([]float64, len(X))
+			unit[i] = 1.0
+			c[i] = outputValue(s.output, elementList, unit, nodesMap, currentNodes)
+		}
+		LU, P := mnaLUFactorization(sensTranspose(J), nil)
+		z := mnaLUSolve(LU, P, c)
+
+		results := make([]sensResult, 0, len(parameters))
+		for _, p := range parameters {
+			high, low := sensPoints(p.value)
+			p.set(high)
+			_, plus := sensResidual(elementList, currentNodes, X, options)
+			yPlus := outputValue(s.output, elementList, X, nodesMap, currentNodes)
+			p.set(low)
+			_, minus := sensResidual(elementList, currentNodes, X, options)
+			yMinus := outputValue(s.output, elementList, X, nodesMap, currentNodes)
+			p.restore()
+
+			derivative := (yPlus - yMinus) / (high - low)
+			for i := range z {
+				derivative = derivative - z[i]*(plus[i]-minus[i])/(high-low)
+			}
+			results = append(results, sensResult{parameter: p, derivative: derivative})
+		}
+
+		fmt.Printf("Sensitivity Analysis: %s\n\n", outputName(s.output))
+		sensPrint(outputValue(s.output, elementList, X, nodesMap, currentNodes), results, options.NumDgt)
+	}
+}
+
+// sensAC computes the sensitivities of an AC output at every frequency of its sweep. A parameter also moves the
+// operating point the nonlinear elements are linearized around; that shift is solved directly with the DC system.
+func sensAC(s sensitivity, parameters []sensParameter, elementList *Element, nodesMap map[string]int,
+	conditions mnaConditions, options SimOptions) {
+	staticH, Xop, currentNodes := acLinearize(elementList, nodesMap, conditions, options)
+	J, _ := sensResidual(elementList, currentNodes, Xop, options)
+	dcLU, dcP := mnaLUFactorization(J, nil)
+	nonlinear := mnaHasNonlinear(elementList)
+
+	frequencies := acFrequencies(s.sweep)
+	X := make([][]complex128, len(frequencies))
+	Z := make([][]complex128, len(frequencies))
+	for k, f := range frequencies {
+		H, B := acSystem(elementList, currentNodes, staticH, 2.0*math.Pi*f, Xop, options)
+		LU, P := acLUFactorization(H)
+		X[k] = acLUSolve(LU, P, B)
+
+		c := make([]complex128, len(H))
+		for i := range c {
+			unit := make([]complex128, len(H))
+			unit[i] = 1.0
+			c[i] = outputPhasor(s.output, elementList, unit, nodesMap, currentNodes)
+		}
+		LU, P = acLUFactorization(noiseTranspose(H))
+		Z[k] = acLUSolve(LU, P, c)
+	}
+
+	results := make([][]sensResult, len(frequencies))
+	for _, p := range parameters {
+		high, low := sensPoints(p.value)
+		derivatives := make([]complex128, len(frequencies))
+
+		// The operating point moves by dXop = -J^-1 dF/dp
+		shift := make([]float64, len(Xop))
+		if nonlinear {
+			p.set(high)
+			_, plus := sensResidual(elementList, currentNodes, Xop, options)
+			p.set(low)
+			_, minus := sensResidual(elementList, currentNodes, Xop, options)
+			for i := range plus {
+				plus[i] = (minus[i] - plus[i]) / (high - low)
+			}
+			shift = mnaLUSolve(dcLU, dcP, plus)
+		}
+
+		for _, value := range []float64{high, low} {
+			p.set(value)
+			moved := make([]float64, len(Xop))
+			for i := range Xop {
+				moved[i] = Xop[i] + (value-p.value)*shift[i]
+			}
+			static := acStaticMatrix(elementList, currentNodes, len(Xop))
+			for k, f := range frequencies {
+				H, B := acSystem(elementList, currentNodes, static, 2.0*math.Pi*f, moved, options)
+				d := outputPhasor(s.output, elementList, X[k], nodesMap, currentNodes)
+				for i := range H {
+					residual := -B[i]
+					for j := range H[i] {
+						residual = residual + H[i][j]*X[k][j]
+					}
+					d = d - Z[k][i]*residual
+				}
+				if value == low {
+					d = -d
+				}
+				derivatives[k] = derivatives[k] + d/complex(high-low, 0.0)
+			}
+		}
+		p.restore()
+
+		for k := range frequencies {
+			y := outputPhasor(s.output, elementList, X[k], nodesMap, currentNodes)
+			results[k] = append(results[k], sensResult{parameter: p, derivative: sensPart(s.output, y, derivatives[k])})
+		}
+	}
+
+	for k, f := range frequencies {
+		fmt.Printf("Sensitivity Analysis: %s at f=%g Hz\n\n", outputName(s.output), f)
+		y := outputPhasor(s.output, elementList, X[k], nodesMap, currentNodes)
+		sensPrint(outputPart(s.output, y), results[k], options.NumDgt)
+	}
+}
+
+// sensParameters lists the values of the elements and the parameters of the models in use, defaults included.
+// Changing a model parameter binds its elements to it again.
+func sensParameters(elementList *Element, models map[string]*Model, options SimOptions) []sensParameter {
+	parameters := make([]sensParameter, 0)
+	used := make(map[string]bool)
+	names := make([]string, 0)
+	for e := elementList; e != nil; e = e.Next {
+		if elementHasValue(e) {
+			e := e
+			value := e.Value
+			parameters = append(parameters, sensParameter{name: e.Label, value: value,
+				set: func(v float64) { e.Value = v }, restore: func() { e.Value = value }})
+		}
+		if name, hasModel := modelName(e); hasModel && !used[name] {
+			used[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		name := name
+		model := models[name]
+		resolve := func() {
+			for e := elementList; e != nil; e = e.Next {
+				if n, hasModel := modelName(e); hasModel && n == name {
+					modelResolveElement(e, model)
+				}
+			}
+			temperatureApply(elementList, options)
+		}
+
+		keys := make([]string, 0)
+		for key := range modelDefaults[model.ModelType] {
+			if key != "nseg" {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			key := key
+			value, given := model.Params[key]
+			if !given {
+				value = modelParam(model, key)
+			}
+			parameters = append(parameters, sensParameter{name: name + ":" + key, value: value,
+				set: func(v float64) {
+					model.Params[key] = v
+					resolve()
+				},
+				restore: func() {
+					model.Params[key] = value
+					if !given {
+						delete(model.Params, key)
+					}
+					resolve()
+				}})
+		}
+	}
+	return parameters
+}
+
+// sensPoints returns the values around a parameter the stamps are differentiated between. A parameter at zero is
+// only increased, as some may not be negative.
+func sensPoints(value float64) (float64, float64) {
+	if value == 0.0 {
+		return sensDelta, 0.0
+	}
+	return value + sensDelta*math.Abs(value), value - sensDelta*math.Abs(value)
+}
+
+// sensResidual returns the DC system linearized at X, and the residual H X - B of the equations there. The
+// companion models of the nonlinear elements make the residual that of the nonlinear equations.
+func sensResidual(elementList *Element, currentNodes map[string]int, X []float64,
+	options SimOptions) ([][]float64, []float64) {
+	size := len(X)
+	H := make([][]float64, size)
+	dynamicH := make([][]float64, size)
+	for i := range H {
+		H[i] = make([]float64, size)
+		dynamicH[i] = make([]float64, size)
+	}
+	B := make([]float64, size)
+	dynamicB := make([]float64, size)
+
+	mnaBuildStaticMatrices(elementList, currentNodes, H, B)
+	mnaBuildDynamicMatrices(elementList, currentNodes, dynamicH, dynamicB, 0, nil, 0, mnaStateDC, options)
+	H, B = mnaSumMatricesAndVectors(H, B, dynamicH, dynamicB)
+
+	// Junction limiting starts at X, so the elements are linearized exactly there
+	for e := elementList; e != nil; e = e.Next {
+		if e.ElementType == ElementJFET {
+			desc := e.Extra.(*jfetDescriptor)
+			desc.vgsLast = desc.polarity * mnaVoltageAcross(X, e.Nodes[1], e.Nodes[2])
+			desc.vgdLast = desc.polarity * mnaVoltageAcross(X, e.Nodes[1], e.Nodes[0])
+		}
+	}
+	mnaBuildNonlinearMatrices(elementList, currentNodes, H, B, X, 0, nil, 0, options)
+
+	F := make([]float64, size)
+	for i := range H {
+		F[i] = -B[i]
+		for j := range H[i] {
+			F[i] = F[i] + H[i][j]*X[j]
+		}
+	}
+	return H, F
+}
+
+// sensTranspose returns the transpose of H.
+func sensTranspose(H [][]float64) [][]float64 {
+	T := make([][]float64, len(H))
+	for i := range T {
+		T[i] = make([]float64, len(H))
+		for j := range T[i] {
+			T[i][j] = H[j][i]
+		}
+	}
+	return T
+}
+
+// sensPart returns the derivative of the part of a phasor y the output asks for, given the derivative dy of
+// the phasor.
+func sensPart(o outputVariable, y complex128, dy complex128) float64 {
+	switch o.part {
+	case "db":
+		return 20.0 / math.Ln10 * real(dy/y)
+	case "p":
+		return imag(dy/y) * 180.0 / math.Pi
+	case "r":
+		return real(dy)
+	case "i":
+		return imag(dy)
+	}
+	return real(cmplx.Conj(y)*dy) / cmplx.Abs(y)
+}
+
+// sensPrint prints the value of an output and its sensitivities, the ones of largest effect first: the change of
+// the output for a relative change of the parameter. Parameters the output does not depend on come last, with a
+// sensitivity of 0.
+func sensPrint(y float64, results []sensResult, digits int) {
+	ranked := append([]sensResult(nil), results...)
+	effect := func(r sensResult) float64 {
+		return math.Abs(r.derivative * r.parameter.value)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if effect(ranked[i]) != effect(ranked[j]) {
+			return effect(ranked[i]) > effect(ranked[j])
+		}
+		return math.Abs(ranked[i].derivative) > math.Abs(ranked[j].derivative)
+	})
+
+	fmt.Printf("\toutput: %.*g\n\n", digits+1, y)
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(writer, "\tparameter\tvalue\tsensitivity\tnormalized (%%/%%)\t\n")
+	for _, r := range ranked {
+		normalized := "-"
+		if n := r.derivative * r.parameter.value / y; y != 0.0 && n != 0.0 {
+			normalized = fmt.Sprintf("%.*g", digits+1, n)
+		} else if y != 0.0 {
+			normalized = "0"
+		}
+		fmt.Fprintf(writer, "\t%s\t%.*g\t%.*g\t%s\t\n", r.parameter.name, digits+1, r.parameter.value, digits+1,
+			r.derivative, normalized)
+	}
+	writer.Flush()
+	fmt.Printf("\n")
+}
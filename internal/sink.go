@@ -0,0 +1,379 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// SinkRun describes a transient run to the sinks that receive it
+type SinkRun struct {
+	Title   string   // title of the netlist, empty if it has none
+	Label   string   // the .step values of the run, empty without .step
+	Signals []string // recorded quantities, "V(<node>)", "V(<node>,<node>)" or "I(<element>)"
+}
+
+// SinkPoint is a timepoint sent by a channel sink
+type SinkPoint struct {
+	Run    *SinkRun
+	T      float64
+	Values []float64 // in the order of Run.Signals
+}
+
+// Sink receives the timepoints of transient runs as they are accepted, so that long runs need not be held in
+// memory. Begin starts every run, Point gets the signals of each recorded timepoint in the order of
+// SinkRun.Signals, and End follows the last timepoint. The values passed to Point belong to the sink. A sink that
+// returns an error stops the simulation.
+type Sink interface {
+	Begin(run SinkRun) error
+	Point(t float64, values []float64) error
+	End() error
+}
+
+// sinks are the sinks every transient run is sent to, besides the graphs
+var sinks []Sink
+
+// SinkRegister adds a sink that receives every transient run of the simulations that follow.
+func SinkRegister(s Sink) {
+	sinks = append(sinks, s)
+}
+
+// sinkFeed sends the timepoints of a transient run from tStart on to its sinks, as the values of outputs
+type sinkFeed struct {
+	run     SinkRun
+	outputs []outputVariable // every node voltage and branch current if nil
+	tStart  float64
+	sinks   []Sink
+	started bool
+}
+
+// sinkFeedPoint sends a timepoint to the sinks of a feed, starting the run at its first timepoint.
+func sinkFeedPoint(feed *sinkFeed, elementList *Element, nodesMap map[string]int, t float64, X []float64,
+	currentNodes map[string]int) {
+	if len(feed.sinks) == 0 {
+		return
+	}
+	if !feed.started {
+		outputs := feed.outputs
+		if outputs == nil {
+			outputs = sinkSignals(nodesMap, currentNodes)
+		}
+		feed.outputs = make([]outputVariable, 0, len(outputs))
+		feed.run.Signals = make([]string, 0, len(outputs))
+		saved := make(map[string]bool)
+		for _, o := range outputs {
+			if !saved[outputName(o)] {
+				saved[outputName(o)] = true
+				feed.outputs = append(feed.outputs, o)
+				feed.run.Signals = append(feed.run.Signals, outputName(o))
+			}
+		}
+		for _, s := range feed.sinks {
+			sinkCheck(s.Begin(feed.run))
+		}
+		feed.started = true
+	}
+
+	// Timepoints are sums of timesteps, so the start time is given some slack
+	if t < feed.tStart*(1.0-1e-9) {
+		return
+	}
+	values := make([]float64, len(feed.outputs))
+	for i, o := range feed.outputs {
+		values[i] = outputValue(o, elementList, X, nodesMap, currentNodes)
+	}
+	for i, s := range feed.sinks {
+		if i > 0 {
+			values = append([]float64(nil), values...)
+		}
+		sinkCheck(s.Point(t, values))
+	}
+}
+
+// sinkFeedEnd ends the run of a feed.
+func sinkFeedEnd(feed *sinkFeed) {
+	if !feed.started {
+		return
+	}
+	for _, s := range feed.sinks {
+		sinkCheck(s.End())
+	}
+}
+
+// sinkCheck stops the simulation if a sink failed.
+func sinkCheck(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Sink Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// sinkSignals lists every node voltage and branch current of the circuit, each group sorted by name.
+func sinkSignals(nodesMap map[string]int, currentNodes map[string]int) []outputVariable {
+	outputs := make([]outputVariable, 0, len(nodesMap)+len(currentNodes))
+	for _, k := range acSortedKeys(nodesMap) {
+		if nodesMap[k] != 0 {
+			outputs = append(outputs, outputVariable{node: k})
+		}
+	}
+	for _, k := range acSortedKeys(currentNodes) {
+		if currentNodes[k] != 0 && !mnaIsInternal(k) {
+			outputs = append(outputs, outputVariable{current: true, node: k})
+		}
+	}
+	return outputs
+}
+
+// sinkRecorder keeps the runs it receives in memory. With a limit, every other timepoint is dropped whenever the
+// limit is reached and only one in twice as many is kept from then on, so a run of any length fits in limit
+// timepoints spread over all of it.
+type sinkRecorder struct {
+	run    SinkRun
+	limit  int // most timepoints kept, 0 for all of them
+	stride int // one timepoint in stride is kept
+	count  int // timepoints received
+	T      []float64
+	values [][]float64 // per timepoint
+	lastT  float64     // last timepoint received, kept even if it is not in stride
+	last   []float64
+}
+
+func sinkNewRecorder(limit int) *sinkRecorder {
+	return &sinkRecorder{limit: limit}
+}
+
+func (r *sinkRecorder) Begin(run SinkRun) error {
+	r.run = run
+	r.stride = 1
+	r.count = 0
+	r.T = nil
+	r.values = nil
+	r.last = nil
+	return nil
+}
+
+func (r *sinkRecorder) Point(t float64, values []float64) error {
+	if r.count%r.stride == 0 {
+		r.T = append(r.T, t)
+		r.values = append(r.values, values)
+		if r.limit > 0 && len(r.T) >= r.limit {
+			kept := 0
+			for k := 0; k < len(r.T); k += 2 {
+				r.T[kept], r.values[kept] = r.T[k], r.values[k]
+				kept++
+			}
+			r.T, r.values = r.T[:kept], r.values[:kept]
+			r.stride *= 2
+		}
+	}
+	r.count++
+	r.lastT, r.last = t, values
+	return nil
+}
+
+func (r *sinkRecorder) End() error {
+	if r.last != nil && r.T[len(r.T)-1] != r.lastT {
+		r.T = append(r.T, r.lastT)
+		r.values = append(r.values, r.last)
+	}
+	return nil
+}
+
+// sinkRecorderWave returns the values of a signal of the recorded run, nil if it was not recorded.
+func sinkRecorderWave(r *sinkRecorder, name string) []float64 {
+	for i, signal := range r.run.Signals {
+		if signal == name {
+			y := make([]float64, len(r.T))
+			for k := range r.T {
+				y[k] = r.values[k][i]
+			}
+			return y
+		}
+	}
+	return nil
+}
+
+// sinkChannel sends every timepoint to a channel
+type sinkChannel struct {
+	run *SinkRun
+	ch  chan<- SinkPoint
+}
+
+// SinkNewChannel returns a sink that sends every timepoint to ch. The channel is never closed: the simulation is
+// over when ParserInit returns.
+func SinkNewChannel(ch chan<- SinkPoint) Sink {
+	return &sinkChannel{ch: ch}
+}
+
+func (c *sinkChannel) Begin(run SinkRun) error {
+	c.run = &run
+	return nil
+}
+
+func (c *sinkChannel) Point(t float64, values []float64) error {
+	c.ch <- SinkPoint{Run: c.run, T: t, Values: values}
+	return nil
+}
+
+func (c *sinkChannel) End() error {
+	return nil
+}
+
+// sinkFile is the file a sink writes to. The first run creates it and the ones after it are appended.
+type sinkFile struct {
+	path   string
+	runs   int
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func sinkFileOpen(f *sinkFile) error {
+	var err error
+	if f.runs == 0 {
+		f.file, err = os.Create(f.path)
+	} else {
+		f.file, err = os.OpenFile(f.path, os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.file.Seek(0, io.SeekEnd)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	f.writer = bufio.NewWriter(f.file)
+	f.runs++
+	return nil
+}
+
+func sinkFileClose(f *sinkFile) error {
+	err := f.writer.Flush()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// sinkRawfile writes the runs as the plots of an ASCII SPICE rawfile
+type sinkRawfile struct {
+	sinkFile
+	points int64 // offset of the number of points, written once the run is over
+	count  int
+}
+
+// sinkRawfilePoints is the width the number of points is written with
+const sinkRawfilePoints = 20
+
+// SinkNewRawfile returns a sink that writes every run as a plot of the ASCII SPICE rawfile at path.
+func SinkNewRawfile(path string) Sink {
+	return &sinkRawfile{sinkFile: sinkFile{path: path}}
+}
+
+func (r *sinkRawfile) Begin(run SinkRun) error {
+	if err := sinkFileOpen(&r.sinkFile); err != nil {
+		return err
+	}
+	name := "Transient Analysis"
+	if run.Label != "" {
+		name = name + " " + run.Label
+	}
+	fmt.Fprintf(r.writer, "Title: %s\n", run.Title)
+	fmt.Fprintf(r.writer, "Plotname: %s\n", name)
+	fmt.Fprintf(r.writer, "Flags: real\n")
+	fmt.Fprintf(r.writer, "No. Variables: %d\n", len(run.Signals)+1)
+	fmt.Fprintf(r.writer, "No. Points: ")
+	if err := r.writer.Flush(); err != nil {
+		return err
+	}
+	var err error
+	r.points, err = r.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(r.writer, "%-*d\n", sinkRawfilePoints, 0)
+	fmt.Fprintf(r.writer, "Variables:\n")
+	fmt.Fprintf(r.writer, "\t0\ttime\ttime\n")
+	for i, signal := range run.Signals {
+		kind := "voltage"
+		if strings.HasPrefix(signal, "I(") {
+			kind = "current"
+		}
+		fmt.Fprintf(r.writer, "\t%d\t%s\t%s\n", i+1, strings.ToLower(signal), kind)
+	}
+	fmt.Fprintf(r.writer, "Values:\n")
+	r.count = 0
+	return nil
+}
+
+func (r *sinkRawfile) Point(t float64, values []float64) error {
+	fmt.Fprintf(r.writer, "%d\t%.15e\n", r.count, t)
+	for _, v := range values {
+		fmt.Fprintf(r.writer, "\t%.15e\n", v)
+	}
+	r.count++
+	return nil
+}
+
+func (r *sinkRawfile) End() error {
+	// The number of points is only known now
+	if err := r.writer.Flush(); err != nil {
+		return err
+	}
+	if _, err := r.file.WriteAt([]byte(fmt.Sprintf("%-*d", sinkRawfilePoints, r.count)), r.points); err != nil {
+		return err
+	}
+	return sinkFileClose(&r.sinkFile)
+}
+
+// sinkCSV writes the runs as CSV, one line per timepoint. A step column tells the runs of a .step apart.
+type sinkCSV struct {
+	sinkFile
+	records *csv.Writer
+	stepped bool
+	label   string
+}
+
+// SinkNewCSV returns a sink that writes every run to the CSV file at path, with a header line naming the signals.
+func SinkNewCSV(path string) Sink {
+	return &sinkCSV{sinkFile: sinkFile{path: path}}
+}
+
+func (c *sinkCSV) Begin(run SinkRun) error {
+	first := c.runs == 0
+	if err := sinkFileOpen(&c.sinkFile); err != nil {
+		return err
+	}
+	c.records = csv.NewWriter(c.writer)
+	c.label = run.Label
+	if first {
+		c.stepped = run.Label != ""
+		header := []string{"time"}
+		if c.stepped {
+			header = append([]string{"step"}, header...)
+		}
+		c.records.Write(append(header, run.Signals...))
+	}
+	return c.records.Error()
+}
+
+func (c *sinkCSV) Point(t float64, values []float64) error {
+	record := make([]string, 0, len(values)+2)
+	if c.stepped {
+		record = append(record, c.label)
+	}
+	record = append(record, fmt.Sprintf("%.*g", 15, t))
+	for _, v := range values {
+		record = append(record, fmt.Sprintf("%.*g", 15, v))
+	}
+	return c.records.Write(record)
+}
+
+func (c *sinkCSV) End() error {
+	c.records.Flush()
+	if err := c.records.Error(); err != nil {
+		return err
+	}
+	return sinkFileClose(&c.sinkFile)
+}
@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"os"
+	"text/tabwriter"
+)
+
+// stability is a .stb line: the loop gain of the feedback loop broken by a probe, over an AC sweep
+type stability struct {
+	probe string
+	sweep acSweep
+	token Token // probe, for diagnostics
+}
+
+// stbCrossing is a frequency where the loop gain crosses unity, with its phase margin, or where its phase crosses
+// -180 degrees, with its gain margin
+type stbCrossing struct {
+	frequency float64
+	margin    float64
+}
+
+// stbPlots collects the loop gain of every run, one Bode plot for each .stb
+type stbPlots struct {
+	names  []string // probes
+	sweeps map[string]acSweep
+	gain   map[string][]graphValues
+	phase  map[string][]graphValues
+}
+
+// stbRun computes the loop gain at every probe with Middlebrook's double injection. At each frequency the circuit,
+// its independent sources zeroed, is solved twice with the same factorization: a unit voltage injected by the
+// probe from its first node to its second, and a unit current injected into its second node. The voltage and
+// current loop gains Tv and Ti combine into the exact loop gain T = (Tv Ti - 1) / (Tv + Ti + 2), whatever the
+// loading on each side of the probe. Returns the worst phase and gain margins of each probe that has them.
+func stbRun(stbs []stability, elementList *Element, nodesMap map[string]int, conditions mnaConditions,
+	options SimOptions, label string, plots *stbPlots) []outputScalar {
+	conditions.quiet = true
+	scalars := make([]outputScalar, 0)
+	staticH, Xop, currentNodes := acLinearize(elementList, nodesMap, conditions, options)
+
+	for _, s := range stbs {
+		probe := elementListFindByLabel(elementList, s.probe)
+		b := currentNodes[probe.Label] - 1
+		n1, n2 := probe.Nodes[0], probe.Nodes[1]
+
+		frequencies := acFrequencies(s.sweep)
+		T := make([]complex128, len(frequencies))
+		for k, f := range frequencies {
+			H, _ := acSystem(elementList, currentNodes, staticH, 2.0*math.Pi*f, Xop, options)
+			LU, P := acLUFactorization(H)
+
+			// Voltage injection: v2 - v1 = 1, Tv = -v1/v2
+			B := make([]complex128, len(H))
+			B[b] = -1.0
+			X := acLUSolve(LU, P, B)
+			v1, v2 := X[n1-1], X[n2-1]
+
+			// Current injection: i2 = i1 + 1 leaves into the second side, Ti = -i1/i2
+			B = make([]complex128, len(H))
+			B[n2-1] = 1.0
+			i1 := acLUSolve(LU, P, B)[b]
+			i2 := i1 + 1.0
+
+			// Middlebrook's formula with Tv and Ti expanded, so an ideal side does not divide by zero
+			T[k] = (v1*i1 - v2*i2) / (2.0*v2*i2 - v1*i2 - v2*i1)
+		}
+
+		gains, phases := stbBode(T)
+		crossovers, crossings := stbMargins(frequencies, gains, phases, s.sweep)
+		fmt.Printf("Stability Analysis: loop gain at %s\n\n", probe.Label)
+		stbPrint(frequencies, gains, phases, crossovers, crossings, options.NumDgt)
+
+		if margin, found := stbWorst(crossovers); found {
+			scalars = append(scalars, outputScalar{"phase margin at " + probe.Label, margin})
+		}
+		if margin, found := stbWorst(crossings); found {
+			scalars = append(scalars, outputScalar{"gain margin at " + probe.Label, margin})
+		}
+
+		if plots.gain == nil {
+			plots.sweeps = make(map[string]acSweep)
+			plots.gain = make(map[string][]graphValues)
+			plots.phase = make(map[string][]graphValues)
+		}
+		if _, exists := plots.gain[probe.Label]; !exists {
+			plots.names = append(plots.names, probe.Label)
+		}
+		plots.sweeps[probe.Label] = s.sweep
+		x := stbAxis(frequencies, s.sweep)
+		plots.gain[probe.Label] = append(plots.gain[probe.Label], graphValues{name: label, t: x, v: gains})
+		plots.phase[probe.Label] = append(plots.phase[probe.Label], graphValues{name: label, t: x, v: phases})
+	}
+	return scalars
+}
+
+// stbBode returns the loop gain in dB and its phase in degrees, unwrapped along the sweep from a first value in
+// (-180, 180].
+func stbBode(T []complex128) ([]float64, []float64) {
+	gains := make([]float64, len(T))
+	phases := make([]float64, len(T))
+	for k, t := range T {
+		gains[k] = 20.0 * math.Log10(cmplx.Abs(t))
+		phases[k] = cmplx.Phase(t) * 180.0 / math.Pi
+		if k > 0 {
+			phases[k] = acUnwrapPhase(phases[k], phases[k-1])
+		}
+	}
+	return gains, phases
+}
+
+// stbAxis returns the x axis of the sweep: the frequency, or its decade for logarithmic sweeps.
+func stbAxis(frequencies []float64, sweep acSweep) []float64 {
+	x := make([]float64, len(frequencies))
+	for k, f := range frequencies {
+		x[k] = f
+		if sweep.sweepType != "lin" {
+			x[k] = math.Log10(f)
+		}
+	}
+	return x
+}
+
+// stbMargins finds the gain crossovers, where the loop gain crosses 0 dB, and the phase crossovers, where its
+// phase crosses -180 degrees modulo 360. Crossings are interpolated linearly between the points of the sweep,
+// against the decade of the frequency for logarithmic sweeps. The phase margin is 180 degrees plus the phase at
+// a gain crossover, the gain margin is the loop gain below 0 dB at a phase crossover.
+func stbMargins(frequencies []float64, gains []float64, phases []float64, sweep acSweep) ([]stbCrossing,
+	[]stbCrossing) {
+	x := stbAxis(frequencies, sweep)
+	frequency := func(x float64) float64 {
+		if sweep.sweepType != "lin" {
+			return math.Pow(10.0, x)
+		}
+		return x
+	}
+
+	crossovers := make([]stbCrossing, 0)
+	crossings := make([]stbCrossing, 0)
+	for k := 1; k < len(frequencies); k++ {
+		if (gains[k-1] > 0.0) != (gains[k] > 0.0) {
+			r := gains[k-1] / (gains[k-1] - gains[k])
+			phase := phases[k-1] + r*(phases[k]-phases[k-1])
+			crossovers = append(crossovers, stbCrossing{frequency(x[k-1] + r*(x[k]-x[k-1])), 180.0 + phase})
+		}
+
+		// Turns of the phase counted from -180 degrees
+		before := math.Floor((phases[k-1] + 180.0) / 360.0)
+		after := math.Floor((phases[k] + 180.0) / 360.0)
+		if before != after {
+			target := -180.0 + 360.0*math.Max(before, after)
+			r := (target - phases[k-1]) / (phases[k] - phases[k-1])
+			gain := gains[k-1] + r*(gains[k]-gains[k-1])
+			crossings = append(crossings, stbCrossing{frequency(x[k-1] + r*(x[k]-x[k-1])), -gain})
+		}
+	}
+	return crossovers, crossings
+}
+
+// stbWorst returns the smallest of the margins, if there is any.
+func stbWorst(crossings []stbCrossing) (float64, bool) {
+	if len(crossings) == 0 {
+		return 0.0, false
+	}
+	worst := crossings[0].margin
+	for _, c := range crossings[1:] {
+		worst = math.Min(worst, c.margin)
+	}
+	return worst, true
+}
+
+// stbPrint prints the loop gain at every frequency, then the crossovers with their margins.
+func stbPrint(frequencies []float64, gains []float64, phases []float64, crossovers []stbCrossing,
+	crossings []stbCrossing, digits int) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(writer, "\tfrequency\tgain (dB)\tphase (degrees)\t\n")
+	for k, f := range frequencies {
+		fmt.Fprintf(writer, "\t%.*g\t%.*g\t%.*g\t\n", digits+1, f, digits+1, gains[k], digits+1, phases[k])
+	}
+	writer.Flush()
+	fmt.Printf("\n")
+
+	for _, margins := range []struct {
+		name      string
+		margin    string
+		unit      string
+		crossings []stbCrossing
+	}{{"gain crossover", "phase margin", "degrees", crossovers}, {"phase crossover", "gain margin", "dB", crossings}} {
+		if len(margins.crossings) == 0 {
+			fmt.Printf("\t%s: none\n", margins.name)
+		}
+		for _, c := range margins.crossings {
+			fmt.Printf("\t%s: %.*g Hz, %s: %.*g %s\n", margins.name, digits+1, c.frequency, margins.margin, digits+1,
+				c.margin, margins.unit)
+		}
+	}
+	fmt.Printf("\n")
+}
+
+// stbPlot draws the Bode plot of the loop gain at every probe, one curve per run.
+func stbPlot(plots stbPlots) error {
+	for _, name := range plots.names {
+		xName := "f"
+		if plots.sweeps[name].sweepType != "lin" {
+			xName = "log10(f)"
+		}
+		file := "stb_" + graphFileName(name)
+		if err := graphRender(file+"_gain", xName, "dB", plots.gain[name]); err != nil {
+			return err
+		}
+		if err := graphRender(file+"_phase", xName, "degrees", plots.phase[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
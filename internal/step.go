@@ -0,0 +1,546 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+type stepKind int
+
+const (
+	stepKindParam   stepKind = iota // a .param parameter
+	stepKindElement stepKind = iota // the value of an element, the dc value of a source
+	stepKindTemp    stepKind = iota // the circuit temperature
+	stepKindRun     stepKind = iota // the run of a Monte Carlo analysis
+	stepKindLib     stepKind = iota // a .lib section, the values are indices of names
+)
+
+// stepSweep is one .step line. Nested steps run every value of a sweep for each value of the ones before it.
+type stepSweep struct {
+	kind   stepKind
+	name   string // parameter or element label
+	token  Token  // what is swept, for diagnostics
+	values []float64
+	names  []string // sections of a .lib sweep
+}
+
+// stepAnalyses are the analyses the netlist asks for, run once at every .step point
+type stepAnalyses struct {
+	op         bool
+	tran       bool
+	ac         bool
+	tStep      float64
+	tStop      float64
+	tStart     float64          // transient results before it are not saved
+	saves      []outputVariable // signals of the transient sent to the sinks and graphs, all of them if empty
+	title      string           // title of the netlist, for the sinks
+	sweep      acSweep
+	conditions mnaConditions
+	mc         *monteCarlo      // nil without .mc
+	wc         []outputVariable // outputs of .wc
+	tfs        []transferFunction
+	sens       []sensitivity
+	pzs        []poleZero
+	stbs       []stability
+	nets       []network
+	psss       []periodicSteadyState
+	hbs        []harmonicBalance
+	measures   []measure
+	fouriers   []fourier
+	noise      *noiseAnalysis // nil without .noise
+}
+
+// stepValues lists the values of "lin <start> <stop> <increment>" or "dec|oct <start> <stop> <points>".
+func stepValues(sweepType string, start float64, stop float64, increment float64) []float64 {
+	if sweepType != "lin" {
+		return acFrequencies(acSweep{sweepType: sweepType, points: int(increment), fStart: start, fStop: stop})
+	}
+
+	// Small tolerance so stop itself is not lost to rounding
+	values := make([]float64, 0)
+	n := int(math.Floor((stop-start)/increment + 1e-9))
+	for i := 0; i <= n; i++ {
+		values = append(values, start+float64(i)*increment)
+	}
+	return values
+}
+
+// stepPoints lists every combination of the sweep values, the last sweep varying fastest.
+func stepPoints(sweeps []stepSweep) [][]float64 {
+	points := [][]float64{{}}
+	for _, s := range sweeps {
+		next := make([][]float64, 0, len(points)*len(s.values))
+		for _, point := range points {
+			for _, value := range s.values {
+				combined := make([]float64, len(point), len(point)+1)
+				copy(combined, point)
+				next = append(next, append(combined, value))
+			}
+		}
+		points = next
+	}
+	return points
+}
+
+// stepLabel names a point as "<name>=<value> ...", empty without .step. Sweeps of the given kind are left out.
+func stepLabel(sweeps []stepSweep, point []float64, exclude stepKind) string {
+	parts := make([]string, 0, len(sweeps))
+	for i, s := range sweeps {
+		if s.kind == exclude {
+			continue
+		}
+		if s.kind == stepKindLib {
+			parts = append(parts, fmt.Sprintf("%s=%s", s.name, s.names[int(point[i])]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s=%g", s.name, point[i]))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// stepApply sets the parameters, models, element values and temperature of a point. The .lib sections in use add
+// their models and parameters. In a Monte Carlo run, element values start from nominals and are varied within
+// their tolerances.
+func stepApply(elementList *Element, models map[string]*Model, lib library, params []paramDefinition,
+	sweeps []stepSweep, point []float64, options *SimOptions, mc *monteCarlo,
+	nominals map[*Element]float64) (bool, map[string]float64) {
+	var run *monteCarloRun
+	overrides := make(map[string]float64)
+	for i, s := range sweeps {
+		switch s.kind {
+		case stepKindParam:
+			overrides[s.name] = point[i]
+		case stepKindRun:
+			run = monteCarloNewRun(*mc, int(point[i]))
+		}
+	}
+	for e, nominal := range nominals {
+		elementSetValue(e, nominal)
+	}
+
+	sections := librarySections(lib, sweeps, point)
+	models = libraryModels(models, sections)
+	if modelResolve(elementList, models) {
+		return true, nil
+	}
+
+	functions := monteCarloFunctions(run)
+	err, values := paramEvaluate(libraryParams(params, sections), overrides, functions)
+	if err != "" {
+		fmt.Fprintf(os.Stderr, "Parameter Error: %s\n", err)
+		return true, nil
+	}
+	if paramApply(elementList, values, functions) {
+		return true, nil
+	}
+
+	for i, s := range sweeps {
+		switch s.kind {
+		case stepKindElement:
+			elementSetValue(elementListFindByLabel(elementList, s.name), point[i])
+		case stepKindTemp:
+			options.Temp = point[i]
+		}
+	}
+
+	if run != nil && monteCarloApply(elementList, models, run) {
+		return true, nil
+	}
+	return temperatureApply(elementList, *options), values
+}
+
+// stepState is what the runs of a .step collect for the reports that follow the last of them
+type stepState struct {
+	elementList  *Element
+	models       map[string]*Model
+	lib          library
+	nodesMap     map[string]int
+	sweeps       []stepSweep
+	analyses     stepAnalyses
+	currentNodes map[string]int
+	labels       []string
+	samples      []monteCarloSample
+	opX          [][]float64
+	tranRuns     []*sinkRecorder
+	acX          [][][]complex128
+	F            []float64
+	tranMeasures measureTable
+	acMeasures   measureTable
+	dcMeasures   measureSweep
+	spectra      fourierSpectra
+	noises       noisePlots
+	roots        pzPlots
+	loops        stbPlots
+	waveforms    pssWaveforms
+	harmonics    hbSpectra
+	last         string // section printed last in the current run
+}
+
+// stepPoint is a single run of a .step
+type stepPoint struct {
+	point   []float64
+	label   string             // every sweep value of the run
+	group   string             // the sweep values but the Monte Carlo run
+	values  map[string]float64 // parameters of the run
+	options SimOptions
+}
+
+// stepRunner is an analysis of a .step point, run when the netlist asks for it. It returns the scalar results of
+// the run.
+type stepRunner struct {
+	section string
+	wanted  func(analyses stepAnalyses) bool
+	run     func(state *stepState, run stepPoint) []outputScalar
+}
+
+// stepRunners are the analyses of a .step point in the order they are printed
+var stepRunners = []stepRunner{
+	{"op", func(a stepAnalyses) bool { return a.op }, stepRunOperatingPoint},
+	{"wc", func(a stepAnalyses) bool { return len(a.wc) > 0 }, stepRunWorstCase},
+	{"tf", func(a stepAnalyses) bool { return len(a.tfs) > 0 }, stepRunTransferFunction},
+	{"sens", func(a stepAnalyses) bool { return len(a.sens) > 0 }, stepRunSensitivity},
+	{"pz", func(a stepAnalyses) bool { return len(a.pzs) > 0 }, stepRunPoleZero},
+	{"tran", func(a stepAnalyses) bool { return a.tran }, stepRunTransient},
+	{"pss", func(a stepAnalyses) bool { return len(a.psss) > 0 }, stepRunPeriodicSteadyState},
+	{"hb", func(a stepAnalyses) bool { return len(a.hbs) > 0 }, stepRunHarmonicBalance},
+	{"ac", func(a stepAnalyses) bool { return a.ac }, stepRunAC},
+	{"noise", func(a stepAnalyses) bool { return a.noise != nil }, stepRunNoise},
+	{"stb", func(a stepAnalyses) bool { return len(a.stbs) > 0 }, stepRunStability},
+	{"net", func(a stepAnalyses) bool { return len(a.nets) > 0 }, stepRunNetwork},
+}
+
+// stepRun runs the analyses at every .step point and reports all runs together: operating points as one table,
+// transient and AC curves overlaid in the graphs, the measurements, and the statistics of a Monte Carlo analysis.
+// Transfer function, sensitivity, pole-zero, Fourier, periodic steady-state, harmonic balance, noise, stability and
+// network analyses are printed with each run.
+func stepRun(elementList *Element, models map[string]*Model, lib library, nodesMap map[string]int,
+	params []paramDefinition, sweeps []stepSweep, analyses stepAnalyses, options SimOptions) {
+	var nominals map[*Element]float64
+	if analyses.mc != nil {
+		nominals = monteCarloNominals(elementList)
+	}
+
+	points := stepPoints(sweeps)
+	state := stepState{
+		elementList:  elementList,
+		models:       models,
+		lib:          lib,
+		nodesMap:     nodesMap,
+		sweeps:       sweeps,
+		analyses:     analyses,
+		labels:       make([]string, 0, len(points)),
+		samples:      make([]monteCarloSample, 0),
+		tranMeasures: measureTable{analysis: "tran"},
+		acMeasures:   measureTable{analysis: "ac"},
+	}
+
+	for i, point := range points {
+		runOptions := options
+		err, values := stepApply(elementList, models, lib, params, sweeps, point, &runOptions, analyses.mc, nominals)
+		if err {
+			return
+		}
+
+		run := stepPoint{
+			point:   point,
+			label:   stepLabel(sweeps, point, -1),
+			group:   stepLabel(sweeps, point, stepKindRun),
+			values:  values,
+			options: runOptions,
+		}
+		state.labels = append(state.labels, run.label)
+		if len(sweeps) > 0 {
+			fmt.Printf("Step %d/%d: %s\n\n", i+1, len(points), run.label)
+		}
+
+		state.last = ""
+		for _, runner := range stepRunners {
+			if !runner.wanted(analyses) {
+				continue
+			}
+
+			// A blank line sets the AC results apart from the sections that follow them
+			if state.last == "ac" && len(sweeps) == 0 {
+				fmt.Printf("\n")
+			}
+
+			// The results of every run make up the Monte Carlo statistics
+			for _, scalar := range runner.run(&state, run) {
+				state.samples = append(state.samples, monteCarloSample{run.group, scalar.name, scalar.value})
+			}
+			state.last = runner.section
+		}
+	}
+
+	if analyses.op && len(sweeps) > 0 {
+		stepPrintOperatingPoints(state.labels, state.opX, nodesMap, state.currentNodes, options.NumDgt)
+	}
+	if len(analyses.measures) > 0 {
+		if len(sweeps) > 0 || analyses.op {
+			fmt.Printf("\n")
+		}
+		tables := []measureTable{state.tranMeasures, state.acMeasures}
+		if analyses.op {
+			tables = append(tables, measureSweepRun(state.dcMeasures, analyses.measures))
+		}
+		measureReport(tables, measurementsFile, options.NumDgt)
+	}
+	if analyses.mc != nil {
+		fmt.Printf("\n")
+		monteCarloReport(*analyses.mc, state.samples, options.NumDgt)
+	}
+
+	if generateGraphs {
+		var err error
+		if analyses.tran {
+			err = genAllGraphs(state.labels, state.tranRuns)
+		}
+		if err == nil && analyses.ac {
+			err = genAllACGraphs(state.currentNodes, nodesMap, state.F, analyses.sweep.sweepType != "lin", state.labels,
+				state.acX)
+		}
+		if err == nil {
+			err = fourierPlot(state.spectra)
+		}
+		if err == nil && analyses.noise != nil {
+			err = noisePlot(state.noises, analyses.noise.sweep)
+		}
+		if err == nil {
+			err = pzPlot(state.roots)
+		}
+		if err == nil {
+			err = stbPlot(state.loops)
+		}
+		if err == nil {
+			err = pssPlot(state.waveforms)
+		}
+		if err == nil {
+			err = hbPlot(state.harmonics)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error generating graphs: %s", err)
+			os.Exit(-1)
+		}
+	}
+}
+
+// stepRunOperatingPoint solves the operating point, printing its matrices without .step. The last sweep is the x
+// axis of the dc measurements and the others tell their groups apart.
+func stepRunOperatingPoint(state *stepState, run stepPoint) []outputScalar {
+	analyses := state.analyses
+	var X, B []float64
+	var H [][]float64
+	X, H, B, state.currentNodes = mnaSolveLinear(state.elementList, state.nodesMap, analyses.conditions, run.options)
+	if len(state.sweeps) == 0 {
+		mnaPrintMatrices(H, B, X, state.nodesMap, state.currentNodes, run.options.NumDgt)
+	}
+	state.opX = append(state.opX, X)
+
+	outputs := make(map[string]float64)
+	for _, o := range measureOutputs(analyses.measures, "dc") {
+		outputs[outputName(o)] = outputValue(o, state.elementList, X, state.nodesMap, state.currentNodes)
+	}
+	x, sweep := 0.0, ""
+	if len(state.sweeps) > 0 {
+		last := len(state.sweeps) - 1
+		x, sweep = run.point[last], stepLabel(state.sweeps[:last], run.point[:last], -1)
+	}
+	measureSweepAdd(&state.dcMeasures, sweep, x, outputs, run.values)
+
+	// The tables of the other analyses follow the matrices after a blank line
+	tables := len(analyses.wc) > 0 || len(analyses.tfs) > 0 || len(analyses.sens) > 0 || len(analyses.pzs) > 0 ||
+		analyses.noise != nil || len(analyses.stbs) > 0 || len(analyses.nets) > 0 || len(analyses.psss) > 0 ||
+		len(analyses.hbs) > 0
+	if len(state.sweeps) == 0 && tables {
+		fmt.Printf("\n")
+	}
+	return outputSolution(X, state.nodesMap, state.currentNodes, "")
+}
+
+func stepRunWorstCase(state *stepState, run stepPoint) []outputScalar {
+	worstCaseRun(state.elementList, state.nodesMap, state.analyses.wc, state.analyses.conditions, run.options)
+	return nil
+}
+
+func stepRunTransferFunction(state *stepState, run stepPoint) []outputScalar {
+	return tfRun(state.analyses.tfs, state.elementList, state.nodesMap, state.analyses.conditions, run.options)
+}
+
+func stepRunSensitivity(state *stepState, run stepPoint) []outputScalar {
+	models := libraryModels(state.models, librarySections(state.lib, state.sweeps, run.point))
+	sensRun(state.analyses.sens, state.elementList, models, state.nodesMap, state.analyses.conditions, run.options)
+	return nil
+}
+
+func stepRunPoleZero(state *stepState, run stepPoint) []outputScalar {
+	pzRun(state.analyses.pzs, state.elementList, state.nodesMap, state.analyses.conditions, run.options, run.label,
+		&state.roots)
+	return nil
+}
+
+// stepRunTransient runs the transient analysis. The saved signals go to the sinks and graphs from tstart on, while
+// measurements and Fourier analyses see all of the run of their outputs.
+func stepRunTransient(state *stepState, run stepPoint) []outputScalar {
+	analyses := state.analyses
+	elementList, nodesMap := state.elementList, state.nodesMap
+	saved := sinkFeed{
+		run:     SinkRun{Title: analyses.title, Label: run.label},
+		outputs: analyses.saves,
+		tStart:  analyses.tStart,
+		sinks:   sinks,
+	}
+	if generateGraphs {
+		graph := sinkNewRecorder(graphPoints)
+		state.tranRuns = append(state.tranRuns, graph)
+		saved.sinks = append([]Sink{graph}, sinks...)
+	}
+	waves := sinkNewRecorder(0)
+	measured := sinkFeed{outputs: stepWaveOutputs(analyses)}
+	if len(analyses.measures) > 0 || len(analyses.fouriers) > 0 {
+		measured.sinks = []Sink{waves}
+	}
+
+	var t float64
+	var X []float64
+	t, X, state.currentNodes = mnaSolveDynamic(elementList, nodesMap, analyses.tStep, analyses.tStop,
+		analyses.conditions, run.options, func(t float64, X []float64, currentNodes map[string]int) {
+			sinkFeedPoint(&saved, elementList, nodesMap, t, X, currentNodes)
+			sinkFeedPoint(&measured, elementList, nodesMap, t, X, currentNodes)
+		})
+	sinkFeedEnd(&saved)
+	sinkFeedEnd(&measured)
+	scalars := outputSolution(X, nodesMap, state.currentNodes, fmt.Sprintf(" at t=%g", t))
+
+	wave := func(o outputVariable) []float64 {
+		return sinkRecorderWave(waves, outputName(o))
+	}
+	scalars = append(scalars, stepMeasure(&state.tranMeasures, analyses.measures, waves.T, wave, run.values,
+		run.label)...)
+	return append(scalars, fourierRun(analyses.fouriers, waves.T, wave, run.label, &state.spectra,
+		run.options.NumDgt)...)
+}
+
+func stepRunPeriodicSteadyState(state *stepState, run stepPoint) []outputScalar {
+	return pssRun(state.analyses.psss, state.elementList, state.nodesMap, state.analyses.conditions, run.options,
+		run.label, &state.waveforms)
+}
+
+func stepRunHarmonicBalance(state *stepState, run stepPoint) []outputScalar {
+	return hbRun(state.analyses.hbs, state.elementList, state.nodesMap, state.analyses.conditions, run.options,
+		run.label, &state.harmonics)
+}
+
+func stepRunAC(state *stepState, run stepPoint) []outputScalar {
+	analyses := state.analyses
+	var X [][]complex128
+	state.F, X, state.currentNodes = acSolve(state.elementList, state.nodesMap, analyses.sweep, analyses.conditions,
+		run.options)
+	acPrintResults(state.F, X, state.nodesMap, state.currentNodes, run.options.NumDgt)
+	state.acX = append(state.acX, X)
+
+	F, currentNodes := state.F, state.currentNodes
+	wave := func(o outputVariable) []float64 {
+		y := make([]float64, len(F))
+		for k := range F {
+			y[k] = outputPart(o, outputPhasor(o, state.elementList, X[k], state.nodesMap, currentNodes))
+		}
+		return y
+	}
+	scalars := stepMeasure(&state.acMeasures, analyses.measures, F, wave, run.values, run.label)
+	if len(state.sweeps) > 0 {
+		fmt.Printf("\n")
+	}
+	return scalars
+}
+
+func stepRunNoise(state *stepState, run stepPoint) []outputScalar {
+	analyses := state.analyses
+	return noiseRun(*analyses.noise, state.elementList, state.nodesMap, analyses.conditions, run.options, run.label,
+		&state.noises)
+}
+
+func stepRunStability(state *stepState, run stepPoint) []outputScalar {
+	analyses := state.analyses
+	return stbRun(analyses.stbs, state.elementList, state.nodesMap, analyses.conditions, run.options, run.label,
+		&state.loops)
+}
+
+func stepRunNetwork(state *stepState, run stepPoint) []outputScalar {
+	analyses := state.analyses
+	netRun(analyses.nets, state.elementList, state.nodesMap, analyses.conditions, run.options, run.label)
+	return nil
+}
+
+// stepMeasure adds the measurements of a transient or AC run to its table, and returns the ones that succeeded.
+func stepMeasure(table *measureTable, measures []measure, x []float64, wave measureWave, params map[string]float64,
+	label string) []outputScalar {
+	scalars := make([]outputScalar, 0)
+	names, results := measureRun(measures, table.analysis, x, wave, params)
+	table.names = names
+	table.labels = append(table.labels, label)
+	table.rows = append(table.rows, results)
+	for i, r := range results {
+		if r.err == "" {
+			scalars = append(scalars, outputScalar{names[i], r.value})
+		}
+	}
+	return scalars
+}
+
+// stepWaveOutputs lists the outputs the transient measurements and Fourier analyses need the waveforms of.
+func stepWaveOutputs(analyses stepAnalyses) []outputVariable {
+	outputs := measureOutputs(analyses.measures, "tran")
+	used := make(map[string]bool)
+	for _, o := range outputs {
+		used[outputName(o)] = true
+	}
+	for _, f := range analyses.fouriers {
+		for _, o := range f.outputs {
+			if !used[outputName(o)] {
+				used[outputName(o)] = true
+				outputs = append(outputs, o)
+			}
+		}
+	}
+	return outputs
+}
+
+// stepPrintOperatingPoints prints the operating point of every step as a row of a table.
+func stepPrintOperatingPoints(labels []string, X [][]float64, nodesMap map[string]int, currentNodes map[string]int, digits int) {
+	nodes := acSortedKeys(nodesMap)
+	currents := acSortedKeys(currentNodes)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Printf("Operating Points:\n\n")
+	fmt.Fprintf(writer, "\tstep\t")
+	for _, k := range nodes {
+		if nodesMap[k] != 0 {
+			fmt.Fprintf(writer, "V(%s)\t", k)
+		}
+	}
+	for _, k := range currents {
+		if currentNodes[k] != 0 && !mnaIsInternal(k) {
+			fmt.Fprintf(writer, "I(%s)\t", k)
+		}
+	}
+	fmt.Fprintf(writer, "\n")
+
+	for run, label := range labels {
+		fmt.Fprintf(writer, "\t%s\t", label)
+		for _, k := range nodes {
+			if v := nodesMap[k]; v != 0 {
+				fmt.Fprintf(writer, "%.*f\t", digits, X[run][v-1])
+			}
+		}
+		for _, k := range currents {
+			if v := currentNodes[k]; v != 0 && !mnaIsInternal(k) {
+				fmt.Fprintf(writer, "%.*f\t", digits, X[run][v-1])
+			}
+		}
+		fmt.Fprintf(writer, "\n")
+	}
+	writer.Flush()
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"os"
+)
+
+const (
+	temperatureZero      = 273.15          // 0 C in kelvin
+	temperatureBoltzmann = 1.380649e-23    // J/K
+	temperatureCharge    = 1.602176634e-19 // C
+)
+
+// instanceTemperature is the temperature of an element given by temp= (absolute) or dtemp= (relative to
+// the circuit temperature)
+type instanceTemperature struct {
+	temp      float64
+	tempGiven bool
+	dtemp     float64
+}
+
+type resistorDescriptor struct {
+	nominal float64 // resistance at tnom
+	tc1     float64 // first order coefficient (1/C)
+	tc2     float64 // second order coefficient (1/C^2)
+	tce     float64 // exponential coefficient (%/C), takes precedence over tc1 and tc2
+	instanceTemperature
+}
+
+// temperatureOf returns the temperature (C) of an element at circuit temperature options.Temp.
+func temperatureOf(instance instanceTemperature, options SimOptions) float64 {
+	if instance.tempGiven {
+		return instance.temp
+	}
+	return options.Temp + instance.dtemp
+}
+
+// temperatureThermalVoltage returns kT/q at the given temperature (C).
+func temperatureThermalVoltage(temp float64) float64 {
+	return temperatureBoltzmann * (temp + temperatureZero) / temperatureCharge
+}
+
+// temperatureApply updates the temperature dependent values of every element to the circuit temperature
+// options.Temp. Model parameters are measured at options.Tnom.
+func temperatureApply(elementList *Element, options SimOptions) bool {
+	for e := elementList; e != nil; e = e.Next {
+		switch e.ElementType {
+		case ElementResistor:
+			temp := options.Temp
+			if desc, given := e.Extra.(*resistorDescriptor); given {
+				temp = temperatureOf(desc.instanceTemperature, options)
+				dt := temp - options.Tnom
+				if desc.tce != 0.0 {
+					e.Value = desc.nominal * math.Pow(1.01, desc.tce*dt)
+				} else {
+					e.Value = desc.nominal * (1 + desc.tc1*dt + desc.tc2*dt*dt)
+				}
+			}
+			if e.Value <= 0.0 {
+				fmt.Fprintf(os.Stderr, "Temperature Error: Resistor %s has no positive value at %g C\n", e.Label, temp)
+				return true
+			}
+
+		case ElementJFET:
+			desc := e.Extra.(*jfetDescriptor)
+			temp := temperatureOf(desc.instanceTemperature, options)
+			desc.vt = temperatureThermalVoltage(temp)
+
+			// Saturation current: IS(T) = IS (T/Tnom)^XTI exp(EG/VT(T) (T/Tnom - 1))
+			ratio := (temp + temperatureZero) / (options.Tnom + temperatureZero)
+			desc.isT = desc.is * math.Pow(ratio, desc.xti) * math.Exp(desc.eg/desc.vt*(ratio-1))
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+)
+
+// transferFunction is a .tf line: the DC small-signal gain from an independent source to an output
+type transferFunction struct {
+	output outputVariable // a voltage, or the current of a voltage source
+	source string
+	token  Token // input source, for diagnostics
+}
+
+// tfRun linearizes the circuit at its operating point and solves the system factored once for each quantity: the
+// response to a unit input gives the gain and the input resistance, a unit excitation at the output gives the
+// output resistance. Returns the three of each transfer function.
+func tfRun(tfs []transferFunction, elementList *Element, nodesMap map[string]int, conditions mnaConditions,
+	options SimOptions) []outputScalar {
+	conditions.quiet = true
+	scalars := make([]outputScalar, 0)
+	_, H, _, currentNodes := mnaSolveLinear(elementList, nodesMap, conditions, options)
+	LU, P := mnaLUFactorization(H, nil)
+
+	for _, tf := range tfs {
+		source := elementListFindByLabel(elementList, tf.source)
+		X := mnaLUSolve(LU, P, tfExcitation(source, len(H), currentNodes))
+		gain := outputValue(tf.output, elementList, X, nodesMap, currentNodes)
+		input := tfResistance(source, X, currentNodes)
+
+		var output float64
+		if tf.output.current {
+			e := elementListFindByLabel(elementList, tf.output.node)
+			output = tfResistance(e, mnaLUSolve(LU, P, tfExcitation(e, len(H), currentNodes)), currentNodes)
+		} else {
+			// A unit current flowing into the output node from its reference
+			B := make([]float64, len(H))
+			mnaStampCurrent(B, nodesMap[tf.output.ref], nodesMap[tf.output.node], 1.0)
+			output = outputValue(tf.output, elementList, mnaLUSolve(LU, P, B), nodesMap, currentNodes)
+		}
+
+		tfPrint(tf, source, gain, input, output, options.NumDgt)
+		name := outputName(tf.output) + "/" + source.Label
+		scalars = append(scalars, outputScalar{name, gain},
+			outputScalar{"input resistance of " + name, input},
+			outputScalar{"output resistance of " + name, output})
+	}
+	return scalars
+}
+
+// tfExcitation returns the right-hand side of a unit small-signal value of an independent source.
+func tfExcitation(source *Element, size int, currentNodes map[string]int) []float64 {
+	B := make([]float64, size)
+	if index, exists := currentNodes[source.Label]; exists {
+		B[index-1] = 1.0
+	} else {
+		mnaStampCurrent(B, source.Nodes[0], source.Nodes[1], 1.0)
+	}
+	return B
+}
+
+// tfResistance returns the resistance the circuit shows to a source excited by tfExcitation: the voltage across
+// a unit current, or a unit voltage over the current it drives into the circuit.
+func tfResistance(source *Element, X []float64, currentNodes map[string]int) float64 {
+	if source.ElementType == ElementCurrentSource {
+		return mnaVoltageAcross(X, source.Nodes[1], source.Nodes[0])
+	}
+	current := -X[currentNodes[source.Label]-1]
+	if current == 0.0 {
+		return math.Inf(1)
+	}
+	return 1.0 / current
+}
+
+// tfPrint prints the gain of a .tf and the resistances seen at its input and output.
+func tfPrint(tf transferFunction, source *Element, gain float64, input float64, output float64, digits int) {
+	units := map[bool]string{false: "V", true: "A"}
+	fmt.Printf("Transfer Function: %s/%s\n\n", outputName(tf.output), source.Label)
+	fmt.Printf("\tgain: %.*g %s/%s\n", digits+1, gain, units[tf.output.current],
+		units[source.ElementType == ElementCurrentSource])
+	fmt.Printf("\tinput resistance at %s: %.*g ohm\n", source.Label, digits+1, input)
+	fmt.Printf("\toutput resistance at %s: %.*g ohm\n\n", outputName(tf.output), digits+1, output)
+}
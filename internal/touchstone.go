@@ -0,0 +1,324 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const touchstoneSingular = 1e-12 // size of a pivot, relative to the largest entry, taken as zero
+
+// touchstoneData are the S-parameters of an N-port at each frequency of a Touchstone file
+type touchstoneData struct {
+	ports       int
+	z0          float64 // reference impedance
+	frequencies []float64
+	S           [][][]complex128
+}
+
+// touchstoneDescriptor is an N-port element ('n') described by a Touchstone file
+type touchstoneDescriptor struct {
+	path string
+	data *touchstoneData
+}
+
+// touchstoneRead reads a Touchstone version 1 file. The number of ports comes from the .sNp extension, the options
+// line '# <unit> <parameter> <format> R <z0>' tells how the data are given. Y and Z parameters are normalized to
+// z0 and converted to S-parameters. Returns an error message, empty if the file is valid.
+func touchstoneRead(path string) (string, *touchstoneData) {
+	ports := 0
+	extension := strings.ToLower(filepath.Ext(path))
+	fmt.Sscanf(extension, ".s%dp", &ports)
+	if ports < 1 || extension != fmt.Sprintf(".s%dp", ports) {
+		return "the extension must be .s<N>p, the number of ports", nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "can not be read", nil
+	}
+
+	unit, parameter, format := 1e9, "s", "ma"
+	data := &touchstoneData{ports: ports, z0: 50.0}
+	values := make([]float64, 0)
+	options := false
+	for i, line := range strings.Split(string(content), "\n") {
+		if comment := strings.Index(line, "!"); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(strings.ToLower(line))
+		if len(fields) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(fields[0], "[") {
+			return fmt.Sprintf("line %d: Touchstone 2.0 keywords are not supported", i+1), nil
+		}
+		if strings.HasPrefix(fields[0], "#") {
+			// Only the first options line counts
+			if options {
+				continue
+			}
+			options = true
+			fields = append([]string{strings.TrimPrefix(fields[0], "#")}, fields[1:]...)
+			for k := 0; k < len(fields); k++ {
+				switch f := fields[k]; f {
+				case "":
+				case "hz", "khz", "mhz", "ghz":
+					unit = map[string]float64{"hz": 1.0, "khz": 1e3, "mhz": 1e6, "ghz": 1e9}[f]
+				case "s", "y", "z":
+					parameter = f
+				case "h", "g":
+					return fmt.Sprintf("line %d: %s-parameters are not supported", i+1, strings.ToUpper(f)), nil
+				case "db", "ma", "ri":
+					format = f
+				case "r":
+					if k+1 == len(fields) {
+						return fmt.Sprintf("line %d: 'R' needs the reference impedance", i+1), nil
+					}
+					k++
+					z0, err := strconv.ParseFloat(fields[k], 64)
+					if err != nil || z0 <= 0.0 {
+						return fmt.Sprintf("line %d: invalid reference impedance '%s'", i+1, fields[k]), nil
+					}
+					data.z0 = z0
+				default:
+					return fmt.Sprintf("line %d: unknown option '%s'", i+1, f), nil
+				}
+			}
+			continue
+		}
+
+		for _, f := range fields {
+			value, err := strconv.ParseFloat(f, 64)
+			if err != nil {
+				return fmt.Sprintf("line %d: invalid number '%s'", i+1, f), nil
+			}
+			values = append(values, value)
+		}
+	}
+
+	// Each frequency is followed by the N^2 parameters as pairs, row by row; the two-port order is 11 21 12 22
+	record := 1 + 2*ports*ports
+	if len(values) == 0 || len(values)%record != 0 {
+		return fmt.Sprintf("expected a frequency and %d values per point, found %d values", record-1, len(values)), nil
+	}
+	for r := 0; r < len(values); r += record {
+		f := values[r] * unit
+		if len(data.frequencies) > 0 && f <= data.frequencies[len(data.frequencies)-1] {
+			return fmt.Sprintf("frequencies must increase, found %g Hz after %g Hz", f,
+				data.frequencies[len(data.frequencies)-1]), nil
+		}
+
+		P := make([][]complex128, ports)
+		for i := range P {
+			P[i] = make([]complex128, ports)
+		}
+		for k := 0; k < ports*ports; k++ {
+			a, b := values[r+1+2*k], values[r+2+2*k]
+			var v complex128
+			switch format {
+			case "ri":
+				v = complex(a, b)
+			case "ma":
+				v = cmplx.Rect(a, b*math.Pi/180.0)
+			case "db":
+				v = cmplx.Rect(math.Pow(10.0, a/20.0), b*math.Pi/180.0)
+			}
+			i, j := k/ports, k%ports
+			if ports == 2 {
+				i, j = j, i
+			}
+			P[i][j] = v
+		}
+
+		S := P
+		switch parameter {
+		case "y":
+			S = touchstoneCayley(P)
+		case "z":
+			S = touchstoneScale(touchstoneCayley(P), -1.0)
+		}
+		if S == nil {
+			return fmt.Sprintf("the %s-parameters at %g Hz have no S-parameters", strings.ToUpper(parameter), f), nil
+		}
+		if touchstoneAdmittanceOf(S, data.z0) == nil {
+			return fmt.Sprintf("the network has no admittance at %g Hz", f), nil
+		}
+		data.frequencies = append(data.frequencies, f)
+		data.S = append(data.S, S)
+	}
+	return "", data
+}
+
+// touchstoneCayley returns (I + M)^-1 (I - M), nil if I + M is singular. The transform is its own inverse, and
+// turns normalized Y-parameters into S-parameters and back: S = C(Yn), Yn = C(S), and for Z-parameters -S = C(Zn).
+func touchstoneCayley(M [][]complex128) [][]complex128 {
+	n := len(M)
+	minus := make([][]complex128, n)
+	plus := make([][]complex128, n)
+	for i := range M {
+		minus[i] = make([]complex128, n)
+		plus[i] = make([]complex128, n)
+		for j := range M[i] {
+			minus[i][j] = -M[i][j]
+			plus[i][j] = M[i][j]
+		}
+		minus[i][i] += 1.0
+		plus[i][i] += 1.0
+	}
+	return touchstoneDivide(plus, minus)
+}
+
+// touchstoneScale returns c M, nil if M is nil.
+func touchstoneScale(M [][]complex128, c complex128) [][]complex128 {
+	if M == nil {
+		return nil
+	}
+	scaled := make([][]complex128, len(M))
+	for i := range M {
+		scaled[i] = make([]complex128, len(M[i]))
+		for j := range M[i] {
+			scaled[i][j] = c * M[i][j]
+		}
+	}
+	return scaled
+}
+
+// touchstoneAdmittanceOf returns the admittance matrix of S-parameters referred to z0, nil if the network has none.
+func touchstoneAdmittanceOf(S [][]complex128, z0 float64) [][]complex128 {
+	return touchstoneScale(touchstoneCayley(S), complex(1.0/z0, 0.0))
+}
+
+// touchstoneDivide returns A^-1 B, nil if A is singular: a pivot vanishes next to the largest entry of A.
+func touchstoneDivide(A [][]complex128, B [][]complex128) [][]complex128 {
+	n := len(A)
+	scale := 0.0
+	for i := range A {
+		for j := range A[i] {
+			scale = math.Max(scale, cmplx.Abs(A[i][j]))
+		}
+	}
+	LU, P := acLUFactorization(A)
+	for k := range LU {
+		if cmplx.Abs(LU[k][k]) <= touchstoneSingular*scale {
+			return nil
+		}
+	}
+	X := make([][]complex128, n)
+	for i := range X {
+		X[i] = make([]complex128, n)
+	}
+	for j := 0; j < n; j++ {
+		column := make([]complex128, n)
+		for i := range column {
+			column[i] = B[i][j]
+		}
+		column = acLUSolve(LU, P, column)
+		for i := range column {
+			X[i][j] = column[i]
+		}
+	}
+	return X
+}
+
+// touchstoneAdmittance returns the admittance matrix of the network at frequency f. The S-parameters are
+// interpolated linearly between the points of the file, and held at its first and last points outside of them.
+func touchstoneAdmittance(data *touchstoneData, f float64) [][]complex128 {
+	k := 0
+	for k < len(data.frequencies)-1 && data.frequencies[k+1] <= f {
+		k++
+	}
+	if k == len(data.frequencies)-1 || f <= data.frequencies[0] {
+		return touchstoneAdmittanceOf(data.S[k], data.z0)
+	}
+
+	r := complex((f-data.frequencies[k])/(data.frequencies[k+1]-data.frequencies[k]), 0.0)
+	S := make([][]complex128, data.ports)
+	for i := range S {
+		S[i] = make([]complex128, data.ports)
+		for j := range S[i] {
+			S[i][j] = data.S[k][i][j] + r*(data.S[k+1][i][j]-data.S[k][i][j])
+		}
+	}
+	Y := touchstoneAdmittanceOf(S, data.z0)
+	if Y == nil {
+		// Singular between two points, take the nearest one
+		if real(r) > 0.5 {
+			k++
+		}
+		Y = touchstoneAdmittanceOf(data.S[k], data.z0)
+	}
+	return Y
+}
+
+// touchstoneStamp adds the admittance Y of an N-port element through add(row, column, y): the current into the
+// positive node of port i is the sum over j of Y[i][j] times the voltage of port j.
+func touchstoneStamp(e *Element, Y [][]complex128, add func(int, int, complex128)) {
+	for i := range Y {
+		for j := range Y[i] {
+			rows := [2]int{e.Nodes[2*i], e.Nodes[2*i+1]}
+			columns := [2]int{e.Nodes[2*j], e.Nodes[2*j+1]}
+			for a, row := range rows {
+				for b, column := range columns {
+					if row == 0 || column == 0 {
+						continue
+					}
+					if a == b {
+						add(row-1, column-1, Y[i][j])
+					} else {
+						add(row-1, column-1, -Y[i][j])
+					}
+				}
+			}
+		}
+	}
+}
+
+// touchstoneWrite writes S-parameters referred to z0 as a Touchstone file, in magnitude and angle. The two-port
+// order is 11 21 12 22; larger networks are written row by row, at most four pairs on a line. Frequencies where S
+// is undefined are left out with a warning, so the file can still be read back.
+func touchstoneWrite(path string, comment string, frequencies []float64, S [][][]complex128, z0 float64) bool {
+	f, err := os.Create(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Network Error: %s\n", err)
+		return true
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "! %s\n", comment)
+	fmt.Fprintf(f, "# Hz S MA R %g\n", z0)
+	for k, frequency := range frequencies {
+		if S[k] == nil {
+			fmt.Fprintf(os.Stderr, "Network Warning: S-parameters undefined at f=%g Hz, left out of %s\n", frequency, path)
+			continue
+		}
+		n := len(S[k])
+		fmt.Fprintf(f, "%.*g", 15, frequency)
+		pair := func(v complex128) {
+			fmt.Fprintf(f, " %.*g %.*g", 12, cmplx.Abs(v), 12, cmplx.Phase(v)*180.0/math.Pi)
+		}
+		if n == 2 {
+			pair(S[k][0][0])
+			pair(S[k][1][0])
+			pair(S[k][0][1])
+			pair(S[k][1][1])
+			fmt.Fprintf(f, "\n")
+			continue
+		}
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				if (j > 0 && j%4 == 0) || (i > 0 && j == 0) {
+					fmt.Fprintf(f, "\n ")
+				}
+				pair(S[k][i][j])
+			}
+		}
+		fmt.Fprintf(f, "\n")
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// worstCaseElement is the sensitivity of an output to an element with a tolerance
+type worstCaseElement struct {
+	element     *Element
+	nominal     float64 // value at the nominal temperature
+	tolerance   float64 // dev and lot added up, both may push the value to the same end
+	sensitivity float64 // change of the output per unit of the value
+}
+
+// worstCaseRun computes the sensitivity of every output to each element with a tolerance, by moving the element
+// to the upper end of its tolerance. This is a one-sided finite difference, not the adjoint derivative of .sens, so
+// it also holds some of the curvature over the tolerance. It then solves the two extreme corners of each output:
+// every element at the end of its tolerance that raises the output, and every element at the opposite end.
+func worstCaseRun(elementList *Element, nodesMap map[string]int, outputs []outputVariable, conditions mnaConditions,
+	options SimOptions) {
+	conditions.quiet = true
+	// Values are set like the sweeps set them, at the nominal temperature, then scaled to the one of the run
+	set := func(e *Element, value float64) {
+		elementSetValue(e, value)
+		temperatureApply(elementList, options)
+	}
+	solve := func() []float64 {
+		X, _, _, currentNodes := mnaSolveLinear(elementList, nodesMap, conditions, options)
+		values := make([]float64, len(outputs))
+		for i, o := range outputs {
+			values[i] = outputValue(o, elementList, X, nodesMap, currentNodes)
+		}
+		return values
+	}
+
+	nominal := solve()
+	elements := make([]worstCaseElement, 0)
+	sensitivities := make([][]float64, 0)
+	for e := elementList; e != nil; e = e.Next {
+		t := e.Tolerance.dev + e.Tolerance.lot
+		if t == 0.0 || e.Value == 0.0 {
+			continue
+		}
+		w := worstCaseElement{element: e, nominal: e.Value, tolerance: t}
+		if desc, given := e.Extra.(*resistorDescriptor); given {
+			w.nominal = desc.nominal
+		}
+		set(e, w.nominal*(1.0+t))
+		perturbed := solve()
+		set(e, w.nominal)
+
+		S := make([]float64, len(outputs))
+		for i := range outputs {
+			S[i] = (perturbed[i] - nominal[i]) / (w.nominal * t)
+		}
+		elements = append(elements, w)
+		sensitivities = append(sensitivities, S)
+	}
+
+	if len(elements) == 0 {
+		fmt.Fprintf(os.Stderr, "Worst Case Error: No element has a tolerance\n")
+		return
+	}
+
+	for i, o := range outputs {
+		for k := range elements {
+			elements[k].sensitivity = sensitivities[k][i]
+		}
+		maximum := worstCaseCorner(elements, 1.0, set, solve)[i]
+		minimum := worstCaseCorner(elements, -1.0, set, solve)[i]
+		worstCasePrint(o, nominal[i], maximum, minimum, elements, options.NumDgt)
+	}
+}
+
+// worstCaseCorner solves the circuit with every element at the end of its tolerance that moves the output in the
+// given direction, restoring the nominal values afterwards.
+func worstCaseCorner(elements []worstCaseElement, direction float64, set func(*Element, float64),
+	solve func() []float64) []float64 {
+	for _, w := range elements {
+		if w.sensitivity != 0.0 {
+			set(w.element, w.nominal*(1.0+direction*math.Copysign(w.tolerance, w.sensitivity)))
+		}
+	}
+	values := solve()
+	for _, w := range elements {
+		set(w.element, w.nominal)
+	}
+	return values
+}
+
+// worstCasePrint reports the corners of an output and the elements driving them, largest contribution first.
+// The contribution is the linear estimate of the change an element causes at its end of the tolerance.
+func worstCasePrint(o outputVariable, nominal float64, maximum float64, minimum float64, elements []worstCaseElement,
+	digits int) {
+	ranked := append([]worstCaseElement{}, elements...)
+	contribution := func(w worstCaseElement) float64 {
+		return math.Abs(w.sensitivity * w.nominal * w.tolerance)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return contribution(ranked[i]) > contribution(ranked[j])
+	})
+	total := 0.0
+	for _, w := range ranked {
+		total = total + contribution(w)
+	}
+
+	fmt.Printf("Worst Case Analysis: %s\n\n", outputName(o))
+	fmt.Printf("\tnominal: %.*g\n", digits+1, nominal)
+	fmt.Printf("\tmaximum: %.*g (%+.*g)\n", digits+1, maximum, digits+1, maximum-nominal)
+	fmt.Printf("\tminimum: %.*g (%+.*g)\n\n", digits+1, minimum, digits+1, minimum-nominal)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(writer, "\telement\tvalue\ttolerance\tsensitivity\tcontribution\tshare\tat maximum\t\n")
+	for _, w := range ranked {
+		share := 0.0
+		if total > 0.0 {
+			share = 100.0 * contribution(w) / total
+		}
+		end := "-"
+		if w.sensitivity > 0.0 {
+			end = "high"
+		} else if w.sensitivity < 0.0 {
+			end = "low"
+		}
+		fmt.Fprintf(writer, "\t%s\t%.*g\t%g%%\t%.*g\t%.*g\t%.1f%%\t%s\t\n", w.element.Label, digits+1, w.nominal,
+			100.0*w.tolerance, digits+1, w.sensitivity, digits+1, contribution(w), share, end)
+	}
+	writer.Flush()
+	fmt.Printf("\n")
+}